@@ -0,0 +1,519 @@
+package secureoperator
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+const (
+	// BlockNXDomain answers queries for blocked names with NXDOMAIN
+	BlockNXDomain = "nxdomain"
+	// BlockNull answers A and AAAA queries for blocked names with the
+	// unspecified addresses 0.0.0.0 and ::
+	BlockNull = "null"
+	// BlockSinkhole answers A and AAAA queries for blocked names with the
+	// addresses of a sinkhole
+	BlockSinkhole = "sinkhole"
+
+	// DefaultBlockTTL is the TTL of answers for blocked names, unless
+	// otherwise specified
+	DefaultBlockTTL = 60 * time.Second
+)
+
+// names found in hosts files which refer to the local machine, and so are
+// never blocked
+var localHostNames = map[string]bool{
+	"localhost.":             true,
+	"localhost.localdomain.": true,
+	"local.":                 true,
+	"broadcasthost.":         true,
+	"ip6-localhost.":         true,
+	"ip6-loopback.":          true,
+	"ip6-localnet.":          true,
+	"ip6-mcastprefix.":       true,
+	"ip6-allnodes.":          true,
+	"ip6-allrouters.":        true,
+	"ip6-allhosts.":          true,
+	"0.0.0.0.":               true,
+}
+
+// BlocklistOptions is a configuration object for optional Blocklist
+// configuration
+type BlocklistOptions struct {
+	// Files are the paths of the lists of names to block. Each line of a list
+	// is a rule, in one of the formats:
+	//
+	//   - a hosts file entry, "0.0.0.0 example.com", which blocks the names
+	//     given exactly
+	//   - a plain name, "example.com", which blocks only that name
+	//   - an Adblock rule, "||example.com^", which blocks the name and all of
+	//     its subdomains
+	//   - a wildcard, "*.example.com", where "*" matches any characters
+	//   - a regular expression between slashes, "/^track\d+\./", matched
+	//     against the name without its trailing period
+	//
+	// A rule prefixed with "@@" allows the names it matches, rather than
+	// blocking them. Comments, and Adblock rules of other kinds, are ignored.
+	Files []string
+	// AllowFiles are the paths of lists of names to allow, in the same formats
+	// as Files; names matching any rule in them are never blocked.
+	AllowFiles []string
+	// Mode is how queries for blocked names are answered; one of
+	// BlockNXDomain, BlockNull or BlockSinkhole. If not provided,
+	// BlockNXDomain is used.
+	Mode string
+	// SinkholeIPs are the addresses given in answers in BlockSinkhole mode;
+	// IPv4 addresses answer A queries, and IPv6 addresses AAAA queries.
+	SinkholeIPs []net.IP
+	// TTL is the TTL of answers for blocked names; if not provided,
+	// DefaultBlockTTL is used.
+	TTL time.Duration
+	// ReloadInterval is the interval at which the lists are reloaded from
+	// their files. If not provided, they are only loaded once.
+	ReloadInterval time.Duration
+}
+
+// NewBlocklist creates a Blocklist, loading its lists
+func NewBlocklist(opts *BlocklistOptions) (*Blocklist, error) {
+	if opts == nil {
+		opts = &BlocklistOptions{}
+	}
+	if opts.Mode == "" {
+		opts.Mode = BlockNXDomain
+	}
+	if opts.TTL == 0 {
+		opts.TTL = DefaultBlockTTL
+	}
+
+	switch opts.Mode {
+	case BlockNXDomain, BlockNull:
+	case BlockSinkhole:
+		if len(opts.SinkholeIPs) == 0 {
+			return nil, fmt.Errorf("sinkhole mode requires sinkhole IPs")
+		}
+	default:
+		return nil, fmt.Errorf("invalid block mode %v", opts.Mode)
+	}
+
+	b := &Blocklist{opts: opts, stop: make(chan struct{})}
+	if err := b.Reload(); err != nil {
+		return nil, err
+	}
+
+	if opts.ReloadInterval > 0 {
+		go b.reloadEvery(opts.ReloadInterval)
+	}
+
+	return b, nil
+}
+
+// Blocklist answers queries for blocked names locally, so that they are never
+// sent to the provider.
+type Blocklist struct {
+	opts *BlocklistOptions
+	stop chan struct{}
+	once sync.Once
+
+	mutex sync.RWMutex
+	allow *ruleSet
+	block *ruleSet
+}
+
+// Reload reads the lists from their files; if any can't be read, the lists
+// already loaded are kept.
+func (b *Blocklist) Reload() error {
+	allow, block := newRuleSet(), newRuleSet()
+
+	for _, path := range b.opts.Files {
+		if err := loadBlocklist(path, false, allow, block); err != nil {
+			return err
+		}
+	}
+	for _, path := range b.opts.AllowFiles {
+		if err := loadBlocklist(path, true, allow, block); err != nil {
+			return err
+		}
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.allow, b.block = allow, block
+	log.Infof("loaded %v block rules and %v allow rules", block.size(), allow.size())
+
+	return nil
+}
+
+// Close stops reloading the lists
+func (b *Blocklist) Close() {
+	b.once.Do(func() { close(b.stop) })
+}
+
+func (b *Blocklist) reloadEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := b.Reload(); err != nil {
+				log.Errorf("unable to reload blocklists: %v", err)
+			}
+		case <-b.stop:
+			return
+		}
+	}
+}
+
+// Blocked reports whether a name is blocked
+func (b *Blocklist) Blocked(name string) bool {
+	r := b.lookup(name)
+	return r != nil && !r.allow
+}
+
+// lookup returns the rule which matches a name, if any. Allow rules take
+// precedence over block rules; among rules of either kind, exact names are
+// matched first, then domains from the most specific, then wildcards and
+// regular expressions in the order they were listed.
+func (b *Blocklist) lookup(name string) *rule {
+	name = strings.ToLower(dns.Fqdn(name))
+
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	if r := b.allow.match(name); r != nil {
+		return r
+	}
+
+	return b.block.match(name)
+}
+
+// match returns the rule which matches a name, as lookup, counting the hit
+func (b *Blocklist) match(name string) *rule {
+	r := b.lookup(name)
+	if r != nil {
+		atomic.AddUint64(&r.hits, 1)
+		ruleHits.inc(r.list, r.action())
+	}
+
+	return r
+}
+
+// RuleHits is the number of queries which matched a rule
+type RuleHits struct {
+	List   string `json:"list"`
+	Rule   string `json:"rule"`
+	Action string `json:"action"`
+	Hits   uint64 `json:"hits"`
+}
+
+// Hits returns the number of queries which matched each rule since the lists
+// were last loaded, for the rules with any, from the most to the least.
+func (b *Blocklist) Hits() []RuleHits {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	var hits []RuleHits
+	seen := make(map[*rule]bool)
+	for _, set := range []*ruleSet{b.allow, b.block} {
+		set.each(func(r *rule) {
+			n := atomic.LoadUint64(&r.hits)
+			if n == 0 || seen[r] {
+				return
+			}
+			seen[r] = true
+			hits = append(hits, RuleHits{List: r.list, Rule: r.text, Action: r.action(), Hits: n})
+		})
+	}
+
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Hits != hits[j].Hits {
+			return hits[i].Hits > hits[j].Hits
+		}
+		return hits[i].Rule < hits[j].Rule
+	})
+
+	return hits
+}
+
+// HitsHandler returns an http.Handler which serves the result of Hits, as
+// JSON
+func (b *Blocklist) HitsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(b.Hits()); err != nil {
+			log.Errorf("unable to write rule hits: %v", err)
+		}
+	})
+}
+
+// answer creates the response to a question for a blocked name
+func (b *Blocklist) answer(q DNSQuestion) *DNSResponse {
+	resp := &DNSResponse{
+		Question:           []DNSQuestion{q},
+		RecursionDesired:   true,
+		RecursionAvailable: true,
+		ResponseCode:       dns.RcodeSuccess,
+	}
+	if b.opts.Mode == BlockNXDomain {
+		resp.ResponseCode = dns.RcodeNameError
+		return resp
+	}
+
+	ips := []net.IP{net.IPv4zero, net.IPv6zero}
+	if b.opts.Mode == BlockSinkhole {
+		ips = b.opts.SinkholeIPs
+	}
+
+	hdr := dns.RR_Header{
+		Name:   dns.Fqdn(q.Name),
+		Rrtype: q.Type,
+		Class:  dns.ClassINET,
+		Ttl:    uint32(b.opts.TTL / time.Second),
+	}
+	for _, ip := range ips {
+		ip4 := ip.To4()
+		switch {
+		case q.Type == dns.TypeA && ip4 != nil:
+			resp.Answer = append(resp.Answer, NewDNSRR(&dns.A{Hdr: hdr, A: ip4}))
+		case q.Type == dns.TypeAAAA && ip4 == nil:
+			resp.Answer = append(resp.Answer, NewDNSRR(&dns.AAAA{Hdr: hdr, AAAA: ip}))
+		}
+	}
+
+	return resp
+}
+
+// rule is a single entry of a list
+type rule struct {
+	// hits is the number of queries the rule has matched; it is first, so
+	// that it is aligned for atomic access on 32-bit platforms
+	hits uint64
+	// text is the rule as written in the list
+	text  string
+	list  string
+	allow bool
+	// re matches names, for wildcards and regular expressions
+	re *regexp.Regexp
+}
+
+// ruleSet holds the rules of a kind, allow or block, from all lists
+type ruleSet struct {
+	// names match exactly; domains match with their subdomains
+	names    map[string]*rule
+	domains  map[string]*rule
+	patterns []*rule
+}
+
+func newRuleSet() *ruleSet {
+	return &ruleSet{
+		names:   make(map[string]*rule),
+		domains: make(map[string]*rule),
+	}
+}
+
+func (r *rule) action() string {
+	if r.allow {
+		return "allow"
+	}
+	return "block"
+}
+
+// each calls fn with each of the rules of the set
+func (s *ruleSet) each(fn func(*rule)) {
+	for _, r := range s.names {
+		fn(r)
+	}
+	for _, r := range s.domains {
+		fn(r)
+	}
+	for _, r := range s.patterns {
+		fn(r)
+	}
+}
+
+func (s *ruleSet) size() int {
+	return len(s.names) + len(s.domains) + len(s.patterns)
+}
+
+// match returns the rule matching a lower case, fully qualified name
+func (s *ruleSet) match(name string) *rule {
+	if r, ok := s.names[name]; ok {
+		return r
+	}
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if r, ok := s.domains[name[off:]]; ok {
+			return r
+		}
+	}
+
+	host := strings.TrimSuffix(name, ".")
+	for _, r := range s.patterns {
+		if r.re.MatchString(host) {
+			return r
+		}
+	}
+
+	return nil
+}
+
+// loadBlocklist reads a list from a file, adding its rules to the allow and
+// block sets; every rule of an allowlist is an allow rule.
+func loadBlocklist(path string, allowlist bool, allow, block *ruleSet) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := parseBlocklist(f, path, allowlist, allow, block); err != nil {
+		return fmt.Errorf("%v: %v", path, err)
+	}
+
+	return nil
+}
+
+func parseBlocklist(r io.Reader, list string, allowlist bool, allow, block *ruleSet) error {
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+
+		// Adblock comments and headers
+		if strings.HasPrefix(line, "!") || strings.HasPrefix(line, "[") {
+			continue
+		}
+
+		set, prefix := block, ""
+		if allowlist {
+			set = allow
+		}
+		if strings.HasPrefix(line, "@@") {
+			set, prefix = allow, "@@"
+			line = line[2:]
+		}
+		newRule := func(text string) *rule {
+			return &rule{text: prefix + text, list: list, allow: set == allow}
+		}
+
+		if len(line) > 2 && line[0] == '/' && line[len(line)-1] == '/' {
+			re, err := regexp.Compile("(?i)" + line[1:len(line)-1])
+			if err != nil {
+				log.Warnf("%v:%v: ignoring invalid regular expression: %v", list, n, err)
+				continue
+			}
+
+			r := newRule(line)
+			r.re = re
+			set.patterns = append(set.patterns, r)
+			continue
+		}
+		if strings.HasPrefix(line, "||") {
+			if name, ok := adblockDomain(line); ok {
+				set.domains[name] = newRule(line)
+			}
+			continue
+		}
+
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		// a hosts file line starts with an address, followed by names
+		if net.ParseIP(fields[0]) != nil {
+			fields = fields[1:]
+		} else if len(fields) > 1 {
+			continue
+		}
+
+		for _, field := range fields {
+			if strings.Contains(field, "*") {
+				if re, ok := wildcardPattern(field); ok {
+					r := newRule(field)
+					r.re = re
+					set.patterns = append(set.patterns, r)
+				}
+				continue
+			}
+
+			name := strings.ToLower(dns.Fqdn(field))
+			if isHostname(name) && !localHostNames[name] {
+				set.names[name] = newRule(field)
+			}
+		}
+	}
+
+	return s.Err()
+}
+
+// wildcardPattern compiles a name containing wildcards, "*", which match any
+// characters, to a regular expression
+func wildcardPattern(wildcard string) (*regexp.Regexp, bool) {
+	name := strings.ToLower(strings.TrimSuffix(wildcard, "."))
+	if !isHostname(strings.Replace(name, "*", "x", -1) + ".") {
+		return nil, false
+	}
+
+	parts := strings.Split(name, "*")
+	for i, p := range parts {
+		parts[i] = regexp.QuoteMeta(p)
+	}
+
+	return regexp.MustCompile("^" + strings.Join(parts, ".*") + "$"), true
+}
+
+// adblockDomain returns the domain blocked by an Adblock rule of the form
+// "||example.com^"; rules with other patterns, or options, are not supported.
+func adblockDomain(rule string) (string, bool) {
+	rule = strings.TrimPrefix(rule, "||")
+	if !strings.HasSuffix(rule, "^") {
+		return "", false
+	}
+	rule = strings.TrimSuffix(rule, "^")
+
+	name := strings.ToLower(dns.Fqdn(rule))
+	if !isHostname(name) {
+		return "", false
+	}
+
+	return name, true
+}
+
+// isHostname reports whether a fully qualified name is made up only of the
+// letters, digits, hyphens and underscores found in host names
+func isHostname(name string) bool {
+	if _, ok := dns.IsDomainName(name); !ok || name == "." {
+		return false
+	}
+
+	for _, label := range dns.SplitDomainName(name) {
+		if label == "" {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' ||
+				c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,250 @@
+package secureoperator
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+const testBlocklist = `# hosts file
+127.0.0.1 localhost
+0.0.0.0 ads.example.com tracker.example.com # trailing comment
+0.0.0.0 adblock.allowed.example.com
+:: ipv6.example.net
+
+# plain names
+Plain.Example.org
+
+! adblock
+[Adblock Plus 2.0]
+||adblock.example.com^
+||example.net/path^
+||options.example.com^$third-party
+@@||allowed.example.com^
+
+# wildcards and regular expressions
+*.wild.example.com
+/^track\d+\./
+/(invalid/
+`
+
+func TestParseBlocklist(t *testing.T) {
+	allow, block := newRuleSet(), newRuleSet()
+	if err := parseBlocklist(strings.NewReader(testBlocklist), "test", false, allow, block); err != nil {
+		t.Fatal(err)
+	}
+
+	expectedNames := []string{
+		"ads.example.com.", "tracker.example.com.", "adblock.allowed.example.com.",
+		"ipv6.example.net.", "plain.example.org.",
+	}
+	if len(block.names) != len(expectedNames) {
+		t.Errorf("expected names %v, got %v", expectedNames, block.names)
+	}
+	for _, n := range expectedNames {
+		if block.names[n] == nil {
+			t.Errorf("expected %v to be blocked", n)
+		}
+	}
+
+	if len(block.domains) != 1 || block.domains["adblock.example.com."] == nil {
+		t.Errorf("expected only adblock.example.com. to be a blocked domain, got %v", block.domains)
+	}
+	if len(block.patterns) != 2 {
+		t.Errorf("expected 2 patterns, got %v", block.patterns)
+	}
+
+	if r := allow.domains["allowed.example.com."]; r == nil || !r.allow || r.text != "@@||allowed.example.com^" {
+		t.Errorf("expected allowed.example.com. to be an allowed domain, got %v", allow.domains)
+	}
+}
+
+func newTestBlocklist(t *testing.T, opts *BlocklistOptions) (*Blocklist, func()) {
+	dir, err := ioutil.TempDir("", "secureoperator")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "blocklist.txt")
+	if err := ioutil.WriteFile(path, []byte(testBlocklist), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	opts.Files = []string{path}
+	b, err := NewBlocklist(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return b, func() { os.RemoveAll(dir) }
+}
+
+func TestBlocklistBlocked(t *testing.T) {
+	b, cleanup := newTestBlocklist(t, &BlocklistOptions{})
+	defer cleanup()
+
+	tests := []struct {
+		name    string
+		blocked bool
+	}{
+		{"ads.example.com", true},
+		{"ADS.example.com.", true},
+		{"sub.ads.example.com.", false},
+		{"adblock.example.com.", true},
+		{"sub.adblock.example.com.", true},
+		{"example.com.", false},
+		{"localhost.", false},
+		{"a.b.wild.example.com.", true},
+		{"wild.example.com.", false},
+		{"track1.example.com.", true},
+		{"tracker1.example.com.", false},
+		{"sub.adblock.allowed.example.com.", false},
+	}
+
+	for _, test := range tests {
+		if b.Blocked(test.name) != test.blocked {
+			t.Errorf("%v: expected blocked to be %v", test.name, test.blocked)
+		}
+	}
+}
+
+func TestBlocklistModes(t *testing.T) {
+	tests := []struct {
+		opts  *BlocklistOptions
+		qtype uint16
+		rcode int
+		ip    string
+	}{
+		{&BlocklistOptions{}, dns.TypeA, dns.RcodeNameError, ""},
+		{&BlocklistOptions{Mode: BlockNull}, dns.TypeA, dns.RcodeSuccess, "0.0.0.0"},
+		{&BlocklistOptions{Mode: BlockNull}, dns.TypeAAAA, dns.RcodeSuccess, "::"},
+		{&BlocklistOptions{Mode: BlockNull}, dns.TypeMX, dns.RcodeSuccess, ""},
+		{&BlocklistOptions{
+			Mode:        BlockSinkhole,
+			SinkholeIPs: []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")},
+		}, dns.TypeAAAA, dns.RcodeSuccess, "2001:db8::1"},
+	}
+
+	for i, test := range tests {
+		b, cleanup := newTestBlocklist(t, test.opts)
+		defer cleanup()
+
+		p := &mockProvider{name: "mock", err: errMockProvider}
+		h := NewHandler(p, &HandlerOptions{Blocklist: b})
+
+		req := new(dns.Msg)
+		req.SetQuestion("ads.example.com.", test.qtype)
+
+		w := &testResponseWriter{}
+		h.Handle(w, req)
+
+		if p.Calls() != 0 {
+			t.Errorf("%v: expected the provider not to be queried", i)
+		}
+		resp := w.msgs[0]
+		if resp.Rcode != test.rcode {
+			t.Errorf("%v: expected rcode %v, got %v", i, test.rcode, resp.Rcode)
+		}
+
+		var ip string
+		switch rr := firstRR(resp.Answer).(type) {
+		case *dns.A:
+			ip = rr.A.String()
+		case *dns.AAAA:
+			ip = rr.AAAA.String()
+		}
+		if ip != test.ip || len(resp.Answer) > 1 {
+			t.Errorf("%v: expected answer %q, got %v", i, test.ip, resp.Answer)
+		}
+	}
+
+	if _, err := NewBlocklist(&BlocklistOptions{Mode: BlockSinkhole}); err == nil {
+		t.Error("expected an error for sinkhole mode without IPs")
+	}
+}
+
+func firstRR(rrs []dns.RR) dns.RR {
+	if len(rrs) == 0 {
+		return nil
+	}
+	return rrs[0]
+}
+
+func TestBlocklistAllowlist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secureoperator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	allowlist := filepath.Join(dir, "allowlist.txt")
+	if err := ioutil.WriteFile(allowlist, []byte("ads.example.com\n/^track1\\./\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	b, cleanup := newTestBlocklist(t, &BlocklistOptions{AllowFiles: []string{allowlist}})
+	defer cleanup()
+
+	var buf bytes.Buffer
+	l, err := NewQueryLog(&buf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &mockProvider{name: "mock", resp: testResponse("ads.example.com.", 300)}
+	h := NewHandler(p, &HandlerOptions{Blocklist: b, QueryLog: l})
+
+	hits := ruleHits.value(allowlist, "allow")
+
+	for _, name := range []string{"ads.example.com.", "tracker.example.com.", "track1.example.com."} {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		h.Handle(&testResponseWriter{}, req)
+	}
+
+	// both rules of the allowlist are counted together
+	if v := ruleHits.value(allowlist, "allow"); v != hits+2 {
+		t.Errorf("expected two hits of the allowlist, got %v", v-hits)
+	}
+
+	// each rule is counted separately by the blocklist itself
+	found := false
+	for _, h := range b.Hits() {
+		if h.Rule == "ads.example.com" {
+			found = true
+			if h.List != allowlist || h.Action != "allow" || h.Hits != 1 {
+				t.Errorf("unexpected rule hits %+v", h)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("expected hits of the allow rule, got %+v", b.Hits())
+	}
+
+	entries := queryLogEntries(t, &buf)
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 entries, got %v", len(entries))
+	}
+
+	expected := []struct {
+		blocked bool
+		rule    string
+		list    string
+	}{
+		{false, "ads.example.com", allowlist},
+		{true, "tracker.example.com", b.opts.Files[0]},
+		{false, `/^track1\./`, allowlist},
+	}
+	for i, e := range entries {
+		x := expected[i]
+		if e.Blocked != x.blocked || e.Rule != x.rule || e.List != x.list {
+			t.Errorf("%v: expected rule %v from %v, blocked %v; got %+v", e.Name, x.rule, x.list, x.blocked, e)
+		}
+	}
+}
@@ -0,0 +1,591 @@
+package secureoperator
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+const (
+	// DefaultCacheSize is the maximum number of responses held by a
+	// ResponseCache, unless otherwise specified
+	DefaultCacheSize = 10000
+	// DefaultStaleTTL is the TTL of records in stale responses, unless
+	// otherwise specified; as recommended by RFC 8767
+	DefaultStaleTTL = 30 * time.Second
+)
+
+// CacheKey identifies a cached response
+type CacheKey struct {
+	Name  string
+	Type  uint16
+	Class uint16
+	// DNSSECOK and CheckingDisabled are the DO and CD bits of the question,
+	// which change the content of the response
+	DNSSECOK         bool `json:",omitempty"`
+	CheckingDisabled bool `json:",omitempty"`
+	// ClientSubnet is the EDNS client subnet the response was requested for
+	ClientSubnet string `json:",omitempty"`
+}
+
+// NewCacheKey creates a CacheKey for a DNS question; names are compared
+// case-insensitively.
+func NewCacheKey(q dns.Question) CacheKey {
+	return CacheKey{
+		Name:  strings.ToLower(dns.Fqdn(q.Name)),
+		Type:  q.Qtype,
+		Class: q.Qclass,
+	}
+}
+
+// CacheOptions is a configuration object for optional ResponseCache
+// configuration
+type CacheOptions struct {
+	// MaxEntries is the maximum number of responses to be cached; when full,
+	// the least recently used response is evicted. If not provided,
+	// DefaultCacheSize is used.
+	MaxEntries int
+	// MinTTL is the minimum time a response is cached for; record TTLs lower
+	// than this are raised to it.
+	MinTTL time.Duration
+	// MaxTTL is the maximum time a response is cached for; record TTLs higher
+	// than this are lowered to it. If not provided, there is no maximum.
+	MaxTTL time.Duration
+	// StaleWindow is the time responses are retained for after they expire,
+	// so that they may be served stale, as described in RFC 8767, if the
+	// provider is unable to answer. If not provided, expired responses are not
+	// retained.
+	StaleWindow time.Duration
+	// StaleTTL is the TTL given to records of stale responses. If not
+	// provided, DefaultStaleTTL is used.
+	StaleTTL time.Duration
+	// PrefetchThreshold is the fraction of a response's TTL after which it
+	// may be prefetched, e.g. 0.9; popular responses are refreshed before
+	// they expire. If not provided, responses are not prefetched.
+	PrefetchThreshold float64
+	// PrefetchHits is the number of times a response must be retrieved within
+	// its TTL to be considered popular enough to prefetch.
+	PrefetchHits int
+}
+
+// NewResponseCache creates a ResponseCache
+func NewResponseCache(opts *CacheOptions) *ResponseCache {
+	if opts == nil {
+		opts = &CacheOptions{}
+	}
+	if opts.MaxEntries == 0 {
+		opts.MaxEntries = DefaultCacheSize
+	}
+	if opts.StaleTTL == 0 {
+		opts.StaleTTL = DefaultStaleTTL
+	}
+
+	return &ResponseCache{
+		opts:    opts,
+		entries: make(map[CacheKey]*list.Element),
+		lru:     list.New(),
+		now:     time.Now,
+	}
+}
+
+// ResponseCache is an in-memory cache of DNSResponses, which expire at the
+// minimum TTL of their answer. It is bounded in size, evicting the least
+// recently used response when full.
+//
+// Negative responses (NXDOMAIN, and NODATA: NOERROR without answers) are
+// cached as described in RFC 2308, for the lesser of the TTL and MINIMUM field
+// of the SOA record in their authority section.
+type ResponseCache struct {
+	opts *CacheOptions
+
+	mutex   sync.Mutex
+	entries map[CacheKey]*list.Element
+	// lru holds *cacheEntry values, the most recently used at the front
+	lru *list.List
+
+	// now is locally set to allow its mocking during testing
+	now func() time.Time
+}
+
+type cacheEntry struct {
+	key     CacheKey
+	resp    *DNSResponse
+	stored  time.Time
+	expires time.Time
+	// hits is the number of times the entry was retrieved before expiry
+	hits int
+	// prefetched is true once the entry has been selected for prefetch
+	prefetched bool
+}
+
+// Get retrieves an unexpired response from the cache; the TTLs of its records
+// are reduced by the time it has spent in the cache.
+func (c *ResponseCache) Get(key CacheKey) (*DNSResponse, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	now := c.now()
+	e := el.Value.(*cacheEntry)
+	if !now.Before(e.expires) {
+		if c.pastStaleWindow(e, now) {
+			c.remove(el)
+		}
+		return nil, false
+	}
+
+	c.lru.MoveToFront(el)
+	e.hits++
+
+	return agedResponse(e.resp, now.Sub(e.stored)), true
+}
+
+// ShouldPrefetch reports whether a response should be refreshed before it
+// expires; this is true if it has passed the prefetch threshold of its TTL,
+// and was retrieved more than the configured number of times. It returns true
+// only once for a given response, so that the caller may prefetch it.
+func (c *ResponseCache) ShouldPrefetch(key CacheKey) bool {
+	if c.opts.PrefetchThreshold <= 0 {
+		return false
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return false
+	}
+
+	e := el.Value.(*cacheEntry)
+	if e.prefetched || e.hits <= c.opts.PrefetchHits {
+		return false
+	}
+
+	now := c.now()
+	if !now.Before(e.expires) {
+		return false
+	}
+
+	ttl := e.expires.Sub(e.stored)
+	threshold := time.Duration(float64(ttl) * c.opts.PrefetchThreshold)
+	if now.Sub(e.stored) < threshold {
+		return false
+	}
+
+	e.prefetched = true
+	return true
+}
+
+// GetStale retrieves an expired response from the cache, if it is within the
+// stale window; the TTLs of its records are set to the configured StaleTTL.
+func (c *ResponseCache) GetStale(key CacheKey) (*DNSResponse, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	now := c.now()
+	e := el.Value.(*cacheEntry)
+	if now.Before(e.expires) {
+		return nil, false
+	}
+	if c.pastStaleWindow(e, now) {
+		c.remove(el)
+		return nil, false
+	}
+
+	c.lru.MoveToFront(el)
+
+	ttl := uint32(c.opts.StaleTTL / time.Second)
+	return copyResponse(e.resp, func(uint32) uint32 { return ttl }), true
+}
+
+// pastStaleWindow reports whether an entry can no longer be served stale
+func (c *ResponseCache) pastStaleWindow(e *cacheEntry, now time.Time) bool {
+	return !now.Before(e.expires.Add(c.opts.StaleWindow))
+}
+
+// Set stores a response in the cache, if it's cacheable
+func (c *ResponseCache) Set(key CacheKey, resp *DNSResponse) {
+	ttl, ok := c.ttl(resp)
+	if !ok {
+		return
+	}
+
+	now := c.now()
+	e := &cacheEntry{
+		key:     key,
+		resp:    c.clampedResponse(resp, ttl),
+		stored:  now,
+		expires: now.Add(time.Duration(ttl) * time.Second),
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+
+	c.entries[key] = c.lru.PushFront(e)
+
+	for c.lru.Len() > c.opts.MaxEntries {
+		c.remove(c.lru.Back())
+	}
+}
+
+// Len returns the number of responses in the cache, including any which have
+// expired but not yet been removed.
+func (c *ResponseCache) Len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.lru.Len()
+}
+
+// remove removes an element from the cache; the caller must hold the mutex
+func (c *ResponseCache) remove(el *list.Element) {
+	c.lru.Remove(el)
+	delete(c.entries, el.Value.(*cacheEntry).key)
+}
+
+// ttl determines how long a response may be cached for, in seconds, clamped
+// to the configured bounds; ok is false if the response must not be cached.
+func (c *ResponseCache) ttl(resp *DNSResponse) (ttl uint32, ok bool) {
+	if resp.Truncated {
+		return 0, false
+	}
+
+	if ttl, ok := negativeTTL(resp); ok {
+		ttl = c.clamp(ttl)
+		return ttl, ttl > 0
+	}
+
+	if resp.ResponseCode != dns.RcodeSuccess || len(resp.Answer) == 0 {
+		return 0, false
+	}
+
+	ttl = resp.Answer[0].TTL
+	for _, rr := range resp.Answer[1:] {
+		if rr.TTL < ttl {
+			ttl = rr.TTL
+		}
+	}
+
+	ttl = c.clamp(ttl)
+
+	return ttl, ttl > 0
+}
+
+// negativeTTL determines how long a negative response may be cached for, in
+// seconds; ok is false if the response is not a negative response, or if it
+// has no SOA record from which to determine the TTL.
+func negativeTTL(resp *DNSResponse) (ttl uint32, ok bool) {
+	switch {
+	case resp.ResponseCode == dns.RcodeNameError:
+	case resp.ResponseCode == dns.RcodeSuccess && len(resp.Answer) == 0:
+	default:
+		return 0, false
+	}
+
+	for _, rr := range resp.Authority {
+		if rr.Type != dns.TypeSOA {
+			continue
+		}
+
+		r, err := rr.RR()
+		if err != nil {
+			continue
+		}
+		soa, ok := r.(*dns.SOA)
+		if !ok {
+			continue
+		}
+
+		if soa.Minttl < rr.TTL {
+			return soa.Minttl, true
+		}
+		return rr.TTL, true
+	}
+
+	return 0, false
+}
+
+// clamp bounds a TTL to the configured minimum and maximum
+func (c *ResponseCache) clamp(ttl uint32) uint32 {
+	if min := uint32(c.opts.MinTTL / time.Second); ttl < min {
+		ttl = min
+	}
+	if max := uint32(c.opts.MaxTTL / time.Second); max > 0 && ttl > max {
+		ttl = max
+	}
+
+	return ttl
+}
+
+// clampedResponse returns a copy of a response, where the TTLs of its records
+// are bounded to the configured minimum and maximum, and are no lower than the
+// TTL of the cache entry; this ensures no record expires before the entry.
+//
+// For negative responses, the authority records are given the TTL of the
+// entry, so that the SOA record conveys the negative TTL to clients.
+func (c *ResponseCache) clampedResponse(resp *DNSResponse, entryTTL uint32) *DNSResponse {
+	r := copyResponse(resp, func(ttl uint32) uint32 {
+		if ttl = c.clamp(ttl); ttl < entryTTL {
+			return entryTTL
+		}
+		return ttl
+	})
+
+	if _, ok := negativeTTL(resp); ok {
+		for i := range r.Authority {
+			r.Authority[i].TTL = entryTTL
+		}
+	}
+
+	return r
+}
+
+// agedResponse returns a copy of a response, where the TTLs of its records
+// are reduced by the given age.
+func agedResponse(resp *DNSResponse, age time.Duration) *DNSResponse {
+	secs := uint32(age / time.Second)
+
+	return copyResponse(resp, func(ttl uint32) uint32 {
+		if ttl <= secs {
+			return 0
+		}
+		return ttl - secs
+	})
+}
+
+// copyResponse copies a response, transforming the TTL of each record
+func copyResponse(resp *DNSResponse, ttl func(uint32) uint32) *DNSResponse {
+	r := *resp
+	r.Answer = copyRRs(resp.Answer, ttl)
+	r.Authority = copyRRs(resp.Authority, ttl)
+	r.Extra = copyRRs(resp.Extra, ttl)
+
+	return &r
+}
+
+func copyRRs(rrs []DNSRR, ttl func(uint32) uint32) []DNSRR {
+	if rrs == nil {
+		return nil
+	}
+
+	c := make([]DNSRR, len(rrs))
+	for i, rr := range rrs {
+		c[i] = rr
+		c[i].TTL = ttl(rr.TTL)
+	}
+
+	return c
+}
+
+// the version of the snapshot format written by ResponseCache.Save
+const cacheSnapshotVersion = 1
+
+type cacheSnapshot struct {
+	Version int                  `json:"version"`
+	Entries []cacheSnapshotEntry `json:"entries"`
+}
+
+type cacheSnapshotEntry struct {
+	Key      CacheKey         `json:"key"`
+	Stored   time.Time        `json:"stored"`
+	Expires  time.Time        `json:"expires"`
+	Response snapshotResponse `json:"response"`
+}
+
+// snapshotResponse is a DNSResponse where records are held in their
+// presentation format, so that they may be restored without loss
+type snapshotResponse struct {
+	Question           []DNSQuestion `json:"question,omitempty"`
+	Answer             []string      `json:"answer,omitempty"`
+	Authority          []string      `json:"authority,omitempty"`
+	Extra              []string      `json:"extra,omitempty"`
+	Truncated          bool          `json:"tc,omitempty"`
+	RecursionDesired   bool          `json:"rd,omitempty"`
+	RecursionAvailable bool          `json:"ra,omitempty"`
+	AuthenticatedData  bool          `json:"ad,omitempty"`
+	CheckingDisabled   bool          `json:"cd,omitempty"`
+	ResponseCode       int           `json:"rcode"`
+}
+
+// Save writes a snapshot of the cache to w, which may later be restored with
+// Load.
+func (c *ResponseCache) Save(w io.Writer) error {
+	c.mutex.Lock()
+
+	snap := cacheSnapshot{Version: cacheSnapshotVersion}
+	// from least to most recently used, so that Load restores the order
+	for el := c.lru.Back(); el != nil; el = el.Prev() {
+		e := el.Value.(*cacheEntry)
+
+		resp, err := newSnapshotResponse(e.resp)
+		if err != nil {
+			log.Errorln("unable to snapshot cached response", e.key.Name, err)
+			continue
+		}
+
+		snap.Entries = append(snap.Entries, cacheSnapshotEntry{
+			Key:      e.key,
+			Stored:   e.stored,
+			Expires:  e.expires,
+			Response: resp,
+		})
+	}
+
+	c.mutex.Unlock()
+
+	return json.NewEncoder(w).Encode(snap)
+}
+
+// Load restores a snapshot written by Save into the cache, returning the
+// number of responses restored. Responses which have expired since the
+// snapshot was taken, and are not within the stale window, are skipped; the
+// TTLs of the remainder are reduced by the time elapsed since they were
+// stored.
+func (c *ResponseCache) Load(r io.Reader) (int, error) {
+	var snap cacheSnapshot
+	if err := json.NewDecoder(r).Decode(&snap); err != nil {
+		return 0, err
+	}
+	if snap.Version != cacheSnapshotVersion {
+		return 0, fmt.Errorf("unsupported cache snapshot version %v", snap.Version)
+	}
+
+	// restore every entry before any is added, so that a snapshot which can't
+	// be fully restored leaves the cache as it was
+	now := c.now()
+	var entries []*cacheEntry
+
+	for _, se := range snap.Entries {
+		e := &cacheEntry{
+			key:     se.Key,
+			stored:  se.Stored,
+			expires: se.Expires,
+		}
+		if c.pastStaleWindow(e, now) {
+			continue
+		}
+
+		resp, err := se.Response.DNSResponse()
+		if err != nil {
+			return 0, err
+		}
+		e.resp = resp
+
+		entries = append(entries, e)
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for _, e := range entries {
+		if el, ok := c.entries[e.key]; ok {
+			c.remove(el)
+		}
+		c.entries[e.key] = c.lru.PushFront(e)
+	}
+
+	for c.lru.Len() > c.opts.MaxEntries {
+		c.remove(c.lru.Back())
+	}
+
+	return len(entries), nil
+}
+
+func newSnapshotResponse(resp *DNSResponse) (snapshotResponse, error) {
+	s := snapshotResponse{
+		Question:           resp.Question,
+		Truncated:          resp.Truncated,
+		RecursionDesired:   resp.RecursionDesired,
+		RecursionAvailable: resp.RecursionAvailable,
+		AuthenticatedData:  resp.AuthenticatedData,
+		CheckingDisabled:   resp.CheckingDisabled,
+		ResponseCode:       resp.ResponseCode,
+	}
+
+	var err error
+	if s.Answer, err = snapshotRRs(resp.Answer); err != nil {
+		return s, err
+	}
+	if s.Authority, err = snapshotRRs(resp.Authority); err != nil {
+		return s, err
+	}
+	if s.Extra, err = snapshotRRs(resp.Extra); err != nil {
+		return s, err
+	}
+
+	return s, nil
+}
+
+// DNSResponse restores the DNSResponse from which a snapshotResponse was
+// created
+func (s snapshotResponse) DNSResponse() (*DNSResponse, error) {
+	resp := &DNSResponse{
+		Question:           s.Question,
+		Truncated:          s.Truncated,
+		RecursionDesired:   s.RecursionDesired,
+		RecursionAvailable: s.RecursionAvailable,
+		AuthenticatedData:  s.AuthenticatedData,
+		CheckingDisabled:   s.CheckingDisabled,
+		ResponseCode:       s.ResponseCode,
+	}
+
+	var err error
+	if resp.Answer, err = restoreRRs(s.Answer); err != nil {
+		return nil, err
+	}
+	if resp.Authority, err = restoreRRs(s.Authority); err != nil {
+		return nil, err
+	}
+	if resp.Extra, err = restoreRRs(s.Extra); err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+func snapshotRRs(rrs []DNSRR) ([]string, error) {
+	var s []string
+	for _, r := range rrs {
+		rr, err := r.RR()
+		if err != nil {
+			return nil, err
+		}
+		s = append(s, rr.String())
+	}
+
+	return s, nil
+}
+
+func restoreRRs(s []string) ([]DNSRR, error) {
+	var rrs []DNSRR
+	for _, r := range s {
+		rr, err := dns.NewRR(r)
+		if err != nil {
+			return nil, err
+		}
+		rrs = append(rrs, NewDNSRR(rr))
+	}
+
+	return rrs, nil
+}
@@ -0,0 +1,399 @@
+package secureoperator
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// newTestCache creates a cache whose clock is controlled by the returned
+// function, which advances it
+func newTestCache(opts *CacheOptions) (*ResponseCache, func(time.Duration)) {
+	c := NewResponseCache(opts)
+
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	return c, func(d time.Duration) { now = now.Add(d) }
+}
+
+func testKey(name string) CacheKey {
+	return NewCacheKey(dns.Question{Name: name, Qtype: dns.TypeA, Qclass: dns.ClassINET})
+}
+
+func testResponse(name string, ttls ...uint32) *DNSResponse {
+	resp := &DNSResponse{
+		Question: []DNSQuestion{DNSQuestion{Name: name, Type: dns.TypeA}},
+	}
+	for i, ttl := range ttls {
+		resp.Answer = append(resp.Answer, DNSRR{
+			Name: name,
+			Type: dns.TypeA,
+			TTL:  ttl,
+			Data: fmt.Sprintf("10.0.0.%v", i+1),
+		})
+	}
+
+	return resp
+}
+
+func TestCacheExpiry(t *testing.T) {
+	c, advance := newTestCache(nil)
+	key := testKey("example.com.")
+
+	c.Set(key, testResponse("example.com.", 300, 60))
+
+	resp, ok := c.Get(key)
+	if !ok {
+		t.Fatal("expected to retrieve a response")
+	}
+	if resp.Answer[0].TTL != 300 || resp.Answer[1].TTL != 60 {
+		t.Errorf("unexpected TTLs %v", resp.Answer)
+	}
+
+	advance(45 * time.Second)
+
+	resp, ok = c.Get(key)
+	if !ok {
+		t.Fatal("expected to retrieve a response")
+	}
+	if resp.Answer[0].TTL != 255 || resp.Answer[1].TTL != 15 {
+		t.Errorf("unexpected aged TTLs %v", resp.Answer)
+	}
+
+	// expires at the minimum TTL of the answer
+	advance(15 * time.Second)
+
+	if _, ok := c.Get(key); ok {
+		t.Error("expected response to have expired")
+	}
+	if l := c.Len(); l != 0 {
+		t.Errorf("expected expired response to be removed, have %v", l)
+	}
+}
+
+func TestCacheKeyCaseInsensitive(t *testing.T) {
+	c := NewResponseCache(nil)
+
+	c.Set(testKey("Example.COM."), testResponse("example.com.", 300))
+
+	if _, ok := c.Get(testKey("example.com")); !ok {
+		t.Error("expected to retrieve a response")
+	}
+	if _, ok := c.Get(NewCacheKey(dns.Question{Name: "example.com.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET})); ok {
+		t.Error("did not expect a response for a different type")
+	}
+}
+
+func TestCacheLRU(t *testing.T) {
+	c := NewResponseCache(&CacheOptions{MaxEntries: 2})
+
+	c.Set(testKey("one."), testResponse("one.", 300))
+	c.Set(testKey("two."), testResponse("two.", 300))
+
+	// use the first, so that the second is the least recently used
+	c.Get(testKey("one."))
+	c.Set(testKey("three."), testResponse("three.", 300))
+
+	if l := c.Len(); l != 2 {
+		t.Errorf("expected 2 entries, have %v", l)
+	}
+	if _, ok := c.Get(testKey("two.")); ok {
+		t.Error("expected least recently used entry to be evicted")
+	}
+	for _, n := range []string{"one.", "three."} {
+		if _, ok := c.Get(testKey(n)); !ok {
+			t.Errorf("expected %v to be cached", n)
+		}
+	}
+}
+
+func TestCacheTTLBounds(t *testing.T) {
+	c, advance := newTestCache(&CacheOptions{
+		MinTTL: time.Minute,
+		MaxTTL: time.Hour,
+	})
+
+	c.Set(testKey("low."), testResponse("low.", 5))
+	c.Set(testKey("high."), testResponse("high.", 86400))
+
+	resp, ok := c.Get(testKey("low."))
+	if !ok {
+		t.Fatal("expected to retrieve a response")
+	}
+	if ttl := resp.Answer[0].TTL; ttl != 60 {
+		t.Errorf("expected TTL raised to 60, got %v", ttl)
+	}
+
+	resp, ok = c.Get(testKey("high."))
+	if !ok {
+		t.Fatal("expected to retrieve a response")
+	}
+	if ttl := resp.Answer[0].TTL; ttl != 3600 {
+		t.Errorf("expected TTL lowered to 3600, got %v", ttl)
+	}
+
+	advance(59 * time.Second)
+	if _, ok := c.Get(testKey("low.")); !ok {
+		t.Error("expected response to be cached for the minimum TTL")
+	}
+
+	advance(time.Hour)
+	if _, ok := c.Get(testKey("high.")); ok {
+		t.Error("expected response to expire at the maximum TTL")
+	}
+}
+
+func TestCacheUncacheable(t *testing.T) {
+	c := NewResponseCache(nil)
+
+	servfail := testResponse("servfail.", 300)
+	servfail.ResponseCode = dns.RcodeServerFailure
+
+	truncated := testResponse("truncated.", 300)
+	truncated.Truncated = true
+
+	cases := map[string]*DNSResponse{
+		"servfail.":  servfail,
+		"truncated.": truncated,
+		"zero.":      testResponse("zero.", 300, 0),
+	}
+
+	for n, resp := range cases {
+		c.Set(testKey(n), resp)
+		if _, ok := c.Get(testKey(n)); ok {
+			t.Errorf("%v: did not expect response to be cached", n)
+		}
+	}
+}
+
+func testNegativeResponse(name string, rcode int, soaTTL, minTTL uint32) *DNSResponse {
+	return &DNSResponse{
+		Question:     []DNSQuestion{DNSQuestion{Name: name, Type: dns.TypeA}},
+		ResponseCode: rcode,
+		Authority: []DNSRR{
+			DNSRR{
+				Name: "example.com.",
+				Type: dns.TypeSOA,
+				TTL:  soaTTL,
+				Data: fmt.Sprintf("ns.example.com. admin.example.com. 1 7200 3600 1209600 %v", minTTL),
+			},
+		},
+	}
+}
+
+func TestCacheNegative(t *testing.T) {
+	c, advance := newTestCache(nil)
+
+	nxdomain := testKey("nx.example.com.")
+	nodata := testKey("nodata.example.com.")
+
+	// the lesser of the SOA TTL and minimum field is used
+	c.Set(nxdomain, testNegativeResponse("nx.example.com.", dns.RcodeNameError, 3600, 300))
+	c.Set(nodata, testNegativeResponse("nodata.example.com.", dns.RcodeSuccess, 60, 300))
+
+	resp, ok := c.Get(nxdomain)
+	if !ok {
+		t.Fatal("expected NXDOMAIN response to be cached")
+	}
+	if resp.ResponseCode != dns.RcodeNameError {
+		t.Errorf("unexpected response code %v", resp.ResponseCode)
+	}
+	if ttl := resp.Authority[0].TTL; ttl != 300 {
+		t.Errorf("expected SOA TTL of negative TTL 300, got %v", ttl)
+	}
+
+	if _, ok := c.Get(nodata); !ok {
+		t.Fatal("expected NODATA response to be cached")
+	}
+
+	advance(time.Minute)
+	if _, ok := c.Get(nodata); ok {
+		t.Error("expected NODATA response to expire at SOA TTL")
+	}
+	if _, ok := c.Get(nxdomain); !ok {
+		t.Error("expected NXDOMAIN response to be cached")
+	}
+
+	advance(4 * time.Minute)
+	if _, ok := c.Get(nxdomain); ok {
+		t.Error("expected NXDOMAIN response to expire at SOA minimum")
+	}
+
+	// without an SOA record, negative responses are not cached
+	c.Set(nxdomain, &DNSResponse{ResponseCode: dns.RcodeNameError})
+	c.Set(nodata, &DNSResponse{ResponseCode: dns.RcodeSuccess})
+	if c.Len() != 0 {
+		t.Errorf("did not expect negative responses without SOA to be cached")
+	}
+}
+
+func TestCacheStale(t *testing.T) {
+	c, advance := newTestCache(&CacheOptions{StaleWindow: time.Hour})
+	key := testKey("example.com.")
+
+	c.Set(key, testResponse("example.com.", 300))
+
+	if _, ok := c.GetStale(key); ok {
+		t.Error("did not expect a stale response before expiry")
+	}
+
+	advance(5 * time.Minute)
+
+	if _, ok := c.Get(key); ok {
+		t.Error("did not expect an expired response")
+	}
+
+	resp, ok := c.GetStale(key)
+	if !ok {
+		t.Fatal("expected a stale response")
+	}
+	if ttl := resp.Answer[0].TTL; ttl != 30 {
+		t.Errorf("expected stale TTL of 30, got %v", ttl)
+	}
+
+	advance(time.Hour)
+
+	if _, ok := c.GetStale(key); ok {
+		t.Error("did not expect a stale response past the stale window")
+	}
+	if c.Len() != 0 {
+		t.Error("expected response to be removed past the stale window")
+	}
+}
+
+func TestCachePrefetch(t *testing.T) {
+	c, advance := newTestCache(&CacheOptions{
+		PrefetchThreshold: 0.9,
+		PrefetchHits:      2,
+	})
+	hot, cold := testKey("hot."), testKey("cold.")
+
+	c.Set(hot, testResponse("hot.", 100))
+	c.Set(cold, testResponse("cold.", 100))
+
+	for i := 0; i < 3; i++ {
+		c.Get(hot)
+	}
+	c.Get(cold)
+
+	if c.ShouldPrefetch(hot) {
+		t.Error("did not expect prefetch before the threshold")
+	}
+
+	advance(91 * time.Second)
+
+	if !c.ShouldPrefetch(hot) {
+		t.Error("expected prefetch of popular response past the threshold")
+	}
+	if c.ShouldPrefetch(hot) {
+		t.Error("expected prefetch to be signaled only once")
+	}
+	if c.ShouldPrefetch(cold) {
+		t.Error("did not expect prefetch of unpopular response")
+	}
+
+	// a new response resets the count of hits
+	c.Set(hot, testResponse("hot.", 100))
+	advance(91 * time.Second)
+	if c.ShouldPrefetch(hot) {
+		t.Error("did not expect prefetch of refreshed response")
+	}
+}
+
+func TestCacheSaveLoad(t *testing.T) {
+	c, _ := newTestCache(&CacheOptions{StaleWindow: time.Minute})
+
+	txt, err := dns.NewRR(`example.com. 300 IN TXT "hello world" "second"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withRaw := &DNSResponse{
+		Question: []DNSQuestion{DNSQuestion{Name: "example.com.", Type: dns.TypeTXT}},
+		Answer:   []DNSRR{NewDNSRR(txt)},
+	}
+
+	txtKey := NewCacheKey(dns.Question{Name: "example.com.", Qtype: dns.TypeTXT, Qclass: dns.ClassINET})
+	c.Set(txtKey, withRaw)
+	c.Set(testKey("short."), testResponse("short.", 60))
+	c.Set(testKey("long."), testResponse("long.", 600))
+	c.Set(testKey("nx."), testNegativeResponse("nx.", dns.RcodeNameError, 300, 300))
+
+	var buf bytes.Buffer
+	if err := c.Save(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// restore into a new cache, two minutes later; the short response is past
+	// its stale window
+	l, _ := newTestCache(&CacheOptions{StaleWindow: time.Minute})
+	l.now = func() time.Time { return c.now().Add(2 * time.Minute) }
+
+	n, err := l.Load(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("expected 3 responses restored, got %v", n)
+	}
+
+	if _, ok := l.Get(testKey("short.")); ok {
+		t.Error("did not expect expired response to be restored")
+	}
+
+	resp, ok := l.Get(testKey("long."))
+	if !ok {
+		t.Fatal("expected response to be restored")
+	}
+	if ttl := resp.Answer[0].TTL; ttl != 480 {
+		t.Errorf("expected TTL adjusted for elapsed time to 480, got %v", ttl)
+	}
+
+	resp, ok = l.Get(txtKey)
+	if !ok {
+		t.Fatal("expected response to be restored")
+	}
+	rr, err := resp.Answer[0].RR()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, ok := rr.(*dns.TXT); !ok || len(r.Txt) != 2 || r.Txt[0] != "hello world" {
+		t.Errorf("unexpected restored record %v", rr)
+	}
+
+	resp, ok = l.Get(testKey("nx."))
+	if !ok {
+		t.Fatal("expected negative response to be restored")
+	}
+	if resp.ResponseCode != dns.RcodeNameError || len(resp.Authority) != 1 {
+		t.Errorf("unexpected restored response %v", resp)
+	}
+}
+
+func TestCacheLoadInvalid(t *testing.T) {
+	c, _ := newTestCache(nil)
+	c.Set(testKey("valid."), testResponse("valid.", 300))
+	c.Set(testKey("invalid."), testResponse("invalid.", 300))
+
+	var buf bytes.Buffer
+	if err := c.Save(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// corrupt the record of the last entry
+	snap := bytes.Replace(buf.Bytes(), []byte("invalid.\\t"), []byte("invalid.\\tbogus "), 1)
+	if bytes.Equal(snap, buf.Bytes()) {
+		t.Fatalf("unable to corrupt snapshot %s", buf.Bytes())
+	}
+
+	l, _ := newTestCache(nil)
+	if _, err := l.Load(bytes.NewReader(snap)); err == nil {
+		t.Fatal("expected an error for an invalid snapshot")
+	}
+	if _, ok := l.Get(testKey("valid.")); ok {
+		t.Error("did not expect entries of an invalid snapshot to be restored")
+	}
+}
@@ -0,0 +1,112 @@
+package secureoperator
+
+import (
+	"fmt"
+	"net"
+	"sort"
+)
+
+const (
+	// DefaultClientSubnetIPv4Prefix is the prefix length IPv4 client addresses
+	// are truncated to, unless otherwise specified
+	DefaultClientSubnetIPv4Prefix = 24
+	// DefaultClientSubnetIPv6Prefix is the prefix length IPv6 client addresses
+	// are truncated to, unless otherwise specified
+	DefaultClientSubnetIPv6Prefix = 56
+)
+
+// ClientSubnetOptions is a configuration object for optional ClientSubnets
+// configuration
+type ClientSubnetOptions struct {
+	// IPv4Prefix is the prefix length IPv4 client addresses are truncated to;
+	// if not provided, a default of 24 is used. A length of 0 sends no
+	// information about the client's address.
+	IPv4Prefix *int
+	// IPv6Prefix is the prefix length IPv6 client addresses are truncated to;
+	// if not provided, a default of 56 is used. A length of 0 sends no
+	// information about the client's address.
+	IPv6Prefix *int
+	// Overrides maps networks of clients, in CIDR notation, to the subnet sent
+	// for their queries in place of their own address; where several networks
+	// contain a client, the most specific is used. To send no subnet for a
+	// network, use the value "0.0.0.0/0".
+	Overrides map[string]string
+}
+
+// NewClientSubnets creates a ClientSubnets
+func NewClientSubnets(opts *ClientSubnetOptions) (*ClientSubnets, error) {
+	if opts == nil {
+		opts = &ClientSubnetOptions{}
+	}
+	c := &ClientSubnets{
+		opts:       opts,
+		ipv4Prefix: DefaultClientSubnetIPv4Prefix,
+		ipv6Prefix: DefaultClientSubnetIPv6Prefix,
+	}
+	if opts.IPv4Prefix != nil {
+		c.ipv4Prefix = *opts.IPv4Prefix
+	}
+	if opts.IPv6Prefix != nil {
+		c.ipv6Prefix = *opts.IPv6Prefix
+	}
+	if c.ipv4Prefix < 0 || c.ipv4Prefix > 32 {
+		return nil, fmt.Errorf("invalid IPv4 prefix length %v", c.ipv4Prefix)
+	}
+	if c.ipv6Prefix < 0 || c.ipv6Prefix > 128 {
+		return nil, fmt.Errorf("invalid IPv6 prefix length %v", c.ipv6Prefix)
+	}
+
+	for network, subnet := range opts.Overrides {
+		_, n, err := net.ParseCIDR(network)
+		if err != nil {
+			return nil, err
+		}
+		_, s, err := net.ParseCIDR(subnet)
+		if err != nil {
+			return nil, err
+		}
+
+		c.overrides = append(c.overrides, subnetOverride{network: n, subnet: s})
+	}
+
+	// most specific first, so that the first match is used
+	sort.Slice(c.overrides, func(i, j int) bool {
+		a, _ := c.overrides[i].network.Mask.Size()
+		b, _ := c.overrides[j].network.Mask.Size()
+		return a > b
+	})
+
+	return c, nil
+}
+
+// ClientSubnets derives the EDNS client subnet to send for a query from the
+// address of the client which made it, so that answers may be tailored to
+// the client's location rather than that of the server.
+type ClientSubnets struct {
+	opts       *ClientSubnetOptions
+	ipv4Prefix int
+	ipv6Prefix int
+	overrides  []subnetOverride
+}
+
+type subnetOverride struct {
+	network *net.IPNet
+	subnet  *net.IPNet
+}
+
+// Subnet returns the subnet to send for queries from a client address
+func (c *ClientSubnets) Subnet(ip net.IP) *net.IPNet {
+	for _, o := range c.overrides {
+		if o.network.Contains(ip) {
+			return o.subnet
+		}
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		mask := net.CIDRMask(c.ipv4Prefix, 32)
+		return &net.IPNet{IP: ip4.Mask(mask), Mask: mask}
+	}
+
+	mask := net.CIDRMask(c.ipv6Prefix, 128)
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+}
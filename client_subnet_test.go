@@ -0,0 +1,75 @@
+package secureoperator
+
+import (
+	"net"
+	"testing"
+)
+
+func TestClientSubnets(t *testing.T) {
+	c, err := NewClientSubnets(&ClientSubnetOptions{
+		Overrides: map[string]string{
+			"10.0.0.0/8":  "203.0.113.0/24",
+			"10.1.0.0/16": "198.51.100.0/24",
+			"fd00::/8":    "0.0.0.0/0",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		client string
+		subnet string
+	}{
+		{"192.0.2.77", "192.0.2.0/24"},
+		{"2001:db8:aaaa:bbcc:1::1", "2001:db8:aaaa:bb00::/56"},
+		{"10.2.3.4", "203.0.113.0/24"},
+		{"10.1.3.4", "198.51.100.0/24"},
+		{"fd12::1", "0.0.0.0/0"},
+	}
+
+	for _, test := range tests {
+		s := c.Subnet(net.ParseIP(test.client))
+		if s.String() != test.subnet {
+			t.Errorf("%v: expected %v, got %v", test.client, test.subnet, s)
+		}
+	}
+}
+
+func TestClientSubnetsPrefix(t *testing.T) {
+	v4, v6 := 16, 48
+	c, err := NewClientSubnets(&ClientSubnetOptions{IPv4Prefix: &v4, IPv6Prefix: &v6})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s := c.Subnet(net.ParseIP("192.0.2.77")).String(); s != "192.0.0.0/16" {
+		t.Errorf("unexpected subnet %v", s)
+	}
+	if s := c.Subnet(net.ParseIP("2001:db8:aaaa:bbbb::1")).String(); s != "2001:db8:aaaa::/48" {
+		t.Errorf("unexpected subnet %v", s)
+	}
+
+	// a prefix length of 0 sends no part of the address
+	zero := 0
+	c, err = NewClientSubnets(&ClientSubnetOptions{IPv4Prefix: &zero, IPv6Prefix: &zero})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := c.Subnet(net.ParseIP("192.0.2.77")).String(); s != "0.0.0.0/0" {
+		t.Errorf("unexpected subnet %v", s)
+	}
+	if s := c.Subnet(net.ParseIP("2001:db8:aaaa:bbbb::1")).String(); s != "::/0" {
+		t.Errorf("unexpected subnet %v", s)
+	}
+
+	invalid := 33
+	if _, err := NewClientSubnets(&ClientSubnetOptions{IPv4Prefix: &invalid}); err == nil {
+		t.Error("expected an error for an invalid prefix length")
+	}
+	if _, err := NewClientSubnets(&ClientSubnetOptions{
+		Overrides: map[string]string{"10.0.0.0/8": "nope"},
+	}); err == nil {
+		t.Error("expected an error for an invalid override")
+	}
+}
@@ -0,0 +1,192 @@
+package cmd
+
+import (
+	"flag"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Upstream configures a single upstream DNS provider in a configuration file
+type Upstream struct {
+	// Name, if given, makes the upstream available only to the domains routed
+	// to it by the "route" option, rather than as a default upstream
+	Name string `toml:"name"`
+	// Format is the request format of the upstream; "json" or "message" for
+	// DNS-over-HTTPS, "tls" for DNS-over-TLS, or "dns" for plain DNS
+	Format string `toml:"format"`
+	// Endpoint is the URL of a DNS-over-HTTPS upstream
+	Endpoint string `toml:"endpoint"`
+	// Method is the HTTP method used for "message" upstreams
+	Method string `toml:"method"`
+	// EndpointIPs are the IPs of a DNS-over-HTTPS endpoint, avoiding a lookup
+	EndpointIPs []string `toml:"endpoint-ips"`
+	// Servers are the addresses of a DNS-over-TLS or plain DNS upstream, as
+	// ip[:port]
+	Servers []string `toml:"servers"`
+	// ServerName is the name used to verify a DNS-over-TLS upstream
+	ServerName string `toml:"server-name"`
+}
+
+// Config is a configuration file, in TOML format. Its keys are the names of
+// command line flags, and take the same values; flags which may be repeated
+// take an array. Additionally, any number of upstreams may be configured as an
+// array of "upstream" tables.
+type Config struct {
+	Upstreams []Upstream
+
+	options map[string]interface{}
+}
+
+// LoadConfig reads a configuration file
+func LoadConfig(path string) (*Config, error) {
+	var upstreams struct {
+		Upstream []Upstream `toml:"upstream"`
+	}
+	md, err := toml.DecodeFile(path, &upstreams)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range md.Undecoded() {
+		if len(key) > 1 && key[0] == "upstream" {
+			return nil, fmt.Errorf("unknown upstream option %v", key[len(key)-1])
+		}
+	}
+
+	options := make(map[string]interface{})
+	if _, err := toml.DecodeFile(path, &options); err != nil {
+		return nil, err
+	}
+	delete(options, "upstream")
+
+	return &Config{Upstreams: upstreams.Upstream, options: options}, nil
+}
+
+// Apply sets the flags of a FlagSet to the values in the configuration.
+// Flags named in skip are left unchanged, so that flags given on the command
+// line take precedence.
+func (c *Config) Apply(fs *flag.FlagSet, skip map[string]bool) error {
+	// apply in a stable order, so that errors are consistent
+	var names []string
+	for name := range c.options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		f := fs.Lookup(name)
+		if f == nil {
+			return fmt.Errorf("unknown option %v", name)
+		}
+		if skip[name] {
+			continue
+		}
+
+		values, err := configValues(c.options[name])
+		if err != nil {
+			return fmt.Errorf("invalid value for %v: %v", name, err)
+		}
+
+		// repeatable flags are set once per value; others take a list of
+		// values as comma-separated
+		if !repeatable(f.Value) {
+			values = []string{strings.Join(values, ",")}
+		}
+		for _, v := range values {
+			if err := fs.Set(name, v); err != nil {
+				return fmt.Errorf("invalid value for %v: %v", name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// CopyFlags returns a new FlagSet with the flags of fs, which may be set
+// without affecting those of fs. Flags named in keep have their current
+// values, and all others their default values.
+func CopyFlags(fs *flag.FlagSet, keep map[string]bool) *flag.FlagSet {
+	c := flag.NewFlagSet("config", flag.ContinueOnError)
+	fs.VisitAll(func(f *flag.Flag) {
+		var v flag.Value
+		switch t := f.Value.(type) {
+		case KeyValue:
+			kv := make(KeyValue)
+			if keep[f.Name] {
+				kv = t.Copy()
+			}
+			v = kv
+		case *StringList:
+			l := new(StringList)
+			if keep[f.Name] {
+				*l = append(*l, *t...)
+			}
+			v = l
+		default:
+			// the values of the flag package are pointers to their underlying
+			// type, and are set from their string form
+			v = reflect.New(reflect.TypeOf(f.Value).Elem()).Interface().(flag.Value)
+			value := f.DefValue
+			if keep[f.Name] {
+				value = f.Value.String()
+			}
+			v.Set(value)
+		}
+
+		c.Var(v, f.Name, f.Usage)
+	})
+
+	return c
+}
+
+// configValues converts a configuration value to flag values; tables are
+// converted to key=value pairs.
+func configValues(v interface{}) ([]string, error) {
+	switch t := v.(type) {
+	case string, bool, int64, float64:
+		return []string{fmt.Sprint(t)}, nil
+	case []interface{}:
+		var values []string
+		for _, e := range t {
+			vs, err := configValues(e)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, vs...)
+		}
+		return values, nil
+	case map[string]interface{}:
+		var keys []string
+		for k := range t {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		var values []string
+		for _, k := range keys {
+			vs, err := configValues(t[k])
+			if err != nil {
+				return nil, err
+			}
+			for _, v := range vs {
+				values = append(values, k+"="+v)
+			}
+		}
+		return values, nil
+	}
+
+	return nil, fmt.Errorf("unsupported type %T", v)
+}
+
+// repeatable returns true if a flag is set once for each of its values
+func repeatable(v flag.Value) bool {
+	switch v.(type) {
+	case KeyValue, *StringList:
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,158 @@
+package cmd
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func writeTestConfig(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "secure-operator-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if _, err := f.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+
+	return f.Name()
+}
+
+func TestConfig(t *testing.T) {
+	path := writeTestConfig(t, `
+listen = ":5353"
+cache = true
+cache-size = 500
+cache-max-ttl = "1h"
+cache-prefetch = 0.9
+dns-servers = ["8.8.8.8", "8.8.4.4:5353"]
+header = ["X-One=1", "X-One=2"]
+local-record = ["printer.lan. A 192.168.1.5", "lan. TXT \"a,b\""]
+
+[param]
+ct = "application/dns-json"
+
+[route]
+corp = ["corp.example.com", "10.in-addr.arpa"]
+
+[[upstream]]
+format = "message"
+endpoint = "https://dns.google/dns-query"
+method = "POST"
+
+[[upstream]]
+format = "tls"
+servers = ["1.1.1.1", "1.0.0.1:853"]
+server-name = "cloudflare-dns.com"
+name = "corp"
+`)
+	defer os.Remove(path)
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	listen := fs.String("listen", ":53", "")
+	cache := fs.Bool("cache", false, "")
+	size := fs.Int("cache-size", 10, "")
+	maxTTL := fs.Duration("cache-max-ttl", 0, "")
+	prefetch := fs.Float64("cache-prefetch", 0, "")
+	servers := fs.String("dns-servers", "", "")
+	headers, params, routes := make(KeyValue), make(KeyValue), make(KeyValue)
+	fs.Var(headers, "header", "")
+	fs.Var(params, "param", "")
+	fs.Var(routes, "route", "")
+	var records StringList
+	fs.Var(&records, "local-record", "")
+
+	if err := fs.Parse([]string{"-cache-size", "20"}); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.Apply(fs, map[string]bool{"cache-size": true}); err != nil {
+		t.Fatal(err)
+	}
+
+	if *listen != ":5353" || !*cache || *maxTTL != time.Hour || *prefetch != 0.9 {
+		t.Errorf("unexpected flag values %v %v %v %v", *listen, *cache, *maxTTL, *prefetch)
+	}
+	if *size != 20 {
+		t.Errorf("expected command line flag to take precedence, got %v", *size)
+	}
+	if *servers != "8.8.8.8,8.8.4.4:5353" {
+		t.Errorf("unexpected dns servers %v", *servers)
+	}
+	if len(headers["X-One"]) != 2 || params["ct"][0] != "application/dns-json" {
+		t.Errorf("unexpected headers %v or params %v", headers, params)
+	}
+	if len(routes["corp"]) != 2 || routes["corp"][1] != "10.in-addr.arpa" {
+		t.Errorf("unexpected routes %v", routes)
+	}
+	if len(records) != 2 || records[1] != `lan. TXT "a,b"` {
+		t.Errorf("unexpected local records %q", records)
+	}
+
+	if len(cfg.Upstreams) != 2 {
+		t.Fatalf("unexpected upstreams %v", cfg.Upstreams)
+	}
+	if u := cfg.Upstreams[1]; u.Format != "tls" || len(u.Servers) != 2 || u.ServerName != "cloudflare-dns.com" || u.Name != "corp" {
+		t.Errorf("unexpected upstream %+v", u)
+	}
+
+	c := CopyFlags(fs, map[string]bool{"cache-size": true})
+	value := func(name string) string { return c.Lookup(name).Value.String() }
+	if value("listen") != ":53" || value("cache") != "false" || value("header") != "" ||
+		value("local-record") != "" || value("cache-size") != "20" {
+		t.Errorf("expected defaults and kept values, got %v %v %v %v %v", value("listen"),
+			value("cache"), value("header"), value("local-record"), value("cache-size"))
+	}
+
+	// setting the copy must not change the original flags
+	c.Set("listen", ":5300")
+	c.Set("header", "X-Two=1")
+	c.Set("local-record", "nas.lan. A 192.168.1.6")
+	if *listen != ":5353" || len(headers) != 1 || len(records) != 2 {
+		t.Errorf("expected the original flags to be unchanged, got %v %v %q", *listen, headers, records)
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.Int("cache-size", 10, "")
+
+	tests := []struct {
+		name    string
+		content string
+		load    bool
+	}{
+		{"invalid toml", `cache-size = `, false},
+		{"unknown upstream option", "[[upstream]]\nnope = 1", false},
+		{"unknown option", `nope = 1`, true},
+		{"invalid value", `cache-size = "big"`, true},
+	}
+
+	for _, test := range tests {
+		path := writeTestConfig(t, test.content)
+		defer os.Remove(path)
+
+		cfg, err := LoadConfig(path)
+		if !test.load {
+			if err == nil {
+				t.Errorf("%v: expected an error loading", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", test.name, err)
+			continue
+		}
+		if err := cfg.Apply(fs, nil); err == nil {
+			t.Errorf("%v: expected an error applying", test.name)
+		}
+	}
+}
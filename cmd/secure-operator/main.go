@@ -1,14 +1,19 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
+	"io"
 	"math/rand"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 
@@ -21,6 +26,7 @@ import (
 
 const (
 	gdnsEndpoint       = "https://dns.google.com/resolve"
+	googleEndpoint     = "https://dns.google/dns-query"
 	cloudflareEndpoint = "https://cloudflare-dns.com/dns-query"
 	quad9Endpoint      = "https://dns.quad9.net/dns-query"
 )
@@ -68,6 +74,55 @@ unless explicitly overriden:
 	dns-servers: 9.9.9.9, 149.112.112.112
 	params: ct=application/dns-json
 	endpoint : %v`, quad9Endpoint),
+	)
+	format = flag.String(
+		"format",
+		"json",
+		`Format of requests to the DNS-over-HTTPS endpoint, one of: json, message.
+"json" uses the JSON API popularized by Google; "message" sends RFC 8484
+application/dns-message requests, which support all record types. When
+"message" is used with -google, the endpoint defaults to:
+	`+googleEndpoint,
+	)
+	method = flag.String(
+		"method",
+		http.MethodGet,
+		`HTTP method used for "message" format requests, one of: GET, POST`,
+	)
+	dotServers = flag.String(
+		"dot-servers",
+		"",
+		`DNS-over-TLS servers to use in place of a DNS-over-HTTPS endpoint. Comma
+separated, e.g. "1.1.1.1,1.0.0.1:853". The port section is optional, and 853
+will be used by default. Requires "dot-server-name".`,
+	)
+	dotServerName = flag.String(
+		"dot-server-name",
+		"",
+		`Name used to verify the certificate of the DNS-over-TLS servers, e.g.
+"cloudflare-dns.com".`,
+	)
+	fallbackEndpoints = flag.String(
+		"fallback-endpoints",
+		"",
+		`DNS-over-HTTPS endpoint urls to fall back to, in order, when the primary
+endpoint (or DNS-over-TLS servers) fail, time out, or respond with SERVFAIL.
+Comma separated, e.g. "https://cloudflare-dns.com/dns-query". Fallbacks use the
+same format and options as the primary endpoint, with the exception of
+"endpoint-ips".`,
+	)
+	upstreamMode = flag.String(
+		"upstream-mode",
+		"failover",
+		`How upstreams are used when "fallback-endpoints" are provided, one of:
+failover, race. "failover" tries each upstream in order; "race" queries all
+upstreams at once, and uses the fastest successful response.`,
+	)
+	upstreamTimeout = flag.Duration(
+		"upstream-timeout",
+		5*time.Second,
+		`Time to wait for an upstream to respond; in "failover" mode, before falling
+back to the next. Applies only when "fallback-endpoints" are provided.`,
 	)
 	// resolution of the Google DNS endpoint; the interaction of these values is
 	// somewhat complex, and is further explained in the help message.
@@ -110,28 +165,293 @@ we specify that this option should not be used, for privacy. If
        `,
 	)
 
+	clientSubnet = flag.Bool(
+		"client-subnet",
+		false,
+		`Send the querying client's subnet in the edns0-client-subnet option of each
+query, truncated to "client-subnet-ipv4-prefix" or "client-subnet-ipv6-prefix";
+if set, "edns-subnet" is ignored`,
+	)
+	clientSubnetIPv4Prefix = flag.Int(
+		"client-subnet-ipv4-prefix",
+		secop.DefaultClientSubnetIPv4Prefix,
+		`Prefix length IPv4 client addresses are truncated to; 0 sends no part of
+the address`,
+	)
+	clientSubnetIPv6Prefix = flag.Int(
+		"client-subnet-ipv6-prefix",
+		secop.DefaultClientSubnetIPv6Prefix,
+		`Prefix length IPv6 client addresses are truncated to; 0 sends no part of
+the address`,
+	)
+
+	enableCache = flag.Bool(
+		"cache",
+		false,
+		`Cache responses in memory, for the minimum TTL of their answer`,
+	)
+	cacheSize = flag.Int(
+		"cache-size",
+		secop.DefaultCacheSize,
+		`Maximum number of responses to cache; when full, the least recently used
+response is evicted`,
+	)
+	cacheMinTTL = flag.Duration(
+		"cache-min-ttl",
+		0,
+		`Minimum time to cache responses for; lower record TTLs are raised to it`,
+	)
+	cacheMaxTTL = flag.Duration(
+		"cache-max-ttl",
+		0,
+		`Maximum time to cache responses for; higher record TTLs are lowered to it.
+If zero, there is no maximum.`,
+	)
+	cacheServeStale = flag.Duration(
+		"cache-serve-stale",
+		0,
+		`Time after expiry that cached responses may be served for, when upstream
+is unreachable; a refresh is retried in the background while serving stale.
+If zero, stale responses are not served.`,
+	)
+	cacheStaleTTL = flag.Duration(
+		"cache-stale-ttl",
+		secop.DefaultStaleTTL,
+		`TTL of records in stale responses`,
+	)
+	cachePrefetch = flag.Float64(
+		"cache-prefetch",
+		0,
+		`Fraction of a cached response's TTL after which it is refreshed in the
+background, if it is popular; e.g. 0.9. If zero, responses are not prefetched.`,
+	)
+	cachePrefetchHits = flag.Int(
+		"cache-prefetch-hits",
+		2,
+		`Number of times a cached response must be used within its TTL to be
+considered popular enough to prefetch`,
+	)
+	cacheFile = flag.String(
+		"cache-file",
+		"",
+		`File to persist the cache to; the cache is saved on shutdown and every
+"cache-save-interval", and restored from the file at startup`,
+	)
+	cacheSaveInterval = flag.Duration(
+		"cache-save-interval",
+		5*time.Minute,
+		`Interval at which the cache is saved to "cache-file"; if zero, the cache is
+only saved on shutdown`,
+	)
+
+	queryLog = flag.String(
+		"query-log",
+		"",
+		`File to write a log of each query to, as lines of JSON; "-" writes to
+stdout. If empty, queries are not logged.`,
+	)
+	queryLogMaxSize = flag.Int64(
+		"query-log-max-size",
+		100,
+		`Size in megabytes after which the query log file is rotated; if zero, it is
+not rotated by size`,
+	)
+	queryLogMaxAge = flag.Duration(
+		"query-log-max-age",
+		0,
+		`Age after which the query log file is rotated, e.g. "24h"; if zero, it is
+not rotated by age`,
+	)
+	queryLogBackups = flag.Int(
+		"query-log-backups",
+		5,
+		`Number of rotated query log files to keep`,
+	)
+	queryLogClientIP = flag.String(
+		"query-log-client-ip",
+		secop.ClientIPFull,
+		`How client IPs are recorded in the query log: "full", "hash" to record a
+keyed hash of the address, or "omit"`,
+	)
+	queryLogHashKey = flag.String(
+		"query-log-hash-key",
+		"",
+		`Key used to hash client IPs in the query log; if empty, a random key is
+used, and hashes change each time the server is started`,
+	)
+
+	dnssec = flag.Bool(
+		"dnssec",
+		false,
+		`Validate DNSSEC signatures of upstream answers locally, rather than trusting
+the upstream; bogus answers are answered with SERVFAIL`,
+	)
+	trustAnchors = flag.String(
+		"trust-anchors",
+		"",
+		`File of DS or DNSKEY records, one per line, to use as DNSSEC trust anchors
+in place of the built-in root zone anchors`,
+	)
+
+	httpListen = flag.String(
+		"http-listen",
+		"",
+		`Address to serve DNS-over-HTTPS clients on, e.g. ":443"; both RFC 8484
+queries at /dns-query and JSON queries at /resolve are answered. HTTPS is
+served if "tls-cert" and "tls-key" are provided, otherwise plain HTTP. If
+empty, no HTTP listener is started.`,
+	)
+	tlsListen = flag.String(
+		"tls-listen",
+		"",
+		`Address to serve DNS-over-TLS clients on, e.g. ":853"; requires "tls-cert"
+and "tls-key". If empty, no DNS-over-TLS listener is started.`,
+	)
+	tlsCert = flag.String(
+		"tls-cert",
+		"",
+		`Certificate file, in PEM format, for the HTTPS and DNS-over-TLS listeners`,
+	)
+	tlsKey = flag.String(
+		"tls-key",
+		"",
+		`Private key file, in PEM format, for the HTTPS and DNS-over-TLS listeners`,
+	)
+
+	blocklists = flag.String(
+		"blocklists",
+		"",
+		`Files of names to block, comma separated; in hosts file format, one name
+per line, as Adblock "||example.com^" rules, which also block subdomains, as
+wildcards "*.example.com", or as regular expressions "/^ads\d+\./". Rules
+prefixed with "@@" allow names rather than block them.`,
+	)
+	allowlists = flag.String(
+		"allowlists",
+		"",
+		`Files of names to allow, comma separated, in the formats of "blocklists";
+names matching them are never blocked`,
+	)
+	blockMode = flag.String(
+		"block-mode",
+		secop.BlockNXDomain,
+		`How queries for blocked names are answered: "nxdomain", "null" to answer
+with 0.0.0.0 and ::, or "sinkhole" to answer with "block-sinkhole-ips"`,
+	)
+	blockSinkholeIPs = flag.String(
+		"block-sinkhole-ips",
+		"",
+		`Comma separated IPv4 and IPv6 addresses to answer blocked names with, in
+"sinkhole" mode`,
+	)
+	blockTTL = flag.Duration(
+		"block-ttl",
+		secop.DefaultBlockTTL,
+		`TTL of answers for blocked names`,
+	)
+	blocklistReload = flag.Duration(
+		"blocklist-reload-interval",
+		0,
+		`Interval at which blocklists are reloaded from their files; if zero, they
+are reloaded only on SIGHUP`,
+	)
+
+	hostsFiles = flag.String(
+		"hosts-files",
+		"",
+		`Files of local names to answer, comma separated, in /etc/hosts format;
+PTR records are answered for their addresses. Files are reloaded on SIGHUP.`,
+	)
+	localTTL = flag.Duration(
+		"local-ttl",
+		secop.DefaultLocalTTL,
+		`TTL of answers for local names, from "hosts-files" or "local-record"
+records without a TTL`,
+	)
+
+	rebinding = flag.Bool(
+		"rebinding-protection",
+		false,
+		`Remove private, loopback, link-local and unique local addresses from
+answers for names outside of "internal-domains", protecting clients from DNS
+rebinding attacks`,
+	)
+	internalDomains = flag.String(
+		"internal-domains",
+		"",
+		`Domains whose names may have private addresses, comma separated, when
+"rebinding-protection" is set`,
+	)
+	rebindingMode = flag.String(
+		"rebinding-mode",
+		secop.RebindNXDomain,
+		`How questions are answered when every address of the answer was removed
+by "rebinding-protection": "nxdomain", or "nodata" to answer with no records`,
+	)
+
+	dnstapSocket = flag.String(
+		"dnstap-socket",
+		"",
+		`Unix socket to send dnstap messages to, for each query received and sent
+upstream, and their responses`,
+	)
+	dnstapFile = flag.String(
+		"dnstap-file",
+		"",
+		`File to write dnstap messages to, in place of "dnstap-socket"; the file is
+replaced at startup`,
+	)
+	dnstapIdentity = flag.String(
+		"dnstap-identity",
+		"",
+		`Identity of the server in dnstap messages; if empty, the hostname is used`,
+	)
+
+	metricsListen = flag.String(
+		"metrics-listen",
+		"",
+		`Address to serve metrics on, in the Prometheus text format at /metrics,
+e.g. "127.0.0.1:9153". If empty, metrics are not served.`,
+	)
+
+	configFile = flag.String(
+		"config",
+		"",
+		`Configuration file, in TOML format; its keys are the names of these flags,
+and additional upstreams may be given as [[upstream]] tables. Flags given on the
+command line take precedence. The file is reloaded on SIGHUP.`,
+	)
+
 	enableTCP = flag.Bool("tcp", true, "Listen on TCP")
 	enableUDP = flag.Bool("udp", true, "Listen on UDP")
 
 	// variables set in main body
 	headers         = make(cmd.KeyValue)
 	queryParameters = make(cmd.KeyValue)
+	subnetOverrides = make(cmd.KeyValue)
+	routes          = make(cmd.KeyValue)
+	localRecords    cmd.StringList
 )
 
-func serve(net string) {
-	log.Infof("starting %s service on %s", net, *listenAddress)
+func serve(net, addr string, tlsConfig *tls.Config, handler dns.Handler) {
+	log.Infof("starting %s service on %s", net, addr)
 
-	server := &dns.Server{Addr: *listenAddress, Net: net, TsigSecret: nil}
+	server := &dns.Server{Addr: addr, Net: net, TLSConfig: tlsConfig, Handler: handler, TsigSecret: nil}
+	// the server returns an error once shut down, which must be ignored so that
+	// the shutdown completes
+	errs := make(chan error, 1)
 	go func() {
-		if err := server.ListenAndServe(); err != nil {
-			log.Fatalf("Failed to setup the %s server: %s\n", net, err.Error())
-		}
+		errs <- server.ListenAndServe()
 	}()
 
 	// serve until exit
-	sig := make(chan os.Signal)
+	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
-	<-sig
+	select {
+	case err := <-errs:
+		log.Fatalf("Failed to setup the %s server: %s\n", net, err.Error())
+	case <-sig:
+	}
 
 	log.Infof("shutting down %s on interrupt\n", net)
 	if err := server.Shutdown(); err != nil {
@@ -139,87 +459,403 @@ func serve(net string) {
 	}
 }
 
-func main() {
-	// non-standard flag vars
-	flag.Var(
-		headers,
-		"header",
-		`Additional headers to be sent with http requests, as Key=Value; specify
-multiple as:
-    -header Key-1=Value-1-1 -header Key-1=Value1-2 -header Key-2=Value-2`,
-	)
-	flag.Var(
-		queryParameters,
-		"param",
-		`Additional query parameters to be sent with http requests, as key=value;
-specify multiple as:
-    -param key1=value1-1 -param key1=value1-2 -param key2=value2`,
-	)
-	flag.Usage = func() {
-		_, exe := filepath.Split(os.Args[0])
-		fmt.Fprint(os.Stderr, "A DNS-protocol proxy for Google's DNS-over-HTTPS service.\n\n")
-		fmt.Fprintf(os.Stderr, "Usage:\n\n  %s [options]\n\nOptions:\n\n", exe)
-		flag.PrintDefaults()
+// serveHTTP serves HTTP on addr, or HTTPS if a certificate and key file are
+// given
+func serveHTTP(addr string, handler http.Handler, certFile, keyFile string) {
+	useTLS := certFile != "" && keyFile != ""
+	scheme := "http"
+	if useTLS {
+		scheme = "https"
 	}
-	flag.Parse()
+	log.Infof("starting %s service on %s", scheme, addr)
 
-	// seed the global random number generator, used in some utilities and the
-	// google provider
-	rand.Seed(time.Now().UTC().UnixNano())
+	server := &http.Server{Addr: addr, Handler: handler}
+	errs := make(chan error, 1)
+	go func() {
+		if useTLS {
+			errs <- server.ListenAndServeTLS(certFile, keyFile)
+		} else {
+			errs <- server.ListenAndServe()
+		}
+	}()
+
+	// serve until exit
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-errs:
+		log.Fatalf("Failed to setup the %s server: %s\n", scheme, err.Error())
+	case <-sig:
+	}
 
-	// set the loglevel
-	level, err := log.ParseLevel(*logLevel)
+	log.Infof("shutting down %s on interrupt\n", scheme)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Errorf("got unexpected error %s", err.Error())
+	}
+}
+
+func setLogLevel(name string) error {
+	level, err := log.ParseLevel(name)
 	if err != nil {
-		log.Fatalf("invalid log level: %s", err.Error())
+		return fmt.Errorf("invalid log level: %s", err.Error())
 	}
 	log.SetLevel(level)
 
-	if *google && *cloudflare || *google && *quad9 ||
-		*cloudflare && *quad9 || *google && *cloudflare && *quad9 {
-		log.Fatalf("you may not specify `-google` and `-cloudflare` and `-quad9` arguments together")
+	return nil
+}
+
+// reload re-reads the config file, and replaces the handler's provider with
+// one created from it. The config is applied to a copy of the flags, in which
+// those named in skip, given on the command line, keep their values; the flags
+// themselves are left unchanged, as they are read by the running servers.
+// Listeners and the cache are not reconfigured.
+func reload(handler *secop.Handler, path string, skip map[string]bool) error {
+	cfg, err := cmd.LoadConfig(path)
+	if err != nil {
+		return err
+	}
+
+	fs := cmd.CopyFlags(flag.CommandLine, skip)
+	if err := cfg.Apply(fs, skip); err != nil {
+		return err
+	}
+
+	if err := setLogLevel(fs.Lookup("level").Value.String()); err != nil {
+		return err
+	}
+
+	provider, err := newProvider(newProviderSettings(fs), cfg.Upstreams)
+	if err != nil {
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	handler.SetProvider(provider)
+
+	return nil
+}
+
+// loadCache restores the cache from a file written by saveCache, if the file
+// exists
+func loadCache(cache *secop.ResponseCache, path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	n, err := cache.Load(f)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("restored %v cached responses from %v", n, path)
+	return nil
+}
+
+// loadTrustAnchors reads records from a file, one per line; blank lines and
+// comments starting with ";" are ignored
+func loadTrustAnchors(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var anchors []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, ";") {
+			continue
+		}
+		anchors = append(anchors, line)
+	}
+
+	return anchors, scanner.Err()
+}
+
+// saveCache writes the cache to a file; it's written to a temporary file
+// first, so that an existing snapshot is not lost if writing fails
+func saveCache(cache *secop.ResponseCache, path string) error {
+	tmp := path + ".tmp"
+
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	if err := cache.Save(f); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// newHTTPSProvider creates a DNS-over-HTTPS provider for an endpoint, in the
+// format requested by the "format" flag
+func newHTTPSProvider(ep, format, method string, opts *secop.GDNSOptions) (secop.Provider, error) {
+	if format == "message" {
+		return secop.NewDoHProvider(ep, &secop.DoHOptions{
+			Method:          method,
+			Pad:             opts.Pad,
+			EndpointIPs:     opts.EndpointIPs,
+			DNSServers:      opts.DNSServers,
+			EDNSSubnet:      opts.EDNSSubnet,
+			QueryParameters: opts.QueryParameters,
+			Headers:         opts.Headers,
+		})
+	}
+
+	return secop.NewGDNSProvider(ep, opts)
+}
+
+// newUpstream creates a provider for an upstream from the config file; options
+// not specific to the upstream are taken from opts and s
+func newUpstream(u cmd.Upstream, s providerSettings, opts *secop.GDNSOptions) (secop.Provider, error) {
+	switch u.Format {
+	case "tls":
+		servers, err := cmd.CSVtoEndpointsWithPort(strings.Join(u.Servers, ","), secop.DefaultDoTPort)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing upstream servers: %v", err)
+		}
+		return secop.NewDoTProvider(servers, &secop.DoTOptions{
+			ServerName: u.ServerName,
+			Pad:        opts.Pad,
+			EDNSSubnet: opts.EDNSSubnet,
+		})
+	case "dns":
+		servers, err := cmd.CSVtoEndpoints(strings.Join(u.Servers, ","))
+		if err != nil {
+			return nil, fmt.Errorf("error parsing upstream servers: %v", err)
+		}
+		return secop.NewDo53Provider(servers, &secop.Do53Options{
+			EDNSSubnet: opts.EDNSSubnet,
+		})
+	case "json", "message", "":
+		eips, err := cmd.CSVtoIPs(strings.Join(u.EndpointIPs, ","))
+		if err != nil {
+			return nil, fmt.Errorf("error parsing upstream endpoint-ips: %v", err)
+		}
+
+		uopts := *opts
+		uopts.EndpointIPs = eips
+
+		f, m := u.Format, u.Method
+		if f == "" {
+			f = s.format
+		}
+		if m == "" {
+			m = s.method
+		}
+		return newHTTPSProvider(u.Endpoint, f, m, &uopts)
+	}
+
+	return nil, fmt.Errorf("invalid upstream format: %v", u.Format)
+}
+
+// flagProviders creates providers for the upstreams given by flags
+func flagProviders(ep string, dots secop.Endpoints, s providerSettings, opts *secop.GDNSOptions) ([]secop.Provider, error) {
+	var providers []secop.Provider
+	if len(dots) > 0 {
+		p, err := secop.NewDoTProvider(dots, &secop.DoTOptions{
+			ServerName: s.dotServerName,
+			Pad:        opts.Pad,
+			EDNSSubnet: opts.EDNSSubnet,
+		})
+		if err != nil {
+			return nil, err
+		}
+		providers = append(providers, p)
+	} else {
+		p, err := newHTTPSProvider(ep, s.format, s.method, opts)
+		if err != nil {
+			return nil, err
+		}
+		providers = append(providers, p)
+	}
+
+	for _, fep := range strings.Split(s.fallbackEndpoints, ",") {
+		if fep == "" {
+			continue
+		}
+
+		// endpoint IPs apply only to the primary endpoint
+		fopts := *opts
+		fopts.EndpointIPs = nil
+
+		p, err := newHTTPSProvider(fep, s.format, s.method, &fopts)
+		if err != nil {
+			return nil, err
+		}
+		providers = append(providers, p)
 	}
 
-	eips, err := cmd.CSVtoIPs(*endpointIPs)
+	return providers, nil
+}
+
+// newRoutingProvider creates a provider which sends the domains given by the
+// "route" flag to the named upstreams, and all others to provider
+func newRoutingProvider(routes cmd.KeyValue, named map[string]secop.Provider, provider secop.Provider) (secop.Provider, error) {
+	domains := make(map[string]secop.Provider)
+	for name, ds := range routes {
+		p, ok := named[name]
+		if !ok {
+			return nil, fmt.Errorf("route to unknown upstream: %v", name)
+		}
+		for _, d := range ds {
+			domains[d] = p
+		}
+	}
+	for name := range named {
+		if _, ok := routes[name]; !ok {
+			log.Warnf("upstream %v has no routes, and will not be queried", name)
+		}
+	}
+
+	return secop.NewRoutingProvider(domains, provider)
+}
+
+// providerSettings are the flags from which the provider is created. They are
+// read from a FlagSet, so that a provider may be created from a reloaded config
+// without changing the flags read by the running servers.
+type providerSettings struct {
+	format            string
+	method            string
+	upstreamMode      string
+	upstreamTimeout   time.Duration
+	google            bool
+	cloudflare        bool
+	quad9             bool
+	endpoint          string
+	endpointIPs       string
+	dnsServers        string
+	dotServers        string
+	dotServerName     string
+	fallbackEndpoints string
+	pad               bool
+	autoEDNS          bool
+	ednsSubnet        string
+	headers           cmd.KeyValue
+	queryParameters   cmd.KeyValue
+	routes            cmd.KeyValue
+	dnssec            bool
+	trustAnchors      string
+	metrics           bool
+}
+
+// newProviderSettings reads the settings of the provider from a FlagSet
+// holding the flags of this command
+func newProviderSettings(fs *flag.FlagSet) providerSettings {
+	get := func(name string) interface{} {
+		return fs.Lookup(name).Value.(flag.Getter).Get()
+	}
+	keyValue := func(name string) cmd.KeyValue {
+		return fs.Lookup(name).Value.(cmd.KeyValue).Copy()
+	}
+
+	return providerSettings{
+		format:            get("format").(string),
+		method:            get("method").(string),
+		upstreamMode:      get("upstream-mode").(string),
+		upstreamTimeout:   get("upstream-timeout").(time.Duration),
+		google:            get("google").(bool),
+		cloudflare:        get("cloudflare").(bool),
+		quad9:             get("quad9").(bool),
+		endpoint:          get("endpoint").(string),
+		endpointIPs:       get("endpoint-ips").(string),
+		dnsServers:        get("dns-servers").(string),
+		dotServers:        get("dot-servers").(string),
+		dotServerName:     get("dot-server-name").(string),
+		fallbackEndpoints: get("fallback-endpoints").(string),
+		pad:               !get("no-pad").(bool),
+		autoEDNS:          get("auto-edns-subnet").(bool),
+		ednsSubnet:        get("edns-subnet").(string),
+		headers:           keyValue("header"),
+		queryParameters:   keyValue("param"),
+		routes:            keyValue("route"),
+		dnssec:            get("dnssec").(bool),
+		trustAnchors:      get("trust-anchors").(string),
+		metrics:           get("metrics-listen").(string) != "",
+	}
+}
+
+// newProvider creates the provider used to answer queries, as configured by
+// the settings and any upstreams from the config file
+func newProvider(s providerSettings, upstreams []cmd.Upstream) (secop.Provider, error) {
+	if s.format != "json" && s.format != "message" {
+		return nil, fmt.Errorf("invalid format: %v", s.format)
+	}
+	if s.upstreamMode != "failover" && s.upstreamMode != "race" {
+		return nil, fmt.Errorf("invalid upstream mode: %v", s.upstreamMode)
+	}
+
+	if s.google && s.cloudflare || s.google && s.quad9 ||
+		s.cloudflare && s.quad9 || s.google && s.cloudflare && s.quad9 {
+		return nil, fmt.Errorf("you may not specify `-google` and `-cloudflare` and `-quad9` arguments together")
+	}
+
+	eips, err := cmd.CSVtoIPs(s.endpointIPs)
 	if err != nil {
-		log.Fatalf("error parsing endpoint-ips: %v", err)
+		return nil, fmt.Errorf("error parsing endpoint-ips: %v", err)
 	}
-	dips, err := cmd.CSVtoEndpoints(*dnsServers)
+	dips, err := cmd.CSVtoEndpoints(s.dnsServers)
 	if err != nil {
-		log.Fatalf("error parsing dns-servers: %v", err)
+		return nil, fmt.Errorf("error parsing dns-servers: %v", err)
+	}
+	dots, err := cmd.CSVtoEndpointsWithPort(s.dotServers, secop.DefaultDoTPort)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing dot-servers: %v", err)
 	}
 
-	edns := *ednsSubnet
-	if *autoEDNS {
+	edns := s.ednsSubnet
+	if s.autoEDNS {
 		edns = ""
 	}
 	if _, _, err := net.ParseCIDR(edns); edns != "" && err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	if edns != secop.GoogleEDNSSentinelValue {
 		log.Warn("EDNS will be used; authoritative name servers may be able to determine your location")
 	}
 
-	ep := *endpoint
+	ep := s.endpoint
 	opts := &secop.GDNSOptions{
-		Pad:                 !*noPad,
+		Pad:                 s.pad,
 		EndpointIPs:         eips,
 		DNSServers:          dips,
 		UseEDNSsubnetOption: true,
 		EDNSSubnet:          edns,
-		QueryParameters:     map[string][]string(queryParameters),
-		Headers:             http.Header(headers),
+		// copied, as the cloudflare and quad9 defaults are added to them
+		QueryParameters: map[string][]string(s.queryParameters.Copy()),
+		Headers:         http.Header(s.headers.Copy()),
 	}
 
 	// handle "sane defaults" if requested; only where settings are not explicitly
 	// provided by the user
-	if *google {
+	if s.google {
+		// override only if it's currently the default
+		if ep == gdnsEndpoint && s.format == "message" {
+			ep = googleEndpoint
+		}
 		if len(opts.DNSServers) == 0 {
 			opts.DNSServers = []secop.Endpoint{
 				secop.Endpoint{IP: net.ParseIP("8.8.8.8"), Port: 53},
 				secop.Endpoint{IP: net.ParseIP("8.8.4.4"), Port: 53},
 			}
 		}
-	} else if *cloudflare {
+	} else if s.cloudflare {
 		// override only if it's currently the default
 		if ep == gdnsEndpoint {
 			ep = cloudflareEndpoint
@@ -230,10 +866,10 @@ specify multiple as:
 				secop.Endpoint{IP: net.ParseIP("1.1.1.1"), Port: 53},
 			}
 		}
-		if _, ok := opts.QueryParameters["ct"]; !ok {
+		if _, ok := opts.QueryParameters["ct"]; !ok && s.format == "json" {
 			opts.QueryParameters["ct"] = []string{"application/dns-json"}
 		}
-	} else if *quad9 {
+	} else if s.quad9 {
 		// override only if it's currently the default
 		if ep == gdnsEndpoint {
 			ep = quad9Endpoint
@@ -244,20 +880,344 @@ specify multiple as:
 				secop.Endpoint{IP: net.ParseIP("149.112.112.112"), Port: 53},
 			}
 		}
-		if _, ok := opts.QueryParameters["ct"]; !ok {
+		if _, ok := opts.QueryParameters["ct"]; !ok && s.format == "json" {
 			opts.QueryParameters["ct"] = []string{"application/dns-json"}
 		}
 	}
 
-	provider, err := secop.NewGDNSProvider(ep, opts)
+	// named upstreams are queried only for the domains routed to them
+	var providers []secop.Provider
+	named := make(map[string]secop.Provider)
+	for _, u := range upstreams {
+		p, err := newUpstream(u, s, opts)
+		if err != nil {
+			return nil, err
+		}
+		if s.metrics {
+			p = secop.NewInstrumentedProvider(p)
+		}
+
+		if u.Name == "" {
+			providers = append(providers, p)
+		} else if _, ok := named[u.Name]; ok {
+			return nil, fmt.Errorf("duplicate upstream name: %v", u.Name)
+		} else {
+			named[u.Name] = p
+		}
+	}
+
+	// unnamed upstreams from the config file replace those given by flags
+	if len(providers) == 0 {
+		providers, err = flagProviders(ep, dots, s, opts)
+		if err != nil {
+			return nil, err
+		}
+
+		// record the latency and errors of each upstream separately
+		if s.metrics {
+			for i, p := range providers {
+				providers[i] = secop.NewInstrumentedProvider(p)
+			}
+		}
+	}
+
+	provider := providers[0]
+	if len(providers) > 1 && s.upstreamMode == "race" {
+		provider, err = secop.NewRaceProvider(providers, &secop.RaceOptions{
+			Timeout: s.upstreamTimeout,
+		})
+	} else if len(providers) > 1 {
+		provider, err = secop.NewFailoverProvider(providers, &secop.FailoverOptions{
+			Timeout: s.upstreamTimeout,
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// only the default upstreams are validated; the domains routed to named
+	// upstreams, such as internal ones, are often not signed
+	if s.dnssec {
+		vopts := &secop.ValidatorOptions{}
+		if s.trustAnchors != "" {
+			vopts.TrustAnchors, err = loadTrustAnchors(s.trustAnchors)
+			if err != nil {
+				return nil, fmt.Errorf("unable to read trust anchors: %v", err)
+			}
+		}
+
+		provider, err = secop.NewValidatingProvider(provider, vopts)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(s.routes) > 0 || len(named) > 0 {
+		provider, err = newRoutingProvider(s.routes, named, provider)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return provider, nil
+}
+
+func init() {
+	// non-standard flag vars
+	flag.Var(
+		headers,
+		"header",
+		`Additional headers to be sent with http requests, as Key=Value; specify
+multiple as:
+    -header Key-1=Value-1-1 -header Key-1=Value1-2 -header Key-2=Value-2`,
+	)
+	flag.Var(
+		queryParameters,
+		"param",
+		`Additional query parameters to be sent with http requests, as key=value;
+specify multiple as:
+    -param key1=value1-1 -param key1=value1-2 -param key2=value2`,
+	)
+	flag.Var(
+		subnetOverrides,
+		"client-subnet-override",
+		`Subnet to send for clients in a network, when "client-subnet" is set, as
+network=subnet in CIDR notation; use a subnet of 0.0.0.0/0 to send none.
+Specify multiple as:
+    -client-subnet-override 10.0.0.0/8=203.0.113.0/24 -client-subnet-override ...`,
+	)
+	flag.Var(
+		routes,
+		"route",
+		`Domain to send queries for to a named upstream of the config file, rather
+than the default upstreams, as name=domain; the upstream of the longest
+matching domain is used. Specify multiple as:
+    -route corp=corp.example.com -route corp=10.in-addr.arpa`,
+	)
+	flag.Var(
+		&localRecords,
+		"local-record",
+		`A local record to answer, in zone file format; A, AAAA, CNAME, TXT, PTR
+and SRV records are supported. Specify multiple as:
+    -local-record "printer.lan. A 192.168.1.5" -local-record ...`,
+	)
+}
+
+func main() {
+	flag.Usage = func() {
+		_, exe := filepath.Split(os.Args[0])
+		fmt.Fprint(os.Stderr, "A DNS-protocol proxy for Google's DNS-over-HTTPS service.\n\n")
+		fmt.Fprintf(os.Stderr, "Usage:\n\n  %s [options]\n\nOptions:\n\n", exe)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	// seed the global random number generator, used in some utilities and the
+	// google provider
+	rand.Seed(time.Now().UTC().UnixNano())
+
+	// flags given on the command line take precedence over the config file
+	explicit := map[string]bool{"config": true}
+	flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	var upstreams []cmd.Upstream
+	if *configFile != "" {
+		cfg, err := cmd.LoadConfig(*configFile)
+		if err != nil {
+			log.Fatalf("unable to load config: %v", err)
+		}
+		if err := cfg.Apply(flag.CommandLine, explicit); err != nil {
+			log.Fatalf("unable to load config: %v", err)
+		}
+		upstreams = cfg.Upstreams
+	}
+
+	if err := setLogLevel(*logLevel); err != nil {
+		log.Fatal(err)
+	}
+
+	if (*tlsCert == "") != (*tlsKey == "") {
+		log.Fatal("both tls-cert and tls-key must be provided")
+	}
+	if *tlsListen != "" && *tlsCert == "" {
+		log.Fatal("tls-listen requires tls-cert and tls-key")
+	}
+
+	provider, err := newProvider(newProviderSettings(flag.CommandLine), upstreams)
 	if err != nil {
 		log.Fatal(err)
 	}
+
+	// settings which take effect only on restart are read once, before any
+	// goroutine which uses them is started
+	configPath := *configFile
+	cachePath := *cacheFile
+	certFile, keyFile := *tlsCert, *tlsKey
+
 	options := &secop.HandlerOptions{}
+	if *clientSubnet {
+		overrides := make(map[string]string)
+		for network, subnets := range subnetOverrides {
+			overrides[network] = subnets[len(subnets)-1]
+		}
+
+		options.ClientSubnets, err = secop.NewClientSubnets(&secop.ClientSubnetOptions{
+			IPv4Prefix: clientSubnetIPv4Prefix,
+			IPv6Prefix: clientSubnetIPv6Prefix,
+			Overrides:  overrides,
+		})
+		if err != nil {
+			log.Fatalf("error parsing client subnet options: %v", err)
+		}
+	}
+	if *enableCache {
+		options.Cache = secop.NewResponseCache(&secop.CacheOptions{
+			MaxEntries:  *cacheSize,
+			MinTTL:      *cacheMinTTL,
+			MaxTTL:      *cacheMaxTTL,
+			StaleWindow: *cacheServeStale,
+			StaleTTL:    *cacheStaleTTL,
+
+			PrefetchThreshold: *cachePrefetch,
+			PrefetchHits:      *cachePrefetchHits,
+		})
+
+		if cachePath != "" {
+			if err := loadCache(options.Cache, cachePath); err != nil {
+				log.Errorf("unable to restore cache: %v", err)
+			}
+		}
+		if cachePath != "" && *cacheSaveInterval > 0 {
+			interval := *cacheSaveInterval
+			go func() {
+				for range time.Tick(interval) {
+					if err := saveCache(options.Cache, cachePath); err != nil {
+						log.Errorf("unable to save cache: %v", err)
+					}
+				}
+			}()
+		}
+	}
+	if *queryLog != "" {
+		var w io.Writer = os.Stdout
+		if *queryLog != "-" {
+			f, err := secop.NewLogFile(*queryLog, &secop.LogFileOptions{
+				MaxSize:    *queryLogMaxSize * 1024 * 1024,
+				MaxAge:     *queryLogMaxAge,
+				MaxBackups: *queryLogBackups,
+			})
+			if err != nil {
+				log.Fatalf("unable to open query log: %v", err)
+			}
+			defer f.Close()
+			w = f
+		}
+
+		options.QueryLog, err = secop.NewQueryLog(w, &secop.QueryLogOptions{
+			ClientIPs: *queryLogClientIP,
+			HashKey:   *queryLogHashKey,
+		})
+		if err != nil {
+			log.Fatalf("error parsing query log options: %v", err)
+		}
+	}
+	if *blocklists != "" {
+		sinkholes, err := cmd.CSVtoIPs(*blockSinkholeIPs)
+		if err != nil {
+			log.Fatalf("error parsing block-sinkhole-ips: %v", err)
+		}
+
+		var allow []string
+		if *allowlists != "" {
+			allow = strings.Split(*allowlists, ",")
+		}
+
+		options.Blocklist, err = secop.NewBlocklist(&secop.BlocklistOptions{
+			Files:          strings.Split(*blocklists, ","),
+			AllowFiles:     allow,
+			Mode:           *blockMode,
+			SinkholeIPs:    sinkholes,
+			TTL:            *blockTTL,
+			ReloadInterval: *blocklistReload,
+		})
+		if err != nil {
+			log.Fatalf("unable to load blocklists: %v", err)
+		}
+	}
+	if *hostsFiles != "" || len(localRecords) > 0 {
+		var files []string
+		if *hostsFiles != "" {
+			files = strings.Split(*hostsFiles, ",")
+		}
+
+		options.LocalRecords, err = secop.NewLocalRecords(&secop.LocalRecordsOptions{
+			HostsFiles: files,
+			Records:    localRecords,
+			TTL:        *localTTL,
+		})
+		if err != nil {
+			log.Fatalf("unable to load local records: %v", err)
+		}
+	}
+	if *rebinding {
+		var domains []string
+		if *internalDomains != "" {
+			domains = strings.Split(*internalDomains, ",")
+		}
+
+		options.Rebinding, err = secop.NewRebindingFilter(&secop.RebindingOptions{
+			InternalDomains: domains,
+			Mode:            *rebindingMode,
+		})
+		if err != nil {
+			log.Fatalf("error parsing rebinding options: %v", err)
+		}
+	}
+	if *dnstapSocket != "" && *dnstapFile != "" {
+		log.Fatal("dnstap-socket and dnstap-file may not be used together")
+	}
+	dopts := &secop.DnstapOptions{Identity: *dnstapIdentity}
+	if *dnstapSocket != "" {
+		options.Dnstap = secop.NewDnstapSocket(*dnstapSocket, dopts)
+	} else if *dnstapFile != "" {
+		options.Dnstap, err = secop.NewDnstapFile(*dnstapFile, dopts)
+		if err != nil {
+			log.Fatalf("unable to open dnstap file: %v", err)
+		}
+	}
 	handler := secop.NewHandler(provider, options)
 
 	dns.HandleFunc(".", handler.Handle)
 
+	if configPath != "" || options.Blocklist != nil || options.LocalRecords != nil {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				if options.Blocklist != nil {
+					if err := options.Blocklist.Reload(); err != nil {
+						log.Errorf("unable to reload blocklists: %v", err)
+					}
+				}
+				if options.LocalRecords != nil {
+					if err := options.LocalRecords.Reload(); err != nil {
+						log.Errorf("unable to reload local records: %v", err)
+					}
+				}
+				if configPath == "" {
+					continue
+				}
+
+				log.Infof("reloading config from %v", configPath)
+				if err := reload(handler, configPath, explicit); err != nil {
+					log.Errorf("unable to reload config: %v", err)
+					continue
+				}
+				log.Infof("reloaded config from %v", configPath)
+			}
+		}()
+	}
+
 	// push the list of enabled protocols into an array
 	var protocols []string
 	if *enableTCP {
@@ -269,17 +1229,63 @@ specify multiple as:
 
 	// start the servers
 	servers := make(chan bool)
+	listen, tlsAddr, httpAddr, metricsAddr := *listenAddress, *tlsListen, *httpListen, *metricsListen
 	for _, protocol := range protocols {
 		go func(protocol string) {
-			serve(protocol)
+			serve(protocol, listen, nil, nil)
 			servers <- true
 		}(protocol)
 	}
 
+	count := len(protocols)
+	if tlsAddr != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			log.Fatalf("unable to load TLS certificate: %v", err)
+		}
+
+		count++
+		go func() {
+			serve("tcp-tls", tlsAddr, &tls.Config{
+				Certificates: []tls.Certificate{cert},
+			}, dns.HandlerFunc(handler.HandleTLS))
+			servers <- true
+		}()
+	}
+	if httpAddr != "" {
+		count++
+		go func() {
+			serveHTTP(httpAddr, secop.NewHTTPHandler(handler, nil), certFile, keyFile)
+			servers <- true
+		}()
+	}
+	if metricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", secop.MetricsHandler())
+		if options.Blocklist != nil {
+			mux.Handle("/debug/rule-hits", options.Blocklist.HitsHandler())
+		}
+
+		count++
+		go func() {
+			serveHTTP(metricsAddr, mux, "", "")
+			servers <- true
+		}()
+	}
+
 	// wait for servers to exit
-	for i := 0; i < len(protocols); i++ {
+	for i := 0; i < count; i++ {
 		<-servers
 	}
 
+	if options.Cache != nil && cachePath != "" {
+		if err := saveCache(options.Cache, cachePath); err != nil {
+			log.Errorf("unable to save cache: %v", err)
+		}
+	}
+	if options.Dnstap != nil {
+		options.Dnstap.Close()
+	}
+
 	log.Infoln("servers exited, stopping")
 }
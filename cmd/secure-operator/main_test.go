@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	secop "github.com/fardog/secureoperator"
+	"github.com/fardog/secureoperator/cmd"
+)
+
+func TestNewProviderValidatesOnlyDefault(t *testing.T) {
+	// an unsigned internal domain, as served by a local resolver
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dns.Server{
+		PacketConn: pc,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			m := new(dns.Msg)
+			m.SetReply(r)
+			m.Answer = []dns.RR{&dns.A{
+				Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+				A:   net.ParseIP("192.168.1.5"),
+			}}
+			w.WriteMsg(m)
+		}),
+	}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+
+	s := providerSettings{
+		format:       "json",
+		upstreamMode: "failover",
+		ednsSubnet:   secop.GoogleEDNSSentinelValue,
+		dnssec:       true,
+		routes:       cmd.KeyValue{"lan": {"lan"}},
+	}
+
+	provider, err := newProvider(s, []cmd.Upstream{
+		{Name: "lan", Format: "dns", Servers: []string{pc.LocalAddr().String()}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the routed domain must be answered without being validated
+	resp, err := provider.Query(secop.DNSQuestion{Name: "printer.lan.", Type: dns.TypeA})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.ResponseCode != dns.RcodeSuccess || len(resp.Answer) != 1 {
+		t.Errorf("unexpected response %v", resp)
+	}
+}
+
+func TestReloadLeavesFlags(t *testing.T) {
+	f, err := ioutil.TempFile("", "secure-operator-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`
+format = "message"
+
+[[upstream]]
+format = "dns"
+servers = ["127.0.0.1:5353"]
+`)
+	f.Close()
+
+	initial, err := secop.NewDo53Provider(secop.Endpoints{{IP: net.ParseIP("127.0.0.1"), Port: 53}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := secop.NewHandler(initial, nil)
+
+	if err := reload(h, f.Name(), map[string]bool{"config": true}); err != nil {
+		t.Fatal(err)
+	}
+	if h.Provider() == secop.Provider(initial) {
+		t.Error("expected the provider to be replaced")
+	}
+	// the config is applied to a copy of the flags, which are read by the
+	// running servers
+	if *format != "json" {
+		t.Errorf("expected the format flag to be unchanged, got %v", *format)
+	}
+}
@@ -11,13 +11,19 @@ import (
 // CSVtoEndpoints takes a comma-separated string of endpoints, and parses to a
 // []secop.Endpoint
 func CSVtoEndpoints(csv string) (eps []secop.Endpoint, err error) {
+	return CSVtoEndpointsWithPort(csv, 53)
+}
+
+// CSVtoEndpointsWithPort takes a comma-separated string of endpoints, and
+// parses to a []secop.Endpoint, using the given port where none is specified
+func CSVtoEndpointsWithPort(csv string, port uint16) (eps []secop.Endpoint, err error) {
 	reps := strings.Split(csv, ",")
 	for _, r := range reps {
 		if r == "" {
 			continue
 		}
 
-		ep, err := secop.ParseEndpoint(r, 53)
+		ep, err := secop.ParseEndpoint(r, port)
 		if err != nil {
 			return eps, err
 		}
@@ -65,6 +71,17 @@ func (k KeyValue) Set(kv string) error {
 	return nil
 }
 
+// Copy returns a copy of the keys and values, which may be modified without
+// affecting the original
+func (k KeyValue) Copy() KeyValue {
+	c := make(KeyValue, len(k))
+	for key, vs := range k {
+		c[key] = append([]string(nil), vs...)
+	}
+
+	return c
+}
+
 func (k KeyValue) String() string {
 	var s []string
 	for k, vs := range k {
@@ -75,3 +92,20 @@ func (k KeyValue) String() string {
 
 	return strings.Join(s, " ")
 }
+
+// StringList is a flag which may be given more than once, collecting each of
+// its values
+type StringList []string
+
+func (s *StringList) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+func (s *StringList) String() string {
+	if s == nil {
+		return ""
+	}
+
+	return strings.Join(*s, " ")
+}
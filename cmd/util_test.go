@@ -58,6 +58,23 @@ func TestCSVtoEndpoints(t *testing.T) {
 	}
 }
 
+func TestCSVtoEndpointsWithPort(t *testing.T) {
+	results, err := CSVtoEndpointsWithPort("1.1.1.1,1.0.0.1:8853", 853)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"1.1.1.1:853", "1.0.0.1:8853"}
+	if len(results) != len(expected) {
+		t.Fatalf("expected %v results, got %v", len(expected), len(results))
+	}
+	for i, e := range expected {
+		if r := results[i].String(); r != e {
+			t.Errorf("%v: expected %v, got %v", i, e, r)
+		}
+	}
+}
+
 func TestCSVtoIPs(t *testing.T) {
 	type Case struct {
 		csv      string
@@ -148,3 +165,30 @@ func TestKeyValue(t *testing.T) {
 		t.Error("did not get value for key2")
 	}
 }
+
+func TestKeyValueCopy(t *testing.T) {
+	kv := make(KeyValue)
+	kv.Set("key1=value1")
+
+	c := kv.Copy()
+	c.Set("key1=value2")
+	c.Set("key2=value")
+
+	if len(kv) != 1 || len(kv["key1"]) != 1 {
+		t.Errorf("original was modified: %v", kv)
+	}
+	if len(c) != 2 || len(c["key1"]) != 2 {
+		t.Errorf("unexpected copy %v", c)
+	}
+}
+
+func TestStringList(t *testing.T) {
+	var l StringList
+
+	l.Set("printer.lan. A 192.168.1.5")
+	l.Set("nas.lan. A 192.168.1.6")
+
+	if len(l) != 2 || l[0] != "printer.lan. A 192.168.1.5" || l[1] != "nas.lan. A 192.168.1.6" {
+		t.Errorf("unexpected values %q", l)
+	}
+}
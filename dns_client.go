@@ -161,6 +161,7 @@ func (c *SimpleDNSClient) LookupIP(host string) ([]net.IP, error) {
 	entry, ok := c.cache.Get(host)
 	if ok && entry.expires.After(time.Now()) {
 		log.Debugf("simple dns cache hit for %v", host)
+		bootstrapCacheHits.inc()
 		return entry.ips, nil
 	}
 
@@ -173,12 +174,14 @@ func (c *SimpleDNSClient) LookupIP(host string) ([]net.IP, error) {
 		defer cancel()
 
 		log.Infof("simple dns lookup %v", host)
+		bootstrapLookups.inc()
 		r, err := exchange(ctx, &msg, server.String())
 		if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
 			// was a timeout error; continue to the next server
 			continue
 		}
 		if err != nil {
+			errorsTotal.inc(errorBootstrap)
 			return nil, err
 		}
 
@@ -212,5 +215,6 @@ func (c *SimpleDNSClient) LookupIP(host string) ([]net.IP, error) {
 	}
 
 	// we didn't reach any server; return a known error
+	errorsTotal.inc(errorBootstrap)
 	return nil, ErrAllServersFailed
 }
@@ -0,0 +1,380 @@
+package secureoperator
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+const (
+	// DefaultDnstapBufferSize is the number of dnstap messages buffered while
+	// waiting to be written, unless otherwise specified
+	DefaultDnstapBufferSize = 1024
+
+	dnstapContentType      = "protobuf:dnstap.Dnstap"
+	dnstapDefaultVersion   = "secure-operator"
+	dnstapDialTimeout      = 5 * time.Second
+	dnstapReconnectBackoff = 10 * time.Second
+)
+
+// dnstap message types and socket enumerations; see
+// https://github.com/dnstap/dnstap.pb
+const (
+	dnstapTypeMessage = 1
+
+	dnstapClientQuery       = 5
+	dnstapClientResponse    = 6
+	dnstapForwarderQuery    = 7
+	dnstapForwarderResponse = 8
+
+	dnstapFamilyINET  = 1
+	dnstapFamilyINET6 = 2
+
+	dnstapProtocolUDP = 1
+	dnstapProtocolTCP = 2
+	dnstapProtocolDOT = 3
+	dnstapProtocolDOH = 4
+)
+
+// errDnstapClosed is returned when a dnstap output may not be reopened
+var errDnstapClosed = errors.New("dnstap output closed")
+
+// DnstapOptions is a configuration object for optional Dnstap configuration
+type DnstapOptions struct {
+	// Identity identifies the server in each message; if not provided, the
+	// hostname is used.
+	Identity string
+	// Version identifies the software in each message; if not provided,
+	// "secure-operator" is used.
+	Version string
+	// BufferSize is the number of messages buffered while waiting to be
+	// written; once full, messages are dropped rather than delay queries. If
+	// not provided, DefaultDnstapBufferSize is used.
+	BufferSize int
+}
+
+// NewDnstapFile creates a Dnstap which writes to a file, replacing any
+// existing file at path
+func NewDnstapFile(path string, opts *DnstapOptions) (*Dnstap, error) {
+	fw, err := createFrameFile(path, dnstapContentType)
+	if err != nil {
+		return nil, err
+	}
+
+	d := newDnstap(opts, func() (*frameWriter, error) {
+		// a stream can't be resumed once its file has failed
+		return nil, errDnstapClosed
+	})
+	go d.run(fw)
+
+	return d, nil
+}
+
+// NewDnstapSocket creates a Dnstap which writes to the unix socket at path,
+// such as that of a dnstap collector. If the socket can't be reached, messages
+// are dropped until it can be; connections are retried periodically.
+func NewDnstapSocket(path string, opts *DnstapOptions) *Dnstap {
+	d := newDnstap(opts, func() (*frameWriter, error) {
+		return dialFrameSocket(path, dnstapContentType, dnstapDialTimeout)
+	})
+	go d.run(nil)
+
+	return d
+}
+
+func newDnstap(opts *DnstapOptions, connect func() (*frameWriter, error)) *Dnstap {
+	if opts == nil {
+		opts = &DnstapOptions{}
+	}
+	if opts.Identity == "" {
+		opts.Identity, _ = os.Hostname()
+	}
+	if opts.Version == "" {
+		opts.Version = dnstapDefaultVersion
+	}
+	if opts.BufferSize == 0 {
+		opts.BufferSize = DefaultDnstapBufferSize
+	}
+
+	return &Dnstap{
+		opts:     opts,
+		connect:  connect,
+		messages: make(chan []byte, opts.BufferSize),
+		done:     make(chan struct{}),
+	}
+}
+
+// Dnstap logs the queries received and sent by a Handler, and their
+// responses, in the dnstap format: protobuf messages in a Frame Streams
+// output.
+type Dnstap struct {
+	opts    *DnstapOptions
+	connect func() (*frameWriter, error)
+
+	mutex    sync.RWMutex
+	closed   bool
+	messages chan []byte
+	done     chan struct{}
+}
+
+// Close stops logging, writing any buffered messages and ending the stream
+func (d *Dnstap) Close() error {
+	d.mutex.Lock()
+	if !d.closed {
+		d.closed = true
+		close(d.messages)
+	}
+	d.mutex.Unlock()
+
+	<-d.done
+
+	return nil
+}
+
+// run writes messages until closed, (re)connecting the output as needed
+func (d *Dnstap) run(fw *frameWriter) {
+	defer close(d.done)
+
+	var retry time.Time
+	for msg := range d.messages {
+		if fw == nil {
+			if time.Now().Before(retry) {
+				errorsTotal.inc(errorDnstap)
+				continue
+			}
+
+			var err error
+			if fw, err = d.connect(); err != nil {
+				log.Errorf("unable to open dnstap output: %v", err)
+				errorsTotal.inc(errorDnstap)
+				retry = time.Now().Add(dnstapReconnectBackoff)
+				continue
+			}
+		}
+
+		err := fw.writeFrame(msg)
+		// flush once the buffer is drained, so that messages are written
+		// promptly, but in batches when busy
+		if err == nil && len(d.messages) == 0 {
+			err = fw.flush()
+		}
+		if err != nil {
+			log.Errorf("unable to write dnstap output: %v", err)
+			errorsTotal.inc(errorDnstap)
+			fw.conn.Close()
+			fw = nil
+		}
+	}
+
+	if fw != nil {
+		if err := fw.close(); err != nil {
+			log.Errorf("unable to close dnstap output: %v", err)
+		}
+	}
+}
+
+// send queues a message to be written, dropping it if the buffer is full
+func (d *Dnstap) send(m *dnstapMessage) {
+	buf := d.encode(m)
+
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	if d.closed {
+		return
+	}
+
+	select {
+	case d.messages <- buf:
+	default:
+		errorsTotal.inc(errorDnstap)
+	}
+}
+
+// clientQuery logs a query received from a client
+func (d *Dnstap) clientQuery(w dns.ResponseWriter, r *dns.Msg, t time.Time) {
+	m := newClientMessage(dnstapClientQuery, w)
+	m.queryTime = t
+	m.query, _ = r.Pack()
+
+	d.send(m)
+}
+
+// clientResponse logs the response to a query received from a client
+func (d *Dnstap) clientResponse(w dns.ResponseWriter, resp *dns.Msg, qt, rt time.Time) {
+	m := newClientMessage(dnstapClientResponse, w)
+	m.queryTime = qt
+	m.responseTime = rt
+	m.response, _ = resp.Pack()
+
+	d.send(m)
+}
+
+// forwarderQuery logs a question sent to the provider
+func (d *Dnstap) forwarderQuery(q DNSQuestion, t time.Time) {
+	msg, err := newQueryMsg(q, nil, false)
+	if err != nil {
+		return
+	}
+
+	m := &dnstapMessage{kind: dnstapForwarderQuery, queryTime: t}
+	m.query, _ = msg.Pack()
+
+	d.send(m)
+}
+
+// forwarderResponse logs the response of the provider to a question
+func (d *Dnstap) forwarderResponse(q DNSQuestion, resp *DNSResponse, qt, rt time.Time) {
+	msg, err := newQueryMsg(q, nil, false)
+	if err != nil {
+		return
+	}
+
+	m := &dnstapMessage{kind: dnstapForwarderResponse, queryTime: qt, responseTime: rt}
+	m.response, _ = newResponseMsg(msg, resp).Pack()
+
+	d.send(m)
+}
+
+// dnstapMessage is a dnstap Message; unset fields are omitted
+type dnstapMessage struct {
+	kind         uint64
+	protocol     uint64
+	queryAddr    net.IP
+	queryPort    int
+	responseAddr net.IP
+	responsePort int
+	queryTime    time.Time
+	responseTime time.Time
+	query        []byte
+	response     []byte
+}
+
+// newClientMessage creates a message for an exchange with a client, which is
+// the querier
+func newClientMessage(kind uint64, w dns.ResponseWriter) *dnstapMessage {
+	m := &dnstapMessage{kind: kind}
+
+	switch protocol(w) {
+	case "udp":
+		m.protocol = dnstapProtocolUDP
+	case "tls":
+		m.protocol = dnstapProtocolDOT
+	case "https":
+		m.protocol = dnstapProtocolDOH
+	default:
+		m.protocol = dnstapProtocolTCP
+	}
+
+	m.queryAddr, m.queryPort = addrParts(w.RemoteAddr())
+	m.responseAddr, m.responsePort = addrParts(w.LocalAddr())
+
+	return m
+}
+
+func addrParts(addr net.Addr) (net.IP, int) {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP, a.Port
+	case *net.TCPAddr:
+		return a.IP, a.Port
+	}
+
+	return nil, 0
+}
+
+// encode serializes a message, wrapped in a Dnstap envelope, as protobuf
+func (d *Dnstap) encode(m *dnstapMessage) []byte {
+	var msg protobuf
+	msg.varint(1, m.kind)
+	if ip := m.queryAddr; ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			msg.varint(2, dnstapFamilyINET)
+			msg.bytes(4, ip4)
+		} else {
+			msg.varint(2, dnstapFamilyINET6)
+			msg.bytes(4, ip.To16())
+		}
+	}
+	if m.protocol != 0 {
+		msg.varint(3, m.protocol)
+	}
+	if ip := m.responseAddr; ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		msg.bytes(5, ip)
+	}
+	if m.queryAddr != nil {
+		msg.varint(6, uint64(m.queryPort))
+	}
+	if m.responseAddr != nil {
+		msg.varint(7, uint64(m.responsePort))
+	}
+	if !m.queryTime.IsZero() {
+		msg.varint(8, uint64(m.queryTime.Unix()))
+		msg.fixed32(9, uint32(m.queryTime.Nanosecond()))
+	}
+	if m.query != nil {
+		msg.bytes(10, m.query)
+	}
+	if !m.responseTime.IsZero() {
+		msg.varint(12, uint64(m.responseTime.Unix()))
+		msg.fixed32(13, uint32(m.responseTime.Nanosecond()))
+	}
+	if m.response != nil {
+		msg.bytes(14, m.response)
+	}
+
+	var env protobuf
+	env.bytes(1, []byte(d.opts.Identity))
+	env.bytes(2, []byte(d.opts.Version))
+	env.bytes(14, msg)
+	env.varint(15, dnstapTypeMessage)
+
+	return env
+}
+
+// protobuf is a protocol buffers message, encoded field by field
+type protobuf []byte
+
+const (
+	protobufVarint  = 0
+	protobufBytes   = 2
+	protobufFixed32 = 5
+)
+
+func (p *protobuf) key(field int, wire uint64) {
+	*p = appendVarint(*p, uint64(field)<<3|wire)
+}
+
+func (p *protobuf) varint(field int, v uint64) {
+	p.key(field, protobufVarint)
+	*p = appendVarint(*p, v)
+}
+
+func (p *protobuf) bytes(field int, v []byte) {
+	p.key(field, protobufBytes)
+	*p = appendVarint(*p, uint64(len(v)))
+	*p = append(*p, v...)
+}
+
+func (p *protobuf) fixed32(field int, v uint32) {
+	p.key(field, protobufFixed32)
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], v)
+	*p = append(*p, b[:]...)
+}
+
+func appendVarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+
+	return append(b, buf[:n]...)
+}
@@ -0,0 +1,218 @@
+package secureoperator
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// readFrame reads a Frame Streams frame; control frames are returned with
+// control set, and their type as the first four bytes of data
+func readFrame(t *testing.T, r io.Reader) (data []byte, control bool) {
+	var length [4]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		t.Fatal(err)
+	}
+
+	n := binary.BigEndian.Uint32(length[:])
+	if n == 0 {
+		control = true
+		if _, err := io.ReadFull(r, length[:]); err != nil {
+			t.Fatal(err)
+		}
+		n = binary.BigEndian.Uint32(length[:])
+	}
+
+	data = make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		t.Fatal(err)
+	}
+
+	return data, control
+}
+
+func writeControlFrame(t *testing.T, w io.Writer, ctype uint32) {
+	frame := make([]byte, 12)
+	binary.BigEndian.PutUint32(frame[4:], 4)
+	binary.BigEndian.PutUint32(frame[8:], ctype)
+	if _, err := w.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// protobufFields decodes the varint and length-delimited fields of a protobuf
+// message; fixed32 fields are skipped
+func protobufFields(t *testing.T, b []byte) map[int][]byte {
+	fields := make(map[int][]byte)
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		b = b[n:]
+
+		field := int(key >> 3)
+		switch key & 7 {
+		case protobufVarint:
+			v, n := binary.Uvarint(b)
+			fields[field] = appendVarint(nil, v)
+			b = b[n:]
+		case protobufBytes:
+			l, n := binary.Uvarint(b)
+			fields[field] = b[n : n+int(l)]
+			b = b[n+int(l):]
+		case protobufFixed32:
+			b = b[4:]
+		default:
+			t.Fatalf("unexpected wire type %v", key&7)
+		}
+	}
+
+	return fields
+}
+
+// dnstapMessageTypes reads the data frames of a stream up to its STOP frame,
+// returning the type of each message
+func dnstapMessageTypes(t *testing.T, r io.Reader) []uint64 {
+	var types []uint64
+	for {
+		data, control := readFrame(t, r)
+		if control {
+			if binary.BigEndian.Uint32(data) != fstrmControlStop {
+				t.Fatalf("unexpected control frame %v", data)
+			}
+			return types
+		}
+
+		env := protobufFields(t, data)
+		if string(env[1]) != "test" {
+			t.Errorf("unexpected identity %q", env[1])
+		}
+		msg := protobufFields(t, env[14])
+		kind, _ := binary.Uvarint(msg[1])
+		types = append(types, kind)
+	}
+}
+
+func handleDnstapQuery(t *testing.T, d *Dnstap) {
+	p := &mockProvider{name: "mock", resp: testResponse("example.com.", 300)}
+	h := NewHandler(p, &HandlerOptions{Dnstap: d})
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	h.Handle(&testResponseWriter{}, req)
+
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDnstapFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secureoperator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "dnstap.fstrm")
+	d, err := NewDnstapFile(path, &DnstapOptions{Identity: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handleDnstapQuery(t, d)
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+
+	start, control := readFrame(t, r)
+	if !control || binary.BigEndian.Uint32(start) != fstrmControlStart {
+		t.Fatalf("expected a START frame, got %v", start)
+	}
+	if ct := string(start[12:]); ct != dnstapContentType {
+		t.Errorf("unexpected content type %q", ct)
+	}
+
+	types := dnstapMessageTypes(t, r)
+	expected := []uint64{dnstapClientQuery, dnstapForwarderQuery, dnstapForwarderResponse, dnstapClientResponse}
+	if len(types) != len(expected) {
+		t.Fatalf("expected %v messages, got %v", expected, types)
+	}
+	for i := range types {
+		if types[i] != expected[i] {
+			t.Errorf("expected %v messages, got %v", expected, types)
+			break
+		}
+	}
+}
+
+func TestDnstapSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secureoperator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "dnstap.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	received := make(chan []uint64, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+
+		if ready, _ := readFrame(t, r); binary.BigEndian.Uint32(ready) != fstrmControlReady {
+			t.Errorf("expected a READY frame, got %v", ready)
+		}
+		writeControlFrame(t, conn, fstrmControlAccept)
+		if start, _ := readFrame(t, r); binary.BigEndian.Uint32(start) != fstrmControlStart {
+			t.Errorf("expected a START frame, got %v", start)
+		}
+
+		types := dnstapMessageTypes(t, r)
+		writeControlFrame(t, conn, fstrmControlFinish)
+		received <- types
+	}()
+
+	d := NewDnstapSocket(path, &DnstapOptions{Identity: "test"})
+	handleDnstapQuery(t, d)
+
+	if types := <-received; len(types) != 4 {
+		t.Errorf("expected 4 messages, got %v", types)
+	}
+}
+
+func TestDnstapClientProtocol(t *testing.T) {
+	tcp := &testResponseWriter{remote: &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 40000}}
+
+	tests := []struct {
+		w        dns.ResponseWriter
+		expected uint64
+	}{
+		{&testResponseWriter{}, dnstapProtocolUDP},
+		{tcp, dnstapProtocolTCP},
+		{&tlsResponseWriter{tcp}, dnstapProtocolDOT},
+		{&httpResponseWriter{remote: tcp.RemoteAddr()}, dnstapProtocolDOH},
+	}
+	for _, test := range tests {
+		if m := newClientMessage(dnstapClientQuery, test.w); m.protocol != test.expected {
+			t.Errorf("expected protocol %v, got %v", test.expected, m.protocol)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package secureoperator
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+)
+
+// Frame Streams control frame types and fields; see
+// https://github.com/farsightsec/fstrm
+const (
+	fstrmControlAccept = 0x01
+	fstrmControlStart  = 0x02
+	fstrmControlStop   = 0x03
+	fstrmControlReady  = 0x04
+	fstrmControlFinish = 0x05
+
+	fstrmFieldContentType = 0x01
+
+	// the maximum size of a control frame which is accepted from a reader
+	fstrmMaxControlFrame = 512
+)
+
+// errUnexpectedControlFrame is returned when a Frame Streams reader sends
+// a control frame other than the one expected during a handshake
+var errUnexpectedControlFrame = errors.New("unexpected frame streams control frame")
+
+// frameWriter writes data frames of a single content type to a Frame Streams
+// output; a file, which receives a unidirectional stream, or a unix socket,
+// with which a bidirectional handshake is made.
+type frameWriter struct {
+	conn   io.WriteCloser
+	w      *bufio.Writer
+	r      *bufio.Reader
+	ctype  string
+	socket bool
+}
+
+// createFrameFile creates a file, and starts a unidirectional stream in it
+func createFrameFile(path, ctype string) (*frameWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	fw := &frameWriter{conn: f, w: bufio.NewWriter(f), ctype: ctype}
+	if err := fw.start(); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return fw, nil
+}
+
+// dialFrameSocket connects to a unix socket, and starts a bidirectional
+// stream with the reader listening on it
+func dialFrameSocket(path, ctype string, timeout time.Duration) (*frameWriter, error) {
+	conn, err := net.DialTimeout("unix", path, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	fw := &frameWriter{
+		conn:   conn,
+		w:      bufio.NewWriter(conn),
+		r:      bufio.NewReader(conn),
+		ctype:  ctype,
+		socket: true,
+	}
+
+	// the handshake must complete within the timeout; writes afterwards have
+	// deadlines of their own
+	conn.SetDeadline(time.Now().Add(timeout))
+	if err := fw.start(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	return fw, nil
+}
+
+// start begins the stream; a bidirectional stream is first negotiated with
+// READY and ACCEPT frames.
+func (fw *frameWriter) start() error {
+	if fw.socket {
+		if err := fw.writeControl(fstrmControlReady); err != nil {
+			return err
+		}
+		if err := fw.readControl(fstrmControlAccept); err != nil {
+			return err
+		}
+	}
+
+	return fw.writeControl(fstrmControlStart)
+}
+
+// writeFrame writes a data frame, buffered until the next flush
+func (fw *frameWriter) writeFrame(data []byte) error {
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(data)))
+
+	if _, err := fw.w.Write(length[:]); err != nil {
+		return err
+	}
+	_, err := fw.w.Write(data)
+
+	return err
+}
+
+func (fw *frameWriter) flush() error {
+	return fw.w.Flush()
+}
+
+// close stops the stream, waiting for the reader of a bidirectional stream to
+// acknowledge it, and closes the output
+func (fw *frameWriter) close() error {
+	err := fw.writeControl(fstrmControlStop)
+	if err == nil && fw.socket {
+		if c, ok := fw.conn.(net.Conn); ok {
+			c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		}
+		err = fw.readControl(fstrmControlFinish)
+	}
+
+	if cerr := fw.conn.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// writeControl writes a control frame; READY and START frames carry the
+// content type of the stream
+func (fw *frameWriter) writeControl(ctype uint32) error {
+	frame := make([]byte, 12, 20+len(fw.ctype))
+	// an escape sequence, a zero length data frame, marks a control frame
+	binary.BigEndian.PutUint32(frame[8:], ctype)
+	if ctype == fstrmControlReady || ctype == fstrmControlStart {
+		var field [8]byte
+		binary.BigEndian.PutUint32(field[:4], fstrmFieldContentType)
+		binary.BigEndian.PutUint32(field[4:], uint32(len(fw.ctype)))
+		frame = append(frame, field[:]...)
+		frame = append(frame, fw.ctype...)
+	}
+	binary.BigEndian.PutUint32(frame[4:], uint32(len(frame)-8))
+
+	if _, err := fw.w.Write(frame); err != nil {
+		return err
+	}
+
+	return fw.w.Flush()
+}
+
+// readControl reads a control frame from the reader of a bidirectional
+// stream, which must be of the expected type
+func (fw *frameWriter) readControl(expected uint32) error {
+	var header [8]byte
+	if _, err := io.ReadFull(fw.r, header[:]); err != nil {
+		return err
+	}
+
+	escape := binary.BigEndian.Uint32(header[:4])
+	length := binary.BigEndian.Uint32(header[4:])
+	if escape != 0 || length < 4 || length > fstrmMaxControlFrame {
+		return errUnexpectedControlFrame
+	}
+
+	frame := make([]byte, length)
+	if _, err := io.ReadFull(fw.r, frame); err != nil {
+		return err
+	}
+	if t := binary.BigEndian.Uint32(frame[:4]); t != expected {
+		return fmt.Errorf("%v: expected type %v, got %v", errUnexpectedControlFrame, expected, t)
+	}
+
+	return nil
+}
@@ -1,80 +1,426 @@
 package secureoperator
 
 import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
 	log "github.com/Sirupsen/logrus"
 	"github.com/miekg/dns"
 )
 
+// ErrQuestionMismatch is returned when a provider's response is for a
+// question other than the one which was asked
+var ErrQuestionMismatch = errors.New("response does not match question")
+
+// staleRefreshInterval is the time between attempts to refresh a response
+// which is being served stale; it is a variable to allow its mocking during
+// testing
+var staleRefreshInterval = 10 * time.Second
+
 // HandlerOptions specifies options to be used when instantiating a handler
-type HandlerOptions struct{}
+type HandlerOptions struct {
+	// Cache, if provided, is used to answer questions without querying the
+	// provider where possible; responses from the provider are stored in it.
+	Cache *ResponseCache
+	// ClientSubnets, if provided, determines the EDNS client subnet sent for
+	// each query from the address of the client which made it.
+	ClientSubnets *ClientSubnets
+	// QueryLog, if provided, records each query answered by the handler.
+	QueryLog *QueryLog
+	// Dnstap, if provided, logs each query received from clients and sent to
+	// the provider, and their responses, in the dnstap format.
+	Dnstap *Dnstap
+	// Blocklist, if provided, answers queries for blocked names without
+	// querying the provider.
+	Blocklist *Blocklist
+	// LocalRecords, if provided, answers queries for local names without
+	// querying the provider; they are answered even if blocked.
+	LocalRecords *LocalRecords
+	// Rebinding, if provided, removes private addresses from the provider's
+	// responses for names outside of internal domains.
+	Rebinding *RebindingFilter
+}
 
 // Handler represents a DNS handler
 type Handler struct {
-	options  *HandlerOptions
-	provider Provider
+	options *HandlerOptions
+
+	providerMutex sync.RWMutex
+	provider      Provider
+	// queries tracks the queries outstanding to provider, so that it may be
+	// closed once they are done after being replaced
+	queries *sync.WaitGroup
+
+	// refreshing tracks the cache keys being refreshed in the background
+	mutex      sync.Mutex
+	refreshing map[CacheKey]bool
 }
 
 // NewHandler creates a new Handler
 func NewHandler(provider Provider, options *HandlerOptions) *Handler {
-	return &Handler{options, provider}
+	if options == nil {
+		options = &HandlerOptions{}
+	}
+
+	return &Handler{
+		options:    options,
+		provider:   provider,
+		queries:    &sync.WaitGroup{},
+		refreshing: make(map[CacheKey]bool),
+	}
+}
+
+// SetProvider replaces the provider used to answer queries; queries already
+// sent to the previous provider are unaffected. Once they are done, the
+// previous provider is closed, if it implements io.Closer.
+func (h *Handler) SetProvider(provider Provider) {
+	h.providerMutex.Lock()
+	previous, queries := h.provider, h.queries
+	h.provider, h.queries = provider, &sync.WaitGroup{}
+	h.providerMutex.Unlock()
+
+	if previous == provider {
+		return
+	}
+
+	go func() {
+		queries.Wait()
+		if err := closeProvider(previous); err != nil {
+			log.Errorf("unable to close provider %v: %v", providerName(previous), err)
+		}
+	}()
+}
+
+// Provider returns the provider used to answer queries
+func (h *Handler) Provider() Provider {
+	h.providerMutex.RLock()
+	defer h.providerMutex.RUnlock()
+
+	return h.provider
+}
+
+// acquire returns the provider used to answer queries, along with a function
+// to be called once a query to it is done
+func (h *Handler) acquire() (Provider, func()) {
+	h.providerMutex.RLock()
+	defer h.providerMutex.RUnlock()
+
+	h.queries.Add(1)
+	return h.provider, h.queries.Done
 }
 
 // Handle handles a DNS request
 func (h *Handler) Handle(w dns.ResponseWriter, r *dns.Msg) {
+	info := &queryInfo{}
+	if h.options.QueryLog == nil && h.options.Dnstap == nil {
+		h.handle(w, r, info)
+		return
+	}
+
+	start := time.Now()
+	if h.options.Dnstap != nil {
+		h.options.Dnstap.clientQuery(w, r, start)
+	}
+
+	rw := &recordingResponseWriter{ResponseWriter: w}
+	h.handle(rw, r, info)
+
+	if h.options.Dnstap != nil && rw.msg != nil {
+		h.options.Dnstap.clientResponse(w, rw.msg, start, time.Now())
+	}
+	if h.options.QueryLog == nil {
+		return
+	}
+
+	entry := h.options.QueryLog.entry(w, r, rw.msg, info, time.Since(start))
+	if err := h.options.QueryLog.Log(entry); err != nil {
+		log.Errorln("unable to write query log:", err)
+	}
+}
+
+// HandleTLS handles a DNS request received over TLS, as by a dns.Server with
+// the "tcp-tls" network
+func (h *Handler) HandleTLS(w dns.ResponseWriter, r *dns.Msg) {
+	h.Handle(&tlsResponseWriter{w}, r)
+}
+
+// handle answers a DNS request, recording how it was answered in info
+func (h *Handler) handle(w dns.ResponseWriter, r *dns.Msg, info *queryInfo) {
+	if r.Opcode != dns.OpcodeQuery {
+		h.fail(w, r, dns.RcodeNotImplemented)
+		return
+	}
+	// in practice, no server supports more than a single question
+	if len(r.Question) != 1 {
+		h.fail(w, r, dns.RcodeFormatError)
+		return
+	}
+
+	opt := r.IsEdns0()
+	if opt != nil && opt.Version() != 0 {
+		h.fail(w, r, dns.RcodeBadVers)
+		return
+	}
+
 	q := DNSQuestion{
-		Name: r.Question[0].Name,
-		Type: r.Question[0].Qtype,
+		Name:             r.Question[0].Name,
+		Type:             r.Question[0].Qtype,
+		DNSSECOK:         opt != nil && opt.Do(),
+		CheckingDisabled: r.CheckingDisabled,
+	}
+
+	if h.options.LocalRecords != nil {
+		if dnsResp, target, ok := h.options.LocalRecords.answer(q); ok {
+			log.Debugln("local", q.Name, dns.TypeToString[q.Type])
+			info.local = true
+			if target != "" {
+				info.upstream = h.resolveTarget(dnsResp, q, target)
+			}
+			h.respond(w, r, dnsResp)
+			return
+		}
+	}
+
+	if h.options.Blocklist != nil {
+		if rule := h.options.Blocklist.match(q.Name); rule != nil {
+			info.rule = rule
+			if !rule.allow {
+				log.Debugln("blocked", q.Name, dns.TypeToString[q.Type], "by", rule.text)
+				h.respond(w, r, h.options.Blocklist.answer(q))
+				return
+			}
+		}
 	}
-	log.Infoln("requesting", q.Name, dns.TypeToString[q.Type])
 
-	dnsResp, err := h.provider.Query(q)
+	key := NewCacheKey(r.Question[0])
+	key.DNSSECOK = q.DNSSECOK
+	key.CheckingDisabled = q.CheckingDisabled
+
+	if h.options.ClientSubnets != nil {
+		if ip := remoteIP(w.RemoteAddr()); ip != nil {
+			q.ClientSubnet = h.options.ClientSubnets.Subnet(ip)
+			key.ClientSubnet = q.ClientSubnet.String()
+		}
+	}
+
+	if h.options.Cache != nil {
+		if dnsResp, ok := h.options.Cache.Get(key); ok {
+			log.Debugln("cache hit", q.Name, dns.TypeToString[q.Type])
+			info.cache = cacheHit
+			if h.options.Cache.ShouldPrefetch(key) {
+				log.Debugln("prefetching", q.Name, dns.TypeToString[q.Type])
+				go h.refresh(key, q, false)
+			}
+
+			h.respond(w, r, dnsResp)
+			return
+		}
+	}
+
+	info.cache = cacheMiss
+	dnsResp, upstream, err := h.query(q)
+	info.upstream = upstream
+	if err != nil || dnsResp.ResponseCode == dns.RcodeServerFailure {
+		if err != nil {
+			log.Errorln("provider failed", err)
+		}
+
+		if stale, ok := h.stale(key, q); ok {
+			info.cache = cacheStale
+			info.upstream = ""
+			h.respond(w, r, stale)
+			return
+		}
+
+		if err != nil {
+			h.fail(w, r, dns.RcodeServerFailure)
+			return
+		}
+	}
+
+	if h.options.Cache != nil {
+		h.options.Cache.Set(key, dnsResp)
+	}
+
+	h.respond(w, r, dnsResp)
+}
+
+// query sends a question to the provider, checking that the response is for
+// the question which was asked. The name of the upstream which answered is
+// returned along with the response.
+func (h *Handler) query(q DNSQuestion) (*DNSResponse, string, error) {
+	provider, done := h.acquire()
+	defer done()
+	upstream := providerName(provider)
+
+	start := time.Now()
+	if h.options.Dnstap != nil {
+		h.options.Dnstap.forwarderQuery(q, start)
+	}
+
+	resp, err := provider.Query(q)
+	if err != nil {
+		return nil, upstream, err
+	}
+	if h.options.Dnstap != nil {
+		h.options.Dnstap.forwarderResponse(q, resp, start, time.Now())
+	}
+	if resp.Upstream != "" {
+		upstream = resp.Upstream
+	}
+
+	// the question may be omitted from the response, e.g. by some JSON APIs
+	if len(resp.Question) > 0 {
+		rq := resp.Question[0]
+		if len(resp.Question) != 1 || rq.Type != q.Type ||
+			!strings.EqualFold(dns.Fqdn(rq.Name), dns.Fqdn(q.Name)) {
+			errorsTotal.inc(errorQuestionMismatch)
+			return nil, upstream, ErrQuestionMismatch
+		}
+	}
+
+	if h.options.Rebinding != nil {
+		resp = h.options.Rebinding.filter(q.Name, resp)
+	}
+
+	return resp, upstream, nil
+}
+
+// resolveTarget completes a local answer whose CNAME records lead to a name
+// which is not local, appending the provider's answer for the target name.
+// The name of the upstream which answered is returned.
+func (h *Handler) resolveTarget(resp *DNSResponse, q DNSQuestion, target string) string {
+	q.Name = target
+	tresp, upstream, err := h.query(q)
 	if err != nil {
 		log.Errorln("provider failed", err)
-		dns.HandleFailed(w, r)
+		resp.ResponseCode = dns.RcodeServerFailure
+		return upstream
+	}
+
+	resp.ResponseCode = tresp.ResponseCode
+	resp.Answer = append(resp.Answer, tresp.Answer...)
+	resp.Authority = tresp.Authority
+
+	return upstream
+}
+
+// fail writes a response with the given response code, and no records
+func (h *Handler) fail(w dns.ResponseWriter, r *dns.Msg, rcode int) {
+	resp := new(dns.Msg)
+	resp.SetRcode(r, rcode)
+	if r.IsEdns0() != nil {
+		resp.SetEdns0(dns.DefaultMsgSize, false)
+	}
+
+	observeResponse(r, rcode)
+	if err := w.WriteMsg(resp); err != nil {
+		errorsTotal.inc(errorWrite)
+		log.Errorln("Error writing DNS response:", err)
+	}
+}
+
+// stale retrieves a stale response from the cache, if there is one; when
+// found, a refresh of the response is started in the background.
+func (h *Handler) stale(key CacheKey, q DNSQuestion) (*DNSResponse, bool) {
+	if h.options.Cache == nil {
+		return nil, false
+	}
+
+	resp, ok := h.options.Cache.GetStale(key)
+	if !ok {
+		return nil, false
+	}
+
+	log.Infoln("serving stale", q.Name, dns.TypeToString[q.Type])
+	go h.refresh(key, q, true)
+
+	return resp, true
+}
+
+// refresh queries the provider for a question, storing the response in the
+// cache. If retry is true, the query is retried until it succeeds, giving up
+// once the cached response can no longer be served stale. Only one refresh
+// runs for a given key at a time.
+func (h *Handler) refresh(key CacheKey, q DNSQuestion, retry bool) {
+	h.mutex.Lock()
+	if h.refreshing[key] {
+		h.mutex.Unlock()
 		return
 	}
+	h.refreshing[key] = true
+	h.mutex.Unlock()
+
+	defer func() {
+		h.mutex.Lock()
+		delete(h.refreshing, key)
+		h.mutex.Unlock()
+	}()
+
+	for {
+		resp, _, err := h.query(q)
+		if err == nil && resp.ResponseCode != dns.RcodeServerFailure {
+			h.options.Cache.Set(key, resp)
+			return
+		}
+		if !retry {
+			return
+		}
+
+		time.Sleep(staleRefreshInterval)
+
+		// stop if the response was refreshed elsewhere, or may not be served
+		// stale any longer
+		if _, ok := h.options.Cache.GetStale(key); !ok {
+			return
+		}
+	}
+}
 
-	questions := []dns.Question{}
-	for idx, c := range dnsResp.Question {
-		questions = append(questions, dns.Question{
-			Name:   c.Name,
-			Qtype:  c.Type,
-			Qclass: r.Question[idx].Qclass,
-		})
-	}
-
-	// Parse google RRs to DNS RRs
-	answers := transformRR(dnsResp.Answer, "answer")
-	authorities := transformRR(dnsResp.Authority, "authority")
-	extras := transformRR(dnsResp.Extra, "extra")
-
-	resp := dns.Msg{
-		MsgHdr: dns.MsgHdr{
-			Id:                 r.Id,
-			Response:           (dnsResp.ResponseCode == 0),
-			Opcode:             dns.OpcodeQuery,
-			Authoritative:      false,
-			Truncated:          dnsResp.Truncated,
-			RecursionDesired:   dnsResp.RecursionDesired,
-			RecursionAvailable: dnsResp.RecursionAvailable,
-			AuthenticatedData:  dnsResp.AuthenticatedData,
-			CheckingDisabled:   dnsResp.CheckingDisabled,
-			Rcode:              dnsResp.ResponseCode,
-		},
-		Compress: r.Compress,
-		Question: questions,
-		Answer:   answers,
-		Ns:       authorities,
-		Extra:    extras,
+// respond writes a DNSResponse to the client, as the answer to its request.
+// The question is echoed from the request, which must have exactly one.
+func (h *Handler) respond(w dns.ResponseWriter, r *dns.Msg, dnsResp *DNSResponse) {
+	resp := newResponseMsg(r, dnsResp)
+
+	// echo an OPT record to EDNS clients, who may receive larger responses
+	size := dns.MinMsgSize
+	if opt := r.IsEdns0(); opt != nil {
+		resp.SetEdns0(dns.DefaultMsgSize, opt.Do())
+		if s := int(opt.UDPSize()); s > size {
+			size = s
+		}
 	}
 
+	// only UDP responses are limited in size; others are only limited by the
+	// maximum size of a message
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); !ok {
+		size = dns.MaxMsgSize
+	}
+	truncateMsg(resp, size)
+
 	// Write the response
-	err = w.WriteMsg(&resp)
-	if err != nil {
+	observeResponse(r, resp.Rcode)
+	if err := w.WriteMsg(resp); err != nil {
+		errorsTotal.inc(errorWrite)
 		log.Errorln("Error writing DNS response:", err)
 	}
 }
 
+// remoteIP returns the IP address of a client, if it has one
+func remoteIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	}
+
+	return nil
+}
+
 // for a given []DNSRR, transform to dns.RR, logging if any errors occur
 func transformRR(rrs []DNSRR, logType string) []dns.RR {
 	var t []dns.RR
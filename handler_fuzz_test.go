@@ -0,0 +1,52 @@
+//go:build go1.18
+// +build go1.18
+
+package secureoperator
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func FuzzHandle(f *testing.F) {
+	seeds := []*dns.Msg{
+		new(dns.Msg).SetQuestion("example.com.", dns.TypeA),
+		new(dns.Msg).SetNotify("example.com."),
+		new(dns.Msg),
+	}
+	for _, m := range seeds {
+		buf, err := m.Pack()
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(buf)
+	}
+
+	p := &mockProvider{name: "mock", resp: testResponse("example.com.", 300)}
+	h := NewHandler(p, &HandlerOptions{Cache: NewResponseCache(nil)})
+
+	f.Fuzz(func(t *testing.T, buf []byte) {
+		req := new(dns.Msg)
+		if err := req.Unpack(buf); err != nil {
+			return
+		}
+
+		w := &testResponseWriter{}
+		h.Handle(w, req)
+
+		if len(w.msgs) != 1 {
+			t.Fatalf("expected a single response, got %v", len(w.msgs))
+		}
+		resp := w.msgs[0]
+		if resp.Id != req.Id {
+			t.Errorf("unexpected ID %v", resp.Id)
+		}
+		if len(resp.Question) > 1 {
+			t.Errorf("unexpected questions %v", resp.Question)
+		}
+		if _, err := resp.Pack(); err != nil {
+			t.Errorf("unable to pack response: %v", err)
+		}
+	})
+}
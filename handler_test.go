@@ -0,0 +1,449 @@
+package secureoperator
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// testResponseWriter is a dns.ResponseWriter which records the messages
+// written to it
+type testResponseWriter struct {
+	remote net.Addr
+	msgs   []*dns.Msg
+}
+
+func (w *testResponseWriter) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 53}
+}
+
+func (w *testResponseWriter) RemoteAddr() net.Addr {
+	if w.remote != nil {
+		return w.remote
+	}
+	return &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 40000}
+}
+
+func (w *testResponseWriter) WriteMsg(m *dns.Msg) error {
+	w.msgs = append(w.msgs, m)
+	return nil
+}
+
+func (w *testResponseWriter) Write(b []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return 0, err
+	}
+	return len(b), w.WriteMsg(m)
+}
+
+func (w *testResponseWriter) Close() error        { return nil }
+func (w *testResponseWriter) TsigStatus() error   { return nil }
+func (w *testResponseWriter) TsigTimersOnly(bool) {}
+func (w *testResponseWriter) Hijack()             {}
+
+func TestHandlerCache(t *testing.T) {
+	p := &mockProvider{name: "mock", resp: testResponse("example.com.", 300)}
+	h := NewHandler(p, &HandlerOptions{Cache: NewResponseCache(nil)})
+
+	for i := 0; i < 3; i++ {
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+
+		w := &testResponseWriter{}
+		h.Handle(w, req)
+
+		if len(w.msgs) != 1 {
+			t.Fatalf("%v: expected a response to be written", i)
+		}
+		resp := w.msgs[0]
+		if resp.Id != req.Id {
+			t.Errorf("%v: unexpected ID %v", i, resp.Id)
+		}
+		if len(resp.Answer) != 1 {
+			t.Errorf("%v: unexpected answer %v", i, resp.Answer)
+		}
+	}
+
+	if c := p.Calls(); c != 1 {
+		t.Errorf("expected a single provider call, got %v", c)
+	}
+}
+
+func TestHandlerServeStale(t *testing.T) {
+	interval := staleRefreshInterval
+	staleRefreshInterval = 10 * time.Millisecond
+	defer func() { staleRefreshInterval = interval }()
+
+	c, advance := newTestCache(&CacheOptions{StaleWindow: time.Hour})
+	p := &mockProvider{name: "mock", resp: testResponse("example.com.", 300)}
+	h := NewHandler(p, &HandlerOptions{Cache: c})
+
+	query := func() *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+
+		w := &testResponseWriter{}
+		h.Handle(w, req)
+
+		if len(w.msgs) != 1 {
+			t.Fatal("expected a response to be written")
+		}
+		return w.msgs[0]
+	}
+
+	query()
+	advance(10 * time.Minute)
+	p.Set(nil, errMockProvider)
+
+	resp := query()
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 1 {
+		t.Fatalf("expected a stale answer, got %v", resp)
+	}
+	if ttl := resp.Answer[0].Header().Ttl; ttl != 30 {
+		t.Errorf("expected stale TTL of 30, got %v", ttl)
+	}
+
+	// the refresh retries in the background until the provider recovers
+	fresh := testResponse("example.com.", 600)
+	time.Sleep(30 * time.Millisecond)
+	p.Set(fresh, nil)
+
+	for i := 0; i < 100; i++ {
+		if _, ok := c.Get(testKey("example.com.")); ok {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	resp = query()
+	if ttl := resp.Answer[0].Header().Ttl; ttl != 600 {
+		t.Errorf("expected refreshed TTL of 600, got %v", ttl)
+	}
+	if c := p.Calls(); c < 4 {
+		t.Errorf("expected refresh to be retried, got %v calls", c)
+	}
+}
+
+func TestHandlerFailedWithoutStale(t *testing.T) {
+	p := &mockProvider{name: "mock", err: errMockProvider}
+	h := NewHandler(p, &HandlerOptions{Cache: NewResponseCache(nil)})
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+
+	w := &testResponseWriter{}
+	h.Handle(w, req)
+
+	if len(w.msgs) != 1 {
+		t.Fatal("expected a response to be written")
+	}
+	if rc := w.msgs[0].Rcode; rc != dns.RcodeServerFailure {
+		t.Errorf("expected SERVFAIL, got %v", dns.RcodeToString[rc])
+	}
+}
+
+func TestHandlerPrefetch(t *testing.T) {
+	c, advance := newTestCache(&CacheOptions{
+		PrefetchThreshold: 0.5,
+		PrefetchHits:      1,
+	})
+	p := &mockProvider{name: "mock", resp: testResponse("example.com.", 100)}
+	h := NewHandler(p, &HandlerOptions{Cache: c})
+
+	for i := 0; i < 3; i++ {
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		h.Handle(&testResponseWriter{}, req)
+	}
+	if calls := p.Calls(); calls != 1 {
+		t.Fatalf("expected a single provider call, got %v", calls)
+	}
+
+	advance(60 * time.Second)
+	p.Set(testResponse("example.com.", 300), nil)
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	w := &testResponseWriter{}
+	h.Handle(w, req)
+
+	// the cached response is served, while the prefetch happens in the
+	// background
+	if ttl := w.msgs[0].Answer[0].Header().Ttl; ttl != 40 {
+		t.Errorf("expected cached TTL of 40, got %v", ttl)
+	}
+
+	for i := 0; i < 100 && p.Calls() < 2; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	for i := 0; i < 100; i++ {
+		if resp, ok := c.Get(testKey("example.com.")); ok && resp.Answer[0].TTL == 300 {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Error("expected response to be prefetched")
+}
+
+func TestHandlerMalformed(t *testing.T) {
+	p := &mockProvider{name: "mock", resp: testResponse("example.com.", 300)}
+	h := NewHandler(p, nil)
+
+	empty := new(dns.Msg)
+	empty.Id = 1
+
+	multiple := new(dns.Msg)
+	multiple.SetQuestion("example.com.", dns.TypeA)
+	multiple.Question = append(multiple.Question, dns.Question{
+		Name: "example.org.", Qtype: dns.TypeA, Qclass: dns.ClassINET,
+	})
+
+	notify := new(dns.Msg)
+	notify.SetNotify("example.com.")
+
+	tests := []struct {
+		name  string
+		req   *dns.Msg
+		rcode int
+	}{
+		{"no question", empty, dns.RcodeFormatError},
+		{"multiple questions", multiple, dns.RcodeFormatError},
+		{"notify opcode", notify, dns.RcodeNotImplemented},
+	}
+
+	for _, test := range tests {
+		w := &testResponseWriter{}
+		h.Handle(w, test.req)
+
+		if len(w.msgs) != 1 {
+			t.Errorf("%v: expected a response to be written", test.name)
+			continue
+		}
+		resp := w.msgs[0]
+		if resp.Rcode != test.rcode {
+			t.Errorf("%v: expected %v, got %v", test.name,
+				dns.RcodeToString[test.rcode], dns.RcodeToString[resp.Rcode])
+		}
+		if resp.Id != test.req.Id || !resp.Response {
+			t.Errorf("%v: unexpected header %v", test.name, resp.MsgHdr)
+		}
+	}
+
+	if c := p.Calls(); c != 0 {
+		t.Errorf("expected no provider calls, got %v", c)
+	}
+}
+
+func TestHandlerQuestionMismatch(t *testing.T) {
+	p := &mockProvider{name: "mock", resp: testResponse("example.org.", 300)}
+	h := NewHandler(p, &HandlerOptions{Cache: NewResponseCache(nil)})
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+
+	w := &testResponseWriter{}
+	h.Handle(w, req)
+
+	if len(w.msgs) != 1 {
+		t.Fatal("expected a response to be written")
+	}
+	if rc := w.msgs[0].Rcode; rc != dns.RcodeServerFailure {
+		t.Errorf("expected SERVFAIL, got %v", dns.RcodeToString[rc])
+	}
+	if n := h.options.Cache.Len(); n != 0 {
+		t.Errorf("expected mismatched response not to be cached, got %v", n)
+	}
+
+	// the name is compared case-insensitively, and the client's case is echoed
+	p.Set(testResponse("example.com.", 300), nil)
+	req.SetQuestion("ExAmPlE.CoM.", dns.TypeA)
+
+	w = &testResponseWriter{}
+	h.Handle(w, req)
+
+	resp := w.msgs[0]
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 1 {
+		t.Errorf("unexpected response %v", resp)
+	}
+	if n := resp.Question[0].Name; n != "ExAmPlE.CoM." {
+		t.Errorf("expected question to be echoed, got %v", n)
+	}
+}
+
+// questionProvider is a Provider which records the last question it was asked
+type questionProvider struct {
+	resp *DNSResponse
+	last DNSQuestion
+}
+
+func (p *questionProvider) Query(q DNSQuestion) (*DNSResponse, error) {
+	p.last = q
+	return p.resp, nil
+}
+
+func TestHandlerEDNS(t *testing.T) {
+	// enough records to exceed 512 bytes
+	ttls := make([]uint32, 40)
+	for i := range ttls {
+		ttls[i] = 300
+	}
+	p := &questionProvider{resp: testResponse("example.com.", ttls...)}
+	h := NewHandler(p, nil)
+
+	tests := []struct {
+		name      string
+		remote    net.Addr
+		edns      bool
+		size      uint16
+		truncated bool
+	}{
+		{"udp without edns", nil, false, 0, true},
+		{"udp with small buffer", nil, true, 512, true},
+		{"udp with large buffer", nil, true, 4096, false},
+		{"tcp without edns", &net.TCPAddr{IP: net.ParseIP("127.0.0.1")}, false, 0, false},
+	}
+
+	for _, test := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		if test.edns {
+			req.SetEdns0(test.size, true)
+		}
+
+		w := &testResponseWriter{remote: test.remote}
+		h.Handle(w, req)
+
+		resp := w.msgs[0]
+		if resp.Truncated != test.truncated {
+			t.Errorf("%v: expected truncated %v", test.name, test.truncated)
+		}
+		if test.truncated && len(resp.Answer) != 0 {
+			t.Errorf("%v: expected no answers in truncated response", test.name)
+		}
+		if !test.truncated && len(resp.Answer) != len(ttls) {
+			t.Errorf("%v: expected full answer, got %v", test.name, len(resp.Answer))
+		}
+
+		opt := resp.IsEdns0()
+		if test.edns != (opt != nil) {
+			t.Errorf("%v: expected OPT record %v, got %v", test.name, test.edns, opt)
+		}
+		if opt != nil && !opt.Do() {
+			t.Errorf("%v: expected DO bit to be echoed", test.name)
+		}
+		if p.last.DNSSECOK != test.edns {
+			t.Errorf("%v: expected DO bit %v to be forwarded", test.name, test.edns)
+		}
+	}
+}
+
+func TestHandlerEDNSVersion(t *testing.T) {
+	p := &questionProvider{resp: testResponse("example.com.", 300)}
+	h := NewHandler(p, nil)
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	req.SetEdns0(4096, false)
+	req.IsEdns0().SetVersion(1)
+
+	w := &testResponseWriter{}
+	h.Handle(w, req)
+
+	resp := w.msgs[0]
+	if resp.Rcode != dns.RcodeBadVers {
+		t.Errorf("expected BADVERS, got %v", dns.RcodeToString[resp.Rcode])
+	}
+	if resp.IsEdns0() == nil {
+		t.Error("expected an OPT record")
+	}
+	if _, err := resp.Pack(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHandlerClientSubnet(t *testing.T) {
+	p := &questionProvider{resp: testResponse("example.com.", 300)}
+	subnets, err := NewClientSubnets(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewHandler(p, &HandlerOptions{
+		Cache:         NewResponseCache(nil),
+		ClientSubnets: subnets,
+	})
+
+	for _, client := range []string{"192.0.2.1", "192.0.2.2", "198.51.100.1"} {
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+
+		w := &testResponseWriter{
+			remote: &net.UDPAddr{IP: net.ParseIP(client), Port: 40000},
+		}
+		h.Handle(w, req)
+	}
+
+	if s := p.last.ClientSubnet.String(); s != "198.51.100.0/24" {
+		t.Errorf("unexpected client subnet %v", s)
+	}
+
+	// responses are cached per subnet
+	if n := h.options.Cache.Len(); n != 2 {
+		t.Errorf("expected 2 cached responses, got %v", n)
+	}
+}
+
+func TestHandlerSetProvider(t *testing.T) {
+	first := &mockProvider{name: "first", resp: testResponse("example.com.", 300)}
+	second := &mockProvider{name: "second", resp: testResponse("example.com.", 300)}
+	h := NewHandler(first, nil)
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+
+	h.Handle(&testResponseWriter{}, req)
+	h.SetProvider(second)
+	h.Handle(&testResponseWriter{}, req)
+
+	if first.Calls() != 1 || second.Calls() != 1 {
+		t.Errorf("expected one call to each provider, got %v and %v",
+			first.Calls(), second.Calls())
+	}
+}
+
+func TestHandlerSetProviderCloses(t *testing.T) {
+	first := &mockProvider{name: "first", delay: 100 * time.Millisecond, resp: testResponse("example.com.", 300)}
+	second := &mockProvider{name: "second", resp: testResponse("example.com.", 300)}
+	h := NewHandler(first, nil)
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+
+	done := make(chan struct{})
+	go func() {
+		h.Handle(&testResponseWriter{}, req)
+		close(done)
+	}()
+	for first.Calls() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// the previous provider must not be closed while answering a query
+	h.SetProvider(second)
+	if first.Closed() != 0 {
+		t.Error("expected the previous provider not to be closed during a query")
+	}
+
+	<-done
+	for i := 0; first.Closed() == 0 && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if first.Closed() != 1 {
+		t.Errorf("expected the previous provider to be closed once, got %v", first.Closed())
+	}
+	if second.Closed() != 0 {
+		t.Error("expected the current provider not to be closed")
+	}
+}
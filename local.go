@@ -0,0 +1,244 @@
+package secureoperator
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+// DefaultLocalTTL is the TTL of local records, unless otherwise specified
+const DefaultLocalTTL = 5 * time.Minute
+
+// the maximum number of local CNAME records followed to answer a question
+const maxLocalCNAMEs = 8
+
+// types of record which may be given as local records
+var localRecordTypes = map[uint16]bool{
+	dns.TypeA:     true,
+	dns.TypeAAAA:  true,
+	dns.TypeCNAME: true,
+	dns.TypeTXT:   true,
+	dns.TypePTR:   true,
+	dns.TypeSRV:   true,
+}
+
+// LocalRecordsOptions is a configuration object for optional LocalRecords
+// configuration
+type LocalRecordsOptions struct {
+	// HostsFiles are the paths of files in the format of /etc/hosts; each line
+	// is an address, followed by the names which have it.
+	HostsFiles []string
+	// Records are records in the presentation format of a zone file, e.g.
+	// "printer.lan. IN A 192.168.1.5"; A, AAAA, CNAME, TXT, PTR and SRV
+	// records are supported.
+	Records []string
+	// TTL is the TTL of records from hosts files, and of records given without
+	// a TTL. If not provided, DefaultLocalTTL is used.
+	TTL time.Duration
+}
+
+// NewLocalRecords creates LocalRecords, loading its hosts files
+func NewLocalRecords(opts *LocalRecordsOptions) (*LocalRecords, error) {
+	if opts == nil {
+		opts = &LocalRecordsOptions{}
+	}
+	if opts.TTL == 0 {
+		opts.TTL = DefaultLocalTTL
+	}
+
+	l := &LocalRecords{opts: opts}
+	if err := l.Reload(); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// LocalRecords answers questions for local names, such as those of machines
+// on a LAN, without querying the provider. PTR records are synthesized for the
+// addresses of A and AAAA records, unless given explicitly.
+type LocalRecords struct {
+	opts *LocalRecordsOptions
+
+	mutex   sync.RWMutex
+	records map[string][]dns.RR
+}
+
+// Reload reads the hosts files; if any can't be read, the records already
+// loaded are kept.
+func (l *LocalRecords) Reload() error {
+	var rrs []dns.RR
+	ttl := uint32(l.opts.TTL / time.Second)
+
+	for _, path := range l.opts.HostsFiles {
+		hosts, err := loadHostsFile(path, ttl)
+		if err != nil {
+			return err
+		}
+		rrs = append(rrs, hosts...)
+	}
+
+	// records given explicitly are parsed as a zone, with a default TTL
+	zone := fmt.Sprintf("$TTL %v\n%v\n", ttl, strings.Join(l.opts.Records, "\n"))
+	for t := range dns.ParseZone(strings.NewReader(zone), ".", "") {
+		if t.Error != nil {
+			return t.Error
+		}
+		h := t.RR.Header()
+		if !localRecordTypes[h.Rrtype] || h.Class != dns.ClassINET {
+			return fmt.Errorf("unsupported local record %v", t.RR)
+		}
+		// records without data are permitted by the parser, for updates
+		if t.RR.String() == h.String() {
+			return fmt.Errorf("incomplete local record %v", t.RR)
+		}
+		rrs = append(rrs, t.RR)
+	}
+
+	records := make(map[string][]dns.RR)
+	for _, rr := range rrs {
+		name := strings.ToLower(rr.Header().Name)
+		records[name] = append(records[name], rr)
+	}
+	synthesizePTRs(records, rrs)
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.records = records
+	log.Infof("loaded local records for %v names", len(records))
+
+	return nil
+}
+
+// answer creates the response to a question for a local name; ok is false if
+// the name is not local, and the question should be sent to the provider. A
+// local name without records of the question's type is answered with no
+// records. If its CNAME records lead to a name which is not local, that name
+// is returned as target, so that the answer may be completed by the provider.
+func (l *LocalRecords) answer(q DNSQuestion) (resp *DNSResponse, target string, ok bool) {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	name := strings.ToLower(dns.Fqdn(q.Name))
+	if _, ok := l.records[name]; !ok {
+		return nil, "", false
+	}
+
+	resp = &DNSResponse{
+		Question:           []DNSQuestion{q},
+		RecursionDesired:   true,
+		RecursionAvailable: true,
+		ResponseCode:       dns.RcodeSuccess,
+	}
+
+	// follow CNAME records, as long as their targets are local too
+	for i := 0; i < maxLocalCNAMEs; i++ {
+		var cname *dns.CNAME
+		for _, rr := range l.records[name] {
+			if rr.Header().Rrtype == q.Type {
+				resp.Answer = append(resp.Answer, NewDNSRR(rr))
+			} else if c, ok := rr.(*dns.CNAME); ok {
+				cname = c
+			}
+		}
+		if cname == nil || q.Type == dns.TypeCNAME || len(resp.Answer) > 0 {
+			break
+		}
+
+		resp.Answer = append(resp.Answer, NewDNSRR(cname))
+		name = strings.ToLower(cname.Target)
+		if _, ok := l.records[name]; !ok {
+			return resp, cname.Target, true
+		}
+	}
+
+	return resp, "", true
+}
+
+// loadHostsFile reads the records of a hosts file
+func loadHostsFile(path string, ttl uint32) ([]dns.RR, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rrs []dns.RR
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := s.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+
+		// addresses may have a zone, e.g. "fe80::1%lo0", which is ignored
+		ip := net.ParseIP(strings.SplitN(fields[0], "%", 2)[0])
+		if ip == nil {
+			continue
+		}
+
+		for _, name := range fields[1:] {
+			hdr := dns.RR_Header{Name: dns.Fqdn(name), Class: dns.ClassINET, Ttl: ttl}
+			if _, ok := dns.IsDomainName(hdr.Name); !ok {
+				continue
+			}
+
+			if ip4 := ip.To4(); ip4 != nil {
+				hdr.Rrtype = dns.TypeA
+				rrs = append(rrs, &dns.A{Hdr: hdr, A: ip4})
+			} else {
+				hdr.Rrtype = dns.TypeAAAA
+				rrs = append(rrs, &dns.AAAA{Hdr: hdr, AAAA: ip})
+			}
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+
+	return rrs, nil
+}
+
+// synthesizePTRs adds a PTR record for the address of each A and AAAA record,
+// to the first name with the address; addresses which already have a PTR
+// record are left as they are.
+func synthesizePTRs(records map[string][]dns.RR, rrs []dns.RR) {
+	for _, rr := range rrs {
+		var ip net.IP
+		switch t := rr.(type) {
+		case *dns.A:
+			ip = t.A
+		case *dns.AAAA:
+			ip = t.AAAA
+		default:
+			continue
+		}
+
+		reverse, err := dns.ReverseAddr(ip.String())
+		if err != nil {
+			continue
+		}
+		if _, ok := records[reverse]; ok {
+			continue
+		}
+
+		h := rr.Header()
+		records[reverse] = []dns.RR{&dns.PTR{
+			Hdr: dns.RR_Header{Name: reverse, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: h.Ttl},
+			Ptr: h.Name,
+		}}
+	}
+}
@@ -0,0 +1,182 @@
+package secureoperator
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+const testHosts = `# hosts file
+192.168.1.5 printer.lan printer # trailing comment
+192.168.1.6	nas.lan
+fe80::1%lo0 router.lan
+invalid	ignored.lan
+`
+
+func newTestLocalRecords(t *testing.T, records ...string) (*LocalRecords, func()) {
+	dir, err := ioutil.TempDir("", "secureoperator")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "hosts")
+	if err := ioutil.WriteFile(path, []byte(testHosts), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := NewLocalRecords(&LocalRecordsOptions{HostsFiles: []string{path}, Records: records})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return l, func() { os.RemoveAll(dir) }
+}
+
+func TestLocalRecords(t *testing.T) {
+	l, cleanup := newTestLocalRecords(t,
+		"www.lan. CNAME nas.lan.",
+		"ext.lan. CNAME example.com.",
+		"nas.lan. 60 TXT \"hello, world\"",
+		"_ipp._tcp.lan. SRV 0 0 631 printer.lan.",
+		"6.1.168.192.in-addr.arpa. PTR storage.lan.",
+	)
+	defer cleanup()
+
+	tests := []struct {
+		name    string
+		qtype   uint16
+		local   bool
+		answers []string
+	}{
+		{"printer.lan.", dns.TypeA, true, []string{"192.168.1.5"}},
+		{"PRINTER", dns.TypeA, true, []string{"192.168.1.5"}},
+		{"printer.lan.", dns.TypeAAAA, true, nil},
+		{"router.lan.", dns.TypeAAAA, true, []string{"fe80::1"}},
+		{"ignored.lan.", dns.TypeA, false, nil},
+		{"example.com.", dns.TypeA, false, nil},
+		{"nas.lan.", dns.TypeTXT, true, []string{`"hello, world"`}},
+		{"www.lan.", dns.TypeA, true, []string{"nas.lan.", "192.168.1.6"}},
+		{"www.lan.", dns.TypeCNAME, true, []string{"nas.lan."}},
+		{"ext.lan.", dns.TypeA, true, []string{"example.com."}},
+		{"_ipp._tcp.lan.", dns.TypeSRV, true, []string{"0 0 631 printer.lan."}},
+		{"5.1.168.192.in-addr.arpa.", dns.TypePTR, true, []string{"printer.lan."}},
+		{"6.1.168.192.in-addr.arpa.", dns.TypePTR, true, []string{"storage.lan."}},
+		{"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.e.f.ip6.arpa.", dns.TypePTR, true, []string{"router.lan."}},
+	}
+
+	for _, test := range tests {
+		resp, _, ok := l.answer(DNSQuestion{Name: test.name, Type: test.qtype})
+		if ok != test.local {
+			t.Errorf("%v: expected local to be %v", test.name, test.local)
+			continue
+		}
+		if !ok {
+			continue
+		}
+
+		if resp.ResponseCode != dns.RcodeSuccess || len(resp.Answer) != len(test.answers) {
+			t.Errorf("%v: expected answers %v, got %v", test.name, test.answers, resp.Answer)
+			continue
+		}
+		for i, a := range resp.Answer {
+			if a.Data != test.answers[i] {
+				t.Errorf("%v: expected answer %v, got %v", test.name, test.answers[i], a.Data)
+			}
+		}
+	}
+
+	if resp, _, _ := l.answer(DNSQuestion{Name: "nas.lan.", Type: dns.TypeTXT}); resp.Answer[0].TTL != 60 {
+		t.Errorf("expected the TTL of the record, got %v", resp.Answer[0].TTL)
+	}
+	if resp, _, _ := l.answer(DNSQuestion{Name: "nas.lan.", Type: dns.TypeA}); resp.Answer[0].TTL != 300 {
+		t.Errorf("expected the default TTL, got %v", resp.Answer[0].TTL)
+	}
+	if _, target, _ := l.answer(DNSQuestion{Name: "ext.lan.", Type: dns.TypeA}); target != "example.com." {
+		t.Errorf("expected the target example.com., got %q", target)
+	}
+	if _, target, _ := l.answer(DNSQuestion{Name: "www.lan.", Type: dns.TypeA}); target != "" {
+		t.Errorf("expected no target, got %q", target)
+	}
+}
+
+func TestLocalRecordsErrors(t *testing.T) {
+	tests := []*LocalRecordsOptions{
+		{HostsFiles: []string{"/nonexistent/hosts"}},
+		{Records: []string{"printer.lan. A"}},
+		{Records: []string{"lan. MX 10 mail.lan."}},
+		{Records: []string{"printer.lan. CH A 192.168.1.5"}},
+	}
+
+	for _, opts := range tests {
+		if _, err := NewLocalRecords(opts); err == nil {
+			t.Errorf("expected an error for %+v", opts)
+		}
+	}
+}
+
+func TestHandlerLocalRecords(t *testing.T) {
+	l, cleanup := newTestLocalRecords(t)
+	defer cleanup()
+	b, cleanup := newTestBlocklist(t, &BlocklistOptions{})
+	defer cleanup()
+
+	var buf bytes.Buffer
+	ql, err := NewQueryLog(&buf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &mockProvider{name: "mock", err: errMockProvider}
+	h := NewHandler(p, &HandlerOptions{LocalRecords: l, Blocklist: b, QueryLog: ql})
+
+	req := new(dns.Msg)
+	req.SetQuestion("printer.lan.", dns.TypeA)
+
+	w := &testResponseWriter{}
+	h.Handle(w, req)
+
+	if p.Calls() != 0 {
+		t.Error("expected the provider not to be queried")
+	}
+	resp := w.msgs[0]
+	if a, ok := firstRR(resp.Answer).(*dns.A); !ok || a.A.String() != "192.168.1.5" {
+		t.Errorf("unexpected answer %v", resp.Answer)
+	}
+
+	entries := queryLogEntries(t, &buf)
+	if len(entries) != 1 || !entries[0].Local || entries[0].Cache != "" {
+		t.Errorf("expected a local entry, got %+v", entries)
+	}
+}
+
+func TestHandlerLocalCNAMEExternal(t *testing.T) {
+	l, cleanup := newTestLocalRecords(t, "alias.lan. CNAME example.com.")
+	defer cleanup()
+
+	p := &mockProvider{name: "mock", resp: testResponse("example.com.", 300)}
+	h := NewHandler(p, &HandlerOptions{LocalRecords: l})
+
+	req := new(dns.Msg)
+	req.SetQuestion("alias.lan.", dns.TypeA)
+
+	w := &testResponseWriter{}
+	h.Handle(w, req)
+
+	if p.Calls() != 1 {
+		t.Errorf("expected the provider to be queried once, got %v", p.Calls())
+	}
+	resp := w.msgs[0]
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 2 {
+		t.Fatalf("unexpected response %v", resp)
+	}
+	if c, ok := resp.Answer[0].(*dns.CNAME); !ok || c.Target != "example.com." {
+		t.Errorf("expected the local CNAME first, got %v", resp.Answer[0])
+	}
+	if a, ok := resp.Answer[1].(*dns.A); !ok || a.Hdr.Name != "example.com." {
+		t.Errorf("expected the address of the target, got %v", resp.Answer[1])
+	}
+}
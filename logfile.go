@@ -0,0 +1,137 @@
+package secureoperator
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+const defaultLogFileBackups = 5
+
+// LogFileOptions is a configuration object for optional LogFile configuration
+type LogFileOptions struct {
+	// MaxSize is the size, in bytes, the file may grow to before it is
+	// rotated. If not provided, the file is not rotated by size.
+	MaxSize int64
+	// MaxAge is the time after which the file is rotated. If not provided,
+	// the file is not rotated by age.
+	MaxAge time.Duration
+	// MaxBackups is the number of rotated files kept, which are named with the
+	// suffixes ".1", ".2" and so on, from newest to oldest. If not provided, a
+	// default of 5 is used.
+	MaxBackups int
+}
+
+// NewLogFile opens a LogFile, appending to the file at path if it exists
+func NewLogFile(path string, opts *LogFileOptions) (*LogFile, error) {
+	if opts == nil {
+		opts = &LogFileOptions{}
+	}
+	if opts.MaxBackups == 0 {
+		opts.MaxBackups = defaultLogFileBackups
+	}
+
+	f := &LogFile{path: path, opts: opts, now: time.Now}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// LogFile is an io.WriteCloser which writes to a file, rotating it once it
+// reaches a maximum size or age.
+type LogFile struct {
+	path string
+	opts *LogFileOptions
+	now  func() time.Time
+
+	mutex   sync.Mutex
+	file    *os.File
+	size    int64
+	created time.Time
+}
+
+// Write writes to the file, first rotating it if the write would take it
+// past its maximum size, or it has reached its maximum age. Writes are never
+// split across files.
+func (f *LogFile) Write(p []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+
+	full := f.opts.MaxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.opts.MaxSize
+	old := f.opts.MaxAge > 0 && f.now().Sub(f.created) >= f.opts.MaxAge
+	if full || old {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+
+	return n, err
+}
+
+// Close closes the file
+func (f *LogFile) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.file == nil {
+		return nil
+	}
+
+	err := f.file.Close()
+	f.file = nil
+
+	return err
+}
+
+func (f *LogFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	f.file = file
+	f.size = info.Size()
+	f.created = f.now()
+
+	return nil
+}
+
+// rotate shifts each rotated file to the next suffix, dropping the oldest,
+// and starts a new file; the caller must hold the mutex.
+func (f *LogFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	f.file = nil
+
+	for i := f.opts.MaxBackups - 1; i > 0; i-- {
+		err := os.Rename(f.backup(i), f.backup(i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(f.path, f.backup(1)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return f.open()
+}
+
+func (f *LogFile) backup(n int) string {
+	return fmt.Sprintf("%v.%v", f.path, n)
+}
@@ -0,0 +1,81 @@
+package secureoperator
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLogFileRotateSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secureoperator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "queries.log")
+	f, err := NewLogFile(path, &LogFileOptions{MaxSize: 10, MaxBackups: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := map[string]string{
+		path:        "fourth\n",
+		path + ".1": "third\n",
+		path + ".2": "second\n",
+	}
+	for p, content := range expected {
+		buf, err := ioutil.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != content {
+			t.Errorf("%v: expected %q, got %q", p, content, buf)
+		}
+	}
+
+	// the oldest file is dropped
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("expected only 2 backups to be kept")
+	}
+}
+
+func TestLogFileRotateAge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secureoperator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "queries.log")
+	f, err := NewLogFile(path, &LogFileOptions{MaxAge: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	now := time.Now()
+	f.now = func() time.Time { return now }
+
+	f.Write([]byte("first\n"))
+	f.Write([]byte("second\n"))
+	now = now.Add(2 * time.Hour)
+	f.Write([]byte("third\n"))
+
+	buf, err := ioutil.ReadFile(path + ".1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "first\nsecond\n" {
+		t.Errorf("unexpected rotated content %q", buf)
+	}
+}
@@ -0,0 +1,141 @@
+package secureoperator
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// the block size queries are padded to, as recommended by RFC 8467
+const paddingBlockSize = 128
+
+// newQueryMsg creates a DNS query message for a DNSQuestion, as used by the
+// providers which speak the DNS wire format. If a subnet is provided, it is
+// sent in the edns0-client-subnet option, unless the question has its own
+// client subnet; if pad is true the message is padded with the EDNS(0)
+// padding option. The DO and CD bits are set as requested by the question.
+func newQueryMsg(q DNSQuestion, subnet *dns.EDNS0_SUBNET, pad bool) (*dns.Msg, error) {
+	// allow for the trailing period of a fully-qualified name
+	name := dns.Fqdn(q.Name)
+	if l := len([]byte(name)); l > DNSNameMaxBytes+1 {
+		return nil, fmt.Errorf("name length of %v exceeds DNS name max length", l)
+	}
+
+	if q.ClientSubnet != nil {
+		subnet = newEDNSSubnet(q.ClientSubnet)
+	}
+
+	msg := new(dns.Msg)
+	msg.SetQuestion(name, q.Type)
+	msg.CheckingDisabled = q.CheckingDisabled
+
+	if subnet == nil && !pad && !q.DNSSECOK {
+		return msg, nil
+	}
+
+	opt := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+	opt.SetUDPSize(dns.DefaultMsgSize)
+	opt.SetDo(q.DNSSECOK)
+	msg.Extra = append(msg.Extra, opt)
+
+	if subnet != nil {
+		opt.Option = append(opt.Option, subnet)
+	}
+
+	if pad {
+		p := &dns.EDNS0_PADDING{}
+		opt.Option = append(opt.Option, p)
+
+		// pack to determine the unpadded length, as msg.Len is only an estimate
+		buf, err := msg.Pack()
+		if err != nil {
+			return nil, err
+		}
+		if r := len(buf) % paddingBlockSize; r != 0 {
+			p.Padding = make([]byte, paddingBlockSize-r)
+		}
+	}
+
+	return msg, nil
+}
+
+// newResponseMsg creates a message from a DNSResponse, as the answer to a
+// request. The question is echoed from the request, which must have exactly
+// one.
+func newResponseMsg(r *dns.Msg, dnsResp *DNSResponse) *dns.Msg {
+	return &dns.Msg{
+		MsgHdr: dns.MsgHdr{
+			Id:                 r.Id,
+			Response:           true,
+			Opcode:             dns.OpcodeQuery,
+			Authoritative:      false,
+			Truncated:          dnsResp.Truncated,
+			RecursionDesired:   dnsResp.RecursionDesired,
+			RecursionAvailable: dnsResp.RecursionAvailable,
+			AuthenticatedData:  dnsResp.AuthenticatedData,
+			CheckingDisabled:   dnsResp.CheckingDisabled,
+			Rcode:              dnsResp.ResponseCode,
+		},
+		Compress: r.Compress,
+		Question: []dns.Question{r.Question[0]},
+		Answer:   transformRR(dnsResp.Answer, "answer"),
+		Ns:       transformRR(dnsResp.Authority, "authority"),
+		Extra:    transformRR(dnsResp.Extra, "extra"),
+	}
+}
+
+// parseEDNSSubnet parses a subnet in CIDR notation to an EDNS0_SUBNET option
+func parseEDNSSubnet(subnet string) (*dns.EDNS0_SUBNET, error) {
+	_, ipnet, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return nil, err
+	}
+
+	return newEDNSSubnet(ipnet), nil
+}
+
+// newEDNSSubnet creates an EDNS0_SUBNET option for a subnet
+func newEDNSSubnet(subnet *net.IPNet) *dns.EDNS0_SUBNET {
+	ones, _ := subnet.Mask.Size()
+	e := &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		SourceNetmask: uint8(ones),
+	}
+
+	if ip4 := subnet.IP.To4(); ip4 != nil {
+		e.Family = 1
+		e.Address = ip4.Mask(subnet.Mask)
+	} else {
+		e.Family = 2
+		e.Address = subnet.IP.Mask(subnet.Mask)
+	}
+
+	return e
+}
+
+// truncateMsg removes records from a message until it fits in size bytes.
+// Additional records are removed first, as they're optional; if answer or
+// authority records must be removed, the message is marked as truncated so
+// that the client retries over TCP. Any OPT record is retained.
+func truncateMsg(m *dns.Msg, size int) {
+	m.Compress = true
+	if m.Len() <= size {
+		return
+	}
+
+	opt := m.IsEdns0()
+	m.Extra = nil
+	if opt != nil {
+		m.Extra = []dns.RR{opt}
+	}
+	if m.Len() <= size {
+		return
+	}
+
+	// the client must retry over TCP to get a complete answer, so there is
+	// little value in a partial one
+	m.Truncated = true
+	m.Answer = nil
+	m.Ns = nil
+}
@@ -0,0 +1,392 @@
+package secureoperator
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+// MetricsContentType is the media type of metrics served by MetricsHandler;
+// the text exposition format understood by Prometheus
+const MetricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// latencyBuckets are the upper bounds, in seconds, of the buckets of latency
+// histograms
+var latencyBuckets = []float64{
+	.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10,
+}
+
+// metrics holds every metric, so that they may be served
+var metrics []metric
+
+var (
+	queriesTotal = newCounterVec("secureoperator_queries_total",
+		"DNS queries answered, by query type and response code.",
+		"qtype", "rcode")
+	upstreamDuration = newHistogramVec("secureoperator_upstream_query_duration_seconds",
+		"Time taken by queries to upstream providers.",
+		latencyBuckets, "upstream")
+	upstreamHTTPResponses = newCounterVec("secureoperator_upstream_http_responses_total",
+		"HTTP responses from upstream providers, by status code.",
+		"upstream", "code")
+	errorsTotal = newCounterVec("secureoperator_errors_total",
+		"Errors, by kind.",
+		"kind")
+	ruleHits = newCounterVec("secureoperator_rule_hits_total",
+		"Queries matching a rule of each blocklist or allowlist.",
+		"list", "action")
+	rebindingFiltered = newCounterVec("secureoperator_rebinding_filtered_total",
+		"Answers from which private addresses were removed, for public names.")
+	bootstrapLookups = newCounterVec("secureoperator_bootstrap_lookups_total",
+		"Lookups sent by the bootstrap DNS client.")
+	bootstrapCacheHits = newCounterVec("secureoperator_bootstrap_cache_hits_total",
+		"Lookups answered from the cache of the bootstrap DNS client.")
+)
+
+// kinds of error, as counted by errorsTotal
+const (
+	errorUpstream         = "upstream"
+	errorUpstreamTimeout  = "upstream_timeout"
+	errorQuestionMismatch = "question_mismatch"
+	errorDNSSECBogus      = "dnssec_bogus"
+	errorBootstrap        = "bootstrap"
+	errorWrite            = "write"
+	errorDnstap           = "dnstap"
+)
+
+// MetricsHandler returns an http.Handler which serves the metrics of this
+// package, in the text format understood by Prometheus.
+func MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", MetricsContentType)
+		if err := writeMetrics(w); err != nil {
+			log.Errorf("unable to write metrics: %v", err)
+		}
+	})
+}
+
+// writeMetrics writes every metric, ordered by name
+func writeMetrics(w io.Writer) error {
+	sorted := make([]metric, len(metrics))
+	copy(sorted, metrics)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].metricName() < sorted[j].metricName()
+	})
+
+	for _, m := range sorted {
+		if err := m.write(w); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// NewInstrumentedProvider wraps a provider, recording the time taken by each
+// of its queries and any errors in the metrics served by MetricsHandler.
+// Metrics are labelled with the name of the provider.
+func NewInstrumentedProvider(p Provider) *InstrumentedProvider {
+	return &InstrumentedProvider{provider: p, name: providerName(p)}
+}
+
+// InstrumentedProvider is a Provider which records metrics of the queries
+// sent to another.
+type InstrumentedProvider struct {
+	provider Provider
+	name     string
+}
+
+func (p *InstrumentedProvider) String() string {
+	return p.name
+}
+
+// Close closes the wrapped provider
+func (p *InstrumentedProvider) Close() error {
+	return closeProvider(p.provider)
+}
+
+// Query sends a DNS question to the provider
+func (p *InstrumentedProvider) Query(q DNSQuestion) (*DNSResponse, error) {
+	return p.QueryContext(context.Background(), q)
+}
+
+// QueryContext sends a DNS question to the provider, returning early if the
+// context is done.
+func (p *InstrumentedProvider) QueryContext(ctx context.Context, q DNSQuestion) (*DNSResponse, error) {
+	start := time.Now()
+	resp, err := queryContext(ctx, p.provider, q)
+	upstreamDuration.observe(time.Since(start).Seconds(), p.name)
+
+	if err != nil {
+		if isTimeout(err) {
+			errorsTotal.inc(errorUpstreamTimeout)
+		} else {
+			errorsTotal.inc(errorUpstream)
+		}
+	}
+
+	return resp, err
+}
+
+// isTimeout returns true if an error is the result of a query taking too long
+func isTimeout(err error) bool {
+	if err == context.DeadlineExceeded || err == ErrQueryTimeout {
+		return true
+	}
+	if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		return true
+	}
+
+	return false
+}
+
+// observeResponse counts a response to a query by its type and response code
+func observeResponse(r *dns.Msg, rcode int) {
+	qtype := "none"
+	if len(r.Question) > 0 {
+		// types unknown to the dns package are counted together, so that
+		// clients can't create a series for each of the 65536 types
+		var ok bool
+		if qtype, ok = dns.TypeToString[r.Question[0].Qtype]; !ok {
+			qtype = "other"
+		}
+	}
+
+	code, ok := dns.RcodeToString[rcode]
+	if !ok {
+		code = strconv.Itoa(rcode)
+	}
+
+	queriesTotal.inc(qtype, code)
+}
+
+type metric interface {
+	metricName() string
+	write(io.Writer) error
+}
+
+// series is a single combination of label values of a metric
+type series struct {
+	values []string
+	value  float64
+	// histograms only
+	buckets []uint64
+	count   uint64
+}
+
+// metricVec is a metric with a series for each combination of label values
+type metricVec struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+
+	mutex  sync.Mutex
+	series map[string]*series
+}
+
+func (m *metricVec) metricName() string {
+	return m.name
+}
+
+// get returns the series for the given label values, creating it if needed;
+// the caller must hold the mutex.
+func (m *metricVec) get(values []string) *series {
+	if len(values) != len(m.labels) {
+		panic(fmt.Sprintf("%v: expected %v label values, got %v",
+			m.name, len(m.labels), len(values)))
+	}
+
+	key := strings.Join(values, "\xff")
+	s, ok := m.series[key]
+	if !ok {
+		s = &series{values: values}
+		m.series[key] = s
+	}
+
+	return s
+}
+
+// snapshot returns a copy of the series of the metric, ordered by their label
+// values, so that they may be written without holding the mutex; a slow
+// reader of the metrics must not delay the queries which update them.
+func (m *metricVec) snapshot() []series {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	keys := make([]string, 0, len(m.series))
+	for k := range m.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	s := make([]series, len(keys))
+	for i, k := range keys {
+		s[i] = *m.series[k]
+		s[i].buckets = append([]uint64(nil), s[i].buckets...)
+	}
+
+	return s
+}
+
+func (m *metricVec) header(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v %v\n", m.name, m.help, m.name, m.kind)
+	return err
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labelString formats label names and values, with any extra pairs given
+func labelString(names, values []string, extra ...string) string {
+	var pairs []string
+	for i, name := range names {
+		pairs = append(pairs, name+`="`+labelEscaper.Replace(values[i])+`"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+labelEscaper.Replace(extra[i+1])+`"`)
+	}
+
+	if len(pairs) == 0 {
+		return ""
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// counterVec is a counter, with a series for each combination of label values
+type counterVec struct {
+	metricVec
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	c := &counterVec{metricVec{
+		name:   name,
+		help:   help,
+		kind:   "counter",
+		labels: labels,
+		series: make(map[string]*series),
+	}}
+	metrics = append(metrics, c)
+
+	// a counter without labels has a single series, which is reported as zero
+	// until incremented
+	if len(labels) == 0 {
+		c.get(nil)
+	}
+
+	return c
+}
+
+func (c *counterVec) inc(values ...string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.get(values).value++
+}
+
+// value returns the current value of a series
+func (c *counterVec) value(values ...string) float64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.get(values).value
+}
+
+func (c *counterVec) write(w io.Writer) error {
+	all := c.snapshot()
+
+	if err := c.header(w); err != nil {
+		return err
+	}
+	for _, s := range all {
+		_, err := fmt.Fprintf(w, "%v%v %v\n",
+			c.name, labelString(c.labels, s.values), formatFloat(s.value))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// histogramVec is a histogram, with a series for each combination of label
+// values
+type histogramVec struct {
+	metricVec
+	buckets []float64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	h := &histogramVec{
+		metricVec: metricVec{
+			name:   name,
+			help:   help,
+			kind:   "histogram",
+			labels: labels,
+			series: make(map[string]*series),
+		},
+		buckets: buckets,
+	}
+	metrics = append(metrics, h)
+
+	return h
+}
+
+func (h *histogramVec) observe(v float64, values ...string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	s := h.get(values)
+	if s.buckets == nil {
+		s.buckets = make([]uint64, len(h.buckets))
+	}
+	for i, b := range h.buckets {
+		if v <= b {
+			s.buckets[i]++
+		}
+	}
+	s.value += v
+	s.count++
+}
+
+func (h *histogramVec) write(w io.Writer) error {
+	all := h.snapshot()
+
+	if err := h.header(w); err != nil {
+		return err
+	}
+	for _, s := range all {
+		for i, b := range h.buckets {
+			_, err := fmt.Fprintf(w, "%v_bucket%v %v\n", h.name,
+				labelString(h.labels, s.values, "le", formatFloat(b)), s.buckets[i])
+			if err != nil {
+				return err
+			}
+		}
+
+		labels := labelString(h.labels, s.values)
+		_, err := fmt.Fprintf(w, "%v_bucket%v %v\n%v_sum%v %v\n%v_count%v %v\n",
+			h.name, labelString(h.labels, s.values, "le", "+Inf"), s.count,
+			h.name, labels, formatFloat(s.value),
+			h.name, labels, s.count)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
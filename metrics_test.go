@@ -0,0 +1,166 @@
+package secureoperator
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestInstrumentedProvider(t *testing.T) {
+	p := &mockProvider{name: "instrumented", resp: testResponse("example.com.", 300)}
+	ip := NewInstrumentedProvider(p)
+	if ip.String() != "instrumented" {
+		t.Errorf("expected provider name to be kept, got %v", ip.String())
+	}
+
+	errors := errorsTotal.value(errorUpstream)
+
+	if _, err := ip.Query(DNSQuestion{Name: "example.com.", Type: dns.TypeA}); err != nil {
+		t.Fatal(err)
+	}
+	p.Set(nil, errMockProvider)
+	if _, err := ip.Query(DNSQuestion{Name: "example.com.", Type: dns.TypeA}); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	if v := errorsTotal.value(errorUpstream); v != errors+1 {
+		t.Errorf("expected one upstream error to be counted, got %v", v-errors)
+	}
+
+	w := httptest.NewRecorder()
+	MetricsHandler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	if ct := w.Header().Get("Content-Type"); ct != MetricsContentType {
+		t.Errorf("unexpected content type %v", ct)
+	}
+
+	body := w.Body.String()
+	for _, line := range []string{
+		`# TYPE secureoperator_upstream_query_duration_seconds histogram`,
+		`secureoperator_upstream_query_duration_seconds_bucket{upstream="instrumented",le="+Inf"} 2`,
+		`secureoperator_upstream_query_duration_seconds_count{upstream="instrumented"} 2`,
+		`# TYPE secureoperator_bootstrap_lookups_total counter`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("expected metrics to contain %q", line)
+		}
+	}
+}
+
+func TestHandlerMetrics(t *testing.T) {
+	p := &mockProvider{name: "mock", err: errMockProvider}
+	h := NewHandler(p, nil)
+
+	before := queriesTotal.value("MX", "SERVFAIL")
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeMX)
+	h.Handle(&testResponseWriter{}, req)
+
+	if v := queriesTotal.value("MX", "SERVFAIL"); v != before+1 {
+		t.Errorf("expected one failed MX query to be counted, got %v", v-before)
+	}
+}
+
+func TestHandlerMetricsUnknownType(t *testing.T) {
+	p := &mockProvider{name: "mock", err: errMockProvider}
+	h := NewHandler(p, nil)
+
+	before := queriesTotal.value("other", "SERVFAIL")
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", 65000)
+	h.Handle(&testResponseWriter{}, req)
+
+	if v := queriesTotal.value("other", "SERVFAIL"); v != before+1 {
+		t.Errorf("expected a query of an unknown type to be counted as other, got %v", v-before)
+	}
+
+	queriesTotal.mutex.Lock()
+	defer queriesTotal.mutex.Unlock()
+	for _, s := range queriesTotal.series {
+		if s.values[0] == "TYPE65000" {
+			t.Errorf("did not expect a series for an unknown type")
+		}
+	}
+}
+
+func TestHistogramVec(t *testing.T) {
+	h := &histogramVec{
+		metricVec: metricVec{
+			name:   "test_seconds",
+			help:   "Test histogram.",
+			kind:   "histogram",
+			labels: []string{"name"},
+			series: make(map[string]*series),
+		},
+		buckets: []float64{.1, 1},
+	}
+	h.observe(.05, `a "quoted" name`)
+	h.observe(.5, `a "quoted" name`)
+	h.observe(5, `a "quoted" name`)
+
+	var buf bytes.Buffer
+	if err := h.write(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `# HELP test_seconds Test histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{name="a \"quoted\" name",le="0.1"} 1
+test_seconds_bucket{name="a \"quoted\" name",le="1"} 2
+test_seconds_bucket{name="a \"quoted\" name",le="+Inf"} 3
+test_seconds_sum{name="a \"quoted\" name"} 5.55
+test_seconds_count{name="a \"quoted\" name"} 3
+`
+	if buf.String() != expected {
+		t.Errorf("unexpected output:\n%v", buf.String())
+	}
+}
+
+// blockingWriter blocks each write until released
+type blockingWriter struct {
+	writing chan struct{}
+	release chan struct{}
+}
+
+func (w *blockingWriter) Write(b []byte) (int, error) {
+	select {
+	case w.writing <- struct{}{}:
+	default:
+	}
+	<-w.release
+	return len(b), nil
+}
+
+func TestCounterVecSlowWriter(t *testing.T) {
+	c := &counterVec{metricVec{
+		name:   "test_total",
+		help:   "Test counter.",
+		kind:   "counter",
+		labels: []string{"name"},
+		series: make(map[string]*series),
+	}}
+	c.inc("a")
+
+	w := &blockingWriter{writing: make(chan struct{}, 1), release: make(chan struct{})}
+	defer close(w.release)
+	go c.write(w)
+	<-w.writing
+
+	// the counter must be updated while the writer is blocked
+	done := make(chan struct{})
+	go func() {
+		c.inc("a")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("counter blocked by a slow writer")
+	}
+}
@@ -1,6 +1,12 @@
 package secureoperator
 
 import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
 	"github.com/miekg/dns"
 )
 
@@ -8,6 +14,15 @@ import (
 type DNSQuestion struct {
 	Name string `json:"name,omitempty"`
 	Type uint16 `json:"type,omitempty"`
+	// DNSSECOK requests that DNSSEC records be included in the response, by
+	// setting the DO bit, where the provider supports it
+	DNSSECOK bool `json:"-"`
+	// CheckingDisabled requests that the upstream server not perform DNSSEC
+	// validation, by setting the CD bit, where the provider supports it
+	CheckingDisabled bool `json:"-"`
+	// ClientSubnet, if provided, is sent in the edns0-client-subnet option in
+	// place of any subnet configured for the provider
+	ClientSubnet *net.IPNet `json:"-"`
 }
 
 // DNSRR represents a DNS record, part of a response to a DNSQuestion
@@ -16,10 +31,36 @@ type DNSRR struct {
 	Type uint16 `json:"type,omitempty"`
 	TTL  uint32 `json:"TTL,omitempty"`
 	Data string `json:"data,omitempty"`
+
+	// rr is the original record, when the provider received one on the wire;
+	// it avoids a lossy round-trip through the string representation in Data
+	rr dns.RR
+}
+
+// NewDNSRR creates a DNSRR from a dns.RR, retaining the original record so
+// that it may be returned intact by RR.
+func NewDNSRR(rr dns.RR) DNSRR {
+	h := rr.Header()
+
+	return DNSRR{
+		Name: h.Name,
+		Type: h.Rrtype,
+		TTL:  h.Ttl,
+		Data: strings.TrimPrefix(rr.String(), h.String()),
+		rr:   rr,
+	}
 }
 
 // RR transforms a DNSRR to a dns.RR
 func (r DNSRR) RR() (dns.RR, error) {
+	if r.rr != nil {
+		// copy so that callers may freely modify the result; the TTL of the
+		// DNSRR takes precedence, as it may have been adjusted since creation
+		rr := dns.Copy(r.rr)
+		rr.Header().Ttl = r.TTL
+		return rr, nil
+	}
+
 	hdr := dns.RR_Header{Name: r.Name, Rrtype: r.Type, Class: dns.ClassINET, Ttl: r.TTL}
 	str := hdr.String() + r.Data
 	return dns.NewRR(str)
@@ -48,9 +89,126 @@ type DNSResponse struct {
 	AuthenticatedData  bool
 	CheckingDisabled   bool
 	ResponseCode       int
+	// Upstream is the name of the provider which produced the response, where
+	// a provider chooses among several; it is not set otherwise.
+	Upstream string `json:"-"`
+}
+
+// NewDNSResponse creates a DNSResponse from a dns.Msg. The OPT pseudo-record
+// is not carried over, as it applies only to the upstream exchange.
+func NewDNSResponse(msg *dns.Msg) *DNSResponse {
+	resp := &DNSResponse{
+		Truncated:          msg.Truncated,
+		RecursionDesired:   msg.RecursionDesired,
+		RecursionAvailable: msg.RecursionAvailable,
+		AuthenticatedData:  msg.AuthenticatedData,
+		CheckingDisabled:   msg.CheckingDisabled,
+		ResponseCode:       msg.Rcode,
+	}
+
+	for _, q := range msg.Question {
+		resp.Question = append(resp.Question, DNSQuestion{
+			Name: q.Name,
+			Type: q.Qtype,
+		})
+	}
+	for _, rr := range msg.Answer {
+		resp.Answer = append(resp.Answer, NewDNSRR(rr))
+	}
+	for _, rr := range msg.Ns {
+		resp.Authority = append(resp.Authority, NewDNSRR(rr))
+	}
+	for _, rr := range msg.Extra {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			continue
+		}
+		resp.Extra = append(resp.Extra, NewDNSRR(rr))
+	}
+
+	return resp
 }
 
 // Provider is an interface representing a servicer of DNS queries.
 type Provider interface {
 	Query(DNSQuestion) (*DNSResponse, error)
 }
+
+// ContextProvider is a Provider which supports cancellation of queries, and
+// deadlines, through a context.
+type ContextProvider interface {
+	Provider
+	QueryContext(context.Context, DNSQuestion) (*DNSResponse, error)
+}
+
+// providerName returns a name for a provider, for use in logs; providers may
+// implement fmt.Stringer to name themselves.
+func providerName(p Provider) string {
+	if s, ok := p.(fmt.Stringer); ok {
+		return s.String()
+	}
+
+	return fmt.Sprintf("%T", p)
+}
+
+// closeProvider closes a provider once it is no longer used; providers which
+// hold connections implement io.Closer to release them.
+func closeProvider(p Provider) error {
+	if c, ok := p.(io.Closer); ok {
+		return c.Close()
+	}
+
+	return nil
+}
+
+// closeProviders closes each of a list of providers, returning the first
+// error
+func closeProviders(providers []Provider) error {
+	var first error
+	for _, p := range providers {
+		if err := closeProvider(p); err != nil && first == nil {
+			first = err
+		}
+	}
+
+	return first
+}
+
+// fromUpstream returns a copy of a response, recording the provider which
+// produced it; a name already recorded by a nested provider is kept.
+func fromUpstream(resp *DNSResponse, p Provider) *DNSResponse {
+	if resp == nil || resp.Upstream != "" {
+		return resp
+	}
+
+	r := *resp
+	r.Upstream = providerName(p)
+
+	return &r
+}
+
+// queryContext queries a provider, returning early if the context is done.
+// Providers which do not implement ContextProvider are left to complete the
+// query in the background.
+func queryContext(ctx context.Context, p Provider, q DNSQuestion) (*DNSResponse, error) {
+	if cp, ok := p.(ContextProvider); ok {
+		return cp.QueryContext(ctx, q)
+	}
+
+	type result struct {
+		resp *DNSResponse
+		err  error
+	}
+
+	ch := make(chan result, 1)
+	go func() {
+		resp, err := p.Query(q)
+		ch <- result{resp, err}
+	}()
+
+	select {
+	case r := <-ch:
+		return r.resp, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,155 @@
+package secureoperator
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+const defaultDo53Timeout = 2 * time.Second
+
+// Do53Options is a configuration object for optional Do53Provider
+// configuration
+type Do53Options struct {
+	// Timeout is the time to wait for a server to respond to a query,
+	// including any retry over TCP, before trying the next server. If not
+	// provided, a default of 2 seconds is used.
+	Timeout time.Duration
+	// The EDNS subnet to send in the edns0-client-subnet option. If not
+	// specified, the option is not sent and the server determines this
+	// automatically. To specify that the client subnet should not be used, use
+	// the value "0.0.0.0/0".
+	EDNSSubnet string
+}
+
+// NewDo53Provider creates a Do53Provider, which sends queries to the given
+// servers. Servers are tried in order; a server is only skipped if it fails
+// to respond in time.
+func NewDo53Provider(servers Endpoints, opts *Do53Options) (*Do53Provider, error) {
+	if len(servers) < 1 {
+		return nil, fmt.Errorf("at least one endpoint server is required")
+	}
+	if opts == nil {
+		opts = &Do53Options{}
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = defaultDo53Timeout
+	}
+
+	var subnet *dns.EDNS0_SUBNET
+	if opts.EDNSSubnet != "" {
+		s, err := parseEDNSSubnet(opts.EDNSSubnet)
+		if err != nil {
+			return nil, err
+		}
+		subnet = s
+	}
+
+	return &Do53Provider{servers: servers, opts: opts, subnet: subnet}, nil
+}
+
+// Do53Provider is a provider of plain, unencrypted DNS, as served on port 53;
+// it implements the Provider interface. Queries are sent over UDP, and retried
+// over TCP when the response is truncated.
+//
+// As queries and responses are neither encrypted nor authenticated, it should
+// only be used with servers on a trusted network, such as those of internal
+// domains.
+type Do53Provider struct {
+	servers Endpoints
+	opts    *Do53Options
+	subnet  *dns.EDNS0_SUBNET
+}
+
+func (d *Do53Provider) String() string {
+	var servers []string
+	for _, s := range d.servers {
+		servers = append(servers, s.String())
+	}
+
+	return "dns://" + strings.Join(servers, ",")
+}
+
+// Query sends a DNS question to the configured servers, and returns the
+// response
+func (d *Do53Provider) Query(q DNSQuestion) (*DNSResponse, error) {
+	return d.QueryContext(context.Background(), q)
+}
+
+// QueryContext sends a DNS question to the configured servers, and returns
+// the response; the configured timeout applies to each server, in addition to
+// any deadline of the context.
+func (d *Do53Provider) QueryContext(ctx context.Context, q DNSQuestion) (*DNSResponse, error) {
+	msg, err := newQueryMsg(q, d.subnet, false)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, server := range d.servers {
+		r, err := d.query(ctx, msg, server)
+		if err == nil {
+			return NewDNSResponse(r), nil
+		}
+		if ctx.Err() != nil {
+			return nil, ErrQueryTimeout
+		}
+
+		log.Errorf("dns exchange with %v failed: %v", server, err)
+	}
+
+	return nil, ErrAllServersFailed
+}
+
+// query sends a message to a server over UDP, retrying over TCP if the
+// response is truncated
+func (d *Do53Provider) query(ctx context.Context, msg *dns.Msg, server Endpoint) (*dns.Msg, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.opts.Timeout)
+	defer cancel()
+
+	// truncated responses are returned with an error, as they may be
+	// incomplete
+	r, err := d.exchange(ctx, msg, server, "udp")
+	if err == dns.ErrTruncated || err == nil && r.Truncated {
+		log.Debugf("dns response from %v truncated, retrying over tcp", server)
+		r, err = d.exchange(ctx, msg, server, "tcp")
+	}
+
+	return r, err
+}
+
+// exchange sends a message to a server over the given network, "udp" or
+// "tcp", returning early if the context is done
+func (d *Do53Provider) exchange(ctx context.Context, msg *dns.Msg, server Endpoint, network string) (*dns.Msg, error) {
+	deadline, _ := ctx.Deadline()
+	client := &dns.Client{Net: network, Timeout: time.Until(deadline)}
+
+	type result struct {
+		msg *dns.Msg
+		err error
+	}
+
+	// the client does not support cancellation; a canceled exchange is left to
+	// time out in the background
+	ch := make(chan result, 1)
+	go func() {
+		r, _, err := client.Exchange(msg, server.String())
+		ch <- result{r, err}
+	}()
+
+	select {
+	case r := <-ch:
+		if isTimeout(r.err) {
+			// the client times out at the deadline of the context, which may
+			// not yet have been marked done
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		return r.msg, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
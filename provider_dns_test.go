@@ -0,0 +1,140 @@
+package secureoperator
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// newDo53TestServer starts UDP and TCP servers on the same port, answering
+// each query with handler; it returns the servers' endpoint.
+func newDo53TestServer(t *testing.T, handler dns.HandlerFunc) (Endpoint, func()) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		pc.Close()
+		t.Fatal(err)
+	}
+
+	udp := &dns.Server{PacketConn: pc, Handler: handler}
+	tcp := &dns.Server{Listener: ln, Handler: handler}
+	go udp.ActivateAndServe()
+	go tcp.ActivateAndServe()
+
+	host, port, _ := net.SplitHostPort(pc.LocalAddr().String())
+	p, _ := strconv.Atoi(port)
+
+	return Endpoint{IP: net.ParseIP(host), Port: uint16(p)}, func() {
+		udp.Shutdown()
+		tcp.Shutdown()
+	}
+}
+
+func TestDo53Provider(t *testing.T) {
+	var udp, tcp int32
+	server, cleanup := newDo53TestServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		resp := new(dns.Msg)
+		resp.SetReply(r)
+
+		// truncate UDP responses for large.example.com., as a server would
+		// when the answer is too large
+		if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+			atomic.AddInt32(&udp, 1)
+			if r.Question[0].Name == "large.example.com." {
+				resp.Truncated = true
+				w.WriteMsg(resp)
+				return
+			}
+		} else {
+			atomic.AddInt32(&tcp, 1)
+		}
+
+		rr, _ := dns.NewRR(r.Question[0].Name + " 300 IN A 192.0.2.1")
+		resp.Answer = append(resp.Answer, rr)
+		w.WriteMsg(resp)
+	})
+	defer cleanup()
+
+	p, err := NewDo53Provider(Endpoints{server}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := p.Query(DNSQuestion{Name: "example.com", Type: dns.TypeA})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answer) != 1 || resp.Answer[0].Data != "192.0.2.1" {
+		t.Errorf("unexpected answer %v", resp.Answer)
+	}
+	if u, c := atomic.LoadInt32(&udp), atomic.LoadInt32(&tcp); u != 1 || c != 0 {
+		t.Errorf("expected a single UDP query, got %v UDP and %v TCP", u, c)
+	}
+
+	resp, err = p.Query(DNSQuestion{Name: "large.example.com.", Type: dns.TypeA})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Truncated || len(resp.Answer) != 1 {
+		t.Errorf("expected the full response over TCP, got %+v", resp)
+	}
+	if u, c := atomic.LoadInt32(&udp), atomic.LoadInt32(&tcp); u != 2 || c != 1 {
+		t.Errorf("expected a retry over TCP, got %v UDP and %v TCP", u, c)
+	}
+}
+
+func TestDo53ProviderFailover(t *testing.T) {
+	server, cleanup := newDo53TestServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		resp := new(dns.Msg)
+		resp.SetRcode(r, dns.RcodeNameError)
+		w.WriteMsg(resp)
+	})
+	defer cleanup()
+
+	// the first server never responds, and is skipped
+	down, downCleanup := newDo53TestServer(t, func(w dns.ResponseWriter, r *dns.Msg) {})
+	defer downCleanup()
+
+	p, err := NewDo53Provider(Endpoints{down, server}, &Do53Options{Timeout: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := p.Query(DNSQuestion{Name: "example.com.", Type: dns.TypeA})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.ResponseCode != dns.RcodeNameError {
+		t.Errorf("expected NXDOMAIN from the second server, got %v", resp.ResponseCode)
+	}
+}
+
+func TestDo53ProviderTimeout(t *testing.T) {
+	// the server never responds
+	server, cleanup := newDo53TestServer(t, func(w dns.ResponseWriter, r *dns.Msg) {})
+	defer cleanup()
+
+	p, err := NewDo53Provider(Endpoints{server}, &Do53Options{Timeout: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := p.QueryContext(ctx, DNSQuestion{Name: "example.com.", Type: dns.TypeA}); err != ErrQueryTimeout {
+		t.Errorf("expected a timeout, got %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("expected the query to time out promptly, took %v", d)
+	}
+}
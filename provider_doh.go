@@ -0,0 +1,212 @@
+package secureoperator
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// DNSMessageContentType is the media type of a DNS wire-format message, as
+	// defined by RFC 8484
+	DNSMessageContentType = "application/dns-message"
+	// the maximum size of a DNS message; responses larger are rejected
+	dnsMessageMaxBytes = 65535
+)
+
+// ErrUnexpectedContentType is returned when a DNS-over-HTTPS server responds
+// with a content type other than DNSMessageContentType
+var ErrUnexpectedContentType = errors.New("unexpected content type in response")
+
+// DoHOptions is a configuration object for optional DoHProvider configuration
+type DoHOptions struct {
+	// Method is the HTTP method used for requests; either http.MethodGet or
+	// http.MethodPost. GET is used if not specified.
+	Method string
+	// Pad specifies if a DNS request should be padded with the EDNS(0) padding
+	// option, to a multiple of 128 bytes.
+	Pad bool
+	// EndpointIPs is a list of IPs to be used as the DoH endpoint, avoiding
+	// DNS lookups in the case where they are provided. One is chosen randomly
+	// for each request.
+	EndpointIPs []net.IP
+	// DNSServers is a list of Endpoints to be used as DNS servers when looking
+	// up the endpoint; if not provided, the system DNS resolver is used.
+	DNSServers Endpoints
+	// The EDNS subnet to send in the edns0-client-subnet option. If not
+	// specified, the option is not sent and the provider determines this
+	// automatically. To specify that the client subnet should not be used, use
+	// the value "0.0.0.0/0".
+	EDNSSubnet string
+	// Additional headers to be sent with requests to the DNS provider
+	Headers http.Header
+	// Additional query parameters to be sent with requests to the DNS provider
+	QueryParameters map[string][]string
+}
+
+// NewDoHProvider creates a DoHProvider
+func NewDoHProvider(endpoint string, opts *DoHOptions) (*DoHProvider, error) {
+	if opts == nil {
+		opts = &DoHOptions{}
+	}
+
+	switch opts.Method {
+	case "":
+		opts.Method = http.MethodGet
+	case http.MethodGet, http.MethodPost:
+	default:
+		return nil, fmt.Errorf("unsupported method %v", opts.Method)
+	}
+
+	var subnet *dns.EDNS0_SUBNET
+	if opts.EDNSSubnet != "" {
+		s, err := parseEDNSSubnet(opts.EDNSSubnet)
+		if err != nil {
+			return nil, err
+		}
+		subnet = s
+	}
+
+	e, err := newHTTPEndpoint(endpoint, opts.EndpointIPs, opts.DNSServers)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DoHProvider{
+		endpoint: e,
+		opts:     opts,
+		subnet:   subnet,
+		client:   newHTTPClient(e.url.Hostname()),
+	}, nil
+}
+
+// DoHProvider is a DNS-over-HTTPS provider which exchanges DNS wire-format
+// messages, as specified in RFC 8484; it implements the Provider interface.
+type DoHProvider struct {
+	endpoint *httpEndpoint
+	opts     *DoHOptions
+	subnet   *dns.EDNS0_SUBNET
+	client   *http.Client
+}
+
+func (d DoHProvider) String() string {
+	return d.endpoint.url.String()
+}
+
+// Close closes any idle connections to the endpoint
+func (d DoHProvider) Close() error {
+	closeIdleConnections(d.client)
+	return nil
+}
+
+func (d DoHProvider) newRequest(q DNSQuestion) (*http.Request, error) {
+	msg, err := newQueryMsg(q, d.subnet, d.opts.Pad)
+	if err != nil {
+		return nil, err
+	}
+	// RFC 8484 recommends an ID of 0, to improve cacheability of responses
+	msg.Id = 0
+
+	buf, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	u, mustSendHost, err := d.endpoint.resolve()
+	if err != nil {
+		return nil, err
+	}
+
+	var body io.Reader
+	if d.opts.Method == http.MethodPost {
+		body = bytes.NewReader(buf)
+	}
+
+	httpreq, err := http.NewRequest(d.opts.Method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+
+	// set headers if provided; we must always set our content type headers,
+	// so the provided headers are copied rather than used directly
+	for k, vs := range d.opts.Headers {
+		for _, v := range vs {
+			httpreq.Header.Add(k, v)
+		}
+	}
+	httpreq.Header.Set("Accept", DNSMessageContentType)
+	if d.opts.Method == http.MethodPost {
+		httpreq.Header.Set("Content-Type", DNSMessageContentType)
+	}
+
+	qry := httpreq.URL.Query()
+	for k, vs := range d.opts.QueryParameters {
+		for _, v := range vs {
+			qry.Add(k, v)
+		}
+	}
+	if d.opts.Method == http.MethodGet {
+		qry.Set("dns", base64.RawURLEncoding.EncodeToString(buf))
+	}
+	httpreq.URL.RawQuery = qry.Encode()
+
+	if mustSendHost {
+		httpreq.Host = d.endpoint.url.Host
+	}
+
+	return httpreq, nil
+}
+
+// Query sends a DNS question to the DNS-over-HTTPS endpoint, and returns the
+// response
+func (d DoHProvider) Query(q DNSQuestion) (*DNSResponse, error) {
+	return d.QueryContext(context.Background(), q)
+}
+
+// QueryContext sends a DNS question to the DNS-over-HTTPS endpoint, and
+// returns the response; the request is canceled if the context is done before
+// it completes.
+func (d DoHProvider) QueryContext(ctx context.Context, q DNSQuestion) (*DNSResponse, error) {
+	httpreq, err := d.newRequest(q)
+	if err != nil {
+		return nil, err
+	}
+	httpreq = httpreq.WithContext(ctx)
+
+	httpresp, err := d.client.Do(httpreq)
+	if err != nil {
+		return nil, err
+	}
+	defer httpresp.Body.Close()
+	upstreamHTTPResponses.inc(d.String(), strconv.Itoa(httpresp.StatusCode))
+
+	if httpresp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status from server: %v", httpresp.Status)
+	}
+	ct, _, err := mime.ParseMediaType(httpresp.Header.Get("Content-Type"))
+	if err != nil || ct != DNSMessageContentType {
+		return nil, ErrUnexpectedContentType
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(httpresp.Body, dnsMessageMaxBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	msg := new(dns.Msg)
+	if err := msg.Unpack(body); err != nil {
+		return nil, err
+	}
+
+	return NewDNSResponse(msg), nil
+}
@@ -0,0 +1,248 @@
+package secureoperator
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func dohResponse(t *testing.T, w http.ResponseWriter, req *dns.Msg) {
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.Answer = []dns.RR{
+		&dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+			A:   net.ParseIP("93.184.216.34"),
+		},
+		&dns.TXT{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 300},
+			Txt: []string{"v=spf1 include:example.com -all"},
+		},
+	}
+	resp.SetEdns0(4096, false)
+
+	buf, err := resp.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w.Header().Set("Content-Type", DNSMessageContentType)
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf)
+}
+
+func TestDoHQueryGet(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			t.Errorf("unexpected method %v", r.Method)
+		}
+		if a := r.Header.Get("Accept"); a != DNSMessageContentType {
+			t.Errorf("unexpected accept header %v", a)
+		}
+
+		buf, err := base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req := new(dns.Msg)
+		if err := req.Unpack(buf); err != nil {
+			t.Fatal(err)
+		}
+		if req.Id != 0 {
+			t.Errorf("expected ID of 0, got %v", req.Id)
+		}
+		if n := req.Question[0].Name; n != "example.com." {
+			t.Errorf("unexpected name in query: %v", n)
+		}
+		if req.IsEdns0() != nil {
+			t.Errorf("did not expect an OPT record")
+		}
+
+		dohResponse(t, w, req)
+	}))
+	defer ts.Close()
+
+	d, err := NewDoHProvider(ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := d.Query(DNSQuestion{Name: "example.com", Type: dns.TypeA})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(resp.Answer) != 2 {
+		t.Fatalf("unexpected answer count %v", len(resp.Answer))
+	}
+	if len(resp.Extra) != 0 {
+		t.Errorf("expected OPT record to be omitted, got %v", resp.Extra)
+	}
+
+	a := resp.Answer[0]
+	if a.Name != "example.com." || a.Type != dns.TypeA || a.TTL != 300 {
+		t.Errorf("unexpected record %v", a)
+	}
+	if a.Data != "93.184.216.34" {
+		t.Errorf("unexpected data %v", a.Data)
+	}
+
+	rr, err := resp.Answer[1].RR()
+	if err != nil {
+		t.Fatal(err)
+	}
+	txt, ok := rr.(*dns.TXT)
+	if !ok {
+		t.Fatal("did not get expected record type")
+	}
+	if txt.Txt[0] != "v=spf1 include:example.com -all" {
+		t.Errorf("unexpected txt data %v", txt.Txt)
+	}
+}
+
+func TestDoHQueryPost(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			t.Errorf("unexpected method %v", r.Method)
+		}
+		if ct := r.Header.Get("Content-Type"); ct != DNSMessageContentType {
+			t.Errorf("unexpected content type %v", ct)
+		}
+		if r.URL.Query().Get("dns") != "" {
+			t.Errorf("did not expect dns parameter in POST request")
+		}
+		if v := r.Header.Get("X-Test"); v != "yes" {
+			t.Errorf("expected custom header, got %v", v)
+		}
+
+		buf, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req := new(dns.Msg)
+		if err := req.Unpack(buf); err != nil {
+			t.Fatal(err)
+		}
+
+		dohResponse(t, w, req)
+	}))
+	defer ts.Close()
+
+	d, err := NewDoHProvider(ts.URL, &DoHOptions{
+		Method:  http.MethodPost,
+		Headers: http.Header{"X-Test": []string{"yes"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := d.Query(DNSQuestion{Name: "example.com.", Type: dns.TypeA})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answer) != 2 {
+		t.Errorf("unexpected answer count %v", len(resp.Answer))
+	}
+}
+
+func TestDoHPaddingAndSubnet(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(buf)%paddingBlockSize != 0 {
+			t.Errorf("expected request padded to block size, got %v", len(buf))
+		}
+
+		req := new(dns.Msg)
+		if err := req.Unpack(buf); err != nil {
+			t.Fatal(err)
+		}
+
+		opt := req.IsEdns0()
+		if opt == nil {
+			t.Fatal("expected an OPT record")
+		}
+
+		var subnet *dns.EDNS0_SUBNET
+		for _, o := range opt.Option {
+			if s, ok := o.(*dns.EDNS0_SUBNET); ok {
+				subnet = s
+			}
+		}
+		if subnet == nil {
+			t.Fatal("expected a subnet option")
+		}
+		if subnet.SourceNetmask != 20 || subnet.Address.String() != "64.10.0.0" {
+			t.Errorf("unexpected subnet %v", subnet)
+		}
+
+		dohResponse(t, w, req)
+	}))
+	defer ts.Close()
+
+	d, err := NewDoHProvider(ts.URL, &DoHOptions{
+		Method:     http.MethodPost,
+		Pad:        true,
+		EDNSSubnet: "64.10.0.0/20",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	questions := []DNSQuestion{
+		DNSQuestion{Name: "whatever.yo", Type: dns.TypeA},
+		DNSQuestion{Name: "sure.yep", Type: dns.TypeMX},
+		DNSQuestion{Name: strings.Repeat("a.", 126), Type: dns.TypeA},
+	}
+
+	for _, q := range questions {
+		if _, err := d.Query(q); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestDoHErrors(t *testing.T) {
+	var status int
+	var contentType string
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		w.WriteHeader(status)
+	}))
+	defer ts.Close()
+
+	d, err := NewDoHProvider(ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, contentType = http.StatusBadRequest, DNSMessageContentType
+	if _, err := d.Query(DNSQuestion{Name: "example.com", Type: dns.TypeA}); err == nil {
+		t.Error("expected an error for a non-200 response")
+	}
+
+	status, contentType = http.StatusOK, "application/json"
+	_, err = d.Query(DNSQuestion{Name: "example.com", Type: dns.TypeA})
+	if err != ErrUnexpectedContentType {
+		t.Errorf("expected ErrUnexpectedContentType, got %v", err)
+	}
+
+	if _, err := d.Query(DNSQuestion{Name: strings.Repeat("a", 255)}); err == nil {
+		t.Error("expected an error for a too-long DNS name")
+	}
+
+	if _, err := NewDoHProvider(ts.URL, &DoHOptions{Method: http.MethodPut}); err == nil {
+		t.Error("expected an error for an unsupported method")
+	}
+}
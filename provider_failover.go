@@ -0,0 +1,231 @@
+package secureoperator
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultFailoverTimeout   = 5 * time.Second
+	defaultFailureThreshold  = 3
+	defaultFailoverProbeWait = 30 * time.Second
+)
+
+// FailoverOptions is a configuration object for optional FailoverProvider
+// configuration
+type FailoverOptions struct {
+	// Timeout is the time to wait for a single upstream to respond before
+	// trying the next one. If not provided, a default of 5 seconds is used.
+	Timeout time.Duration
+	// FailureThreshold is the number of consecutive failures after which an
+	// upstream is considered down, and is skipped. If not provided, a default
+	// of 3 is used.
+	FailureThreshold int
+	// ProbeInterval is the time a down upstream is skipped for, after which a
+	// single query is sent to it as a probe; if the probe succeeds the upstream
+	// is considered up again. If not provided, a default of 30 seconds is used.
+	ProbeInterval time.Duration
+}
+
+// NewFailoverProvider creates a FailoverProvider, which tries each of the
+// given providers in order.
+func NewFailoverProvider(providers []Provider, opts *FailoverOptions) (*FailoverProvider, error) {
+	if len(providers) < 1 {
+		return nil, fmt.Errorf("at least one provider is required")
+	}
+	if opts == nil {
+		opts = &FailoverOptions{}
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = defaultFailoverTimeout
+	}
+	if opts.FailureThreshold == 0 {
+		opts.FailureThreshold = defaultFailureThreshold
+	}
+	if opts.ProbeInterval == 0 {
+		opts.ProbeInterval = defaultFailoverProbeWait
+	}
+
+	f := &FailoverProvider{opts: opts}
+	for _, p := range providers {
+		f.upstreams = append(f.upstreams, &upstream{provider: p})
+	}
+
+	return f, nil
+}
+
+// FailoverProvider is a Provider which wraps an ordered list of providers;
+// when one errors, times out, or responds with SERVFAIL, the next is tried.
+//
+// The health of each provider is tracked in the manner of a circuit breaker:
+// after repeated failures a provider is skipped, until a probe query to it
+// succeeds.
+type FailoverProvider struct {
+	upstreams []*upstream
+	opts      *FailoverOptions
+}
+
+// Close closes the wrapped providers
+func (f *FailoverProvider) Close() error {
+	providers := make([]Provider, len(f.upstreams))
+	for i, u := range f.upstreams {
+		providers[i] = u.provider
+	}
+
+	return closeProviders(providers)
+}
+
+// Query sends a DNS question to the first healthy provider which is able to
+// answer it, and returns the response
+func (f *FailoverProvider) Query(q DNSQuestion) (*DNSResponse, error) {
+	return f.QueryContext(context.Background(), q)
+}
+
+// QueryContext sends a DNS question to the first healthy provider which is
+// able to answer it, and returns the response
+func (f *FailoverProvider) QueryContext(ctx context.Context, q DNSQuestion) (*DNSResponse, error) {
+	var (
+		skipped  []*upstream
+		servfail *DNSResponse
+	)
+
+	try := func(u *upstream) (*DNSResponse, bool) {
+		resp, err := u.query(ctx, q, f.opts.Timeout)
+		resp = fromUpstream(resp, u.provider)
+		if err == nil && resp.ResponseCode != dns.RcodeServerFailure {
+			u.succeeded()
+			return resp, true
+		}
+
+		if ctx.Err() != nil {
+			// the query as a whole was canceled; not the upstream's fault
+			u.canceled()
+			return nil, false
+		}
+		if err != nil {
+			log.Errorf("failover upstream %v failed: %v", u, err)
+		} else {
+			servfail = resp
+		}
+		u.failed(f.opts.FailureThreshold)
+
+		return nil, false
+	}
+
+	now := time.Now()
+	for _, u := range f.upstreams {
+		if !u.available(now, f.opts.ProbeInterval) {
+			skipped = append(skipped, u)
+			continue
+		}
+		if resp, ok := try(u); ok {
+			return resp, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+
+	// every available upstream failed; as a last resort, try those which were
+	// skipped, as it's better than failing outright
+	for _, u := range skipped {
+		if resp, ok := try(u); ok {
+			return resp, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+
+	if servfail != nil {
+		return servfail, nil
+	}
+
+	return nil, ErrAllServersFailed
+}
+
+// upstream tracks the health of a provider
+type upstream struct {
+	provider Provider
+
+	mutex    sync.Mutex
+	failures int
+	// downSince is when the upstream was marked down, or last probed
+	downSince time.Time
+	probing   bool
+}
+
+func (u *upstream) String() string {
+	return providerName(u.provider)
+}
+
+func (u *upstream) query(ctx context.Context, q DNSQuestion, timeout time.Duration) (*DNSResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	return queryContext(ctx, u.provider, q)
+}
+
+func (u *upstream) down() bool {
+	return !u.downSince.IsZero()
+}
+
+// available reports whether a query should be sent to the upstream; if it is
+// down, only a single probe query is allowed once every probe interval.
+func (u *upstream) available(now time.Time, interval time.Duration) bool {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if !u.down() {
+		return true
+	}
+	if u.probing || now.Sub(u.downSince) < interval {
+		return false
+	}
+
+	u.probing = true
+	return true
+}
+
+func (u *upstream) succeeded() {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if u.down() {
+		log.Infof("upstream %v is up", u)
+	}
+
+	u.failures = 0
+	u.downSince = time.Time{}
+	u.probing = false
+}
+
+// canceled ends a query which was canceled before the upstream could answer
+// it; if it was a probe, another may be sent.
+func (u *upstream) canceled() {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	u.probing = false
+}
+
+func (u *upstream) failed(threshold int) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	u.failures++
+	u.probing = false
+
+	if u.down() {
+		// a failed probe; wait another interval before the next
+		u.downSince = time.Now()
+	} else if u.failures >= threshold {
+		log.Warnf("upstream %v is down after %v failures", u, u.failures)
+		u.downSince = time.Now()
+	}
+}
@@ -0,0 +1,221 @@
+package secureoperator
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// mockProvider is a Provider which returns a fixed response or error, after
+// an optional delay
+type mockProvider struct {
+	name   string
+	resp   *DNSResponse
+	err    error
+	delay  time.Duration
+	calls  int32
+	closed int32
+	mutex  sync.Mutex
+}
+
+func (m *mockProvider) String() string {
+	return m.name
+}
+
+func (m *mockProvider) Query(q DNSQuestion) (*DNSResponse, error) {
+	return m.QueryContext(context.Background(), q)
+}
+
+func (m *mockProvider) QueryContext(ctx context.Context, q DNSQuestion) (*DNSResponse, error) {
+	atomic.AddInt32(&m.calls, 1)
+
+	select {
+	case <-time.After(m.delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.resp, m.err
+}
+
+// Set changes the response and error returned by the provider
+func (m *mockProvider) Set(resp *DNSResponse, err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.resp, m.err = resp, err
+}
+
+func (m *mockProvider) Calls() int {
+	return int(atomic.LoadInt32(&m.calls))
+}
+
+func (m *mockProvider) Close() error {
+	atomic.AddInt32(&m.closed, 1)
+	return nil
+}
+
+// Closed returns the number of times the provider was closed
+func (m *mockProvider) Closed() int {
+	return int(atomic.LoadInt32(&m.closed))
+}
+
+var errMockProvider = errors.New("mock provider failure")
+
+func TestFailoverOrder(t *testing.T) {
+	ok := &DNSResponse{ResponseCode: dns.RcodeSuccess}
+
+	first := &mockProvider{name: "first", err: errMockProvider}
+	second := &mockProvider{name: "second", resp: &DNSResponse{ResponseCode: dns.RcodeServerFailure}}
+	third := &mockProvider{name: "third", delay: time.Second, resp: ok}
+	fourth := &mockProvider{name: "fourth", resp: ok}
+
+	f, err := NewFailoverProvider(
+		[]Provider{first, second, third, fourth},
+		&FailoverOptions{Timeout: 20 * time.Millisecond},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := f.Query(DNSQuestion{Name: "example.com.", Type: dns.TypeA})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Upstream != "fourth" {
+		t.Errorf("expected response from fourth provider, got %v", resp)
+	}
+
+	for i, p := range []*mockProvider{first, second, third, fourth} {
+		if p.Calls() != 1 {
+			t.Errorf("%v: expected 1 call, got %v", i, p.Calls())
+		}
+	}
+}
+
+func TestFailoverCircuitBreaker(t *testing.T) {
+	ok := &DNSResponse{ResponseCode: dns.RcodeSuccess}
+
+	first := &mockProvider{name: "first", err: errMockProvider}
+	second := &mockProvider{name: "second", resp: ok}
+
+	f, err := NewFailoverProvider([]Provider{first, second}, &FailoverOptions{
+		FailureThreshold: 2,
+		ProbeInterval:    50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := DNSQuestion{Name: "example.com.", Type: dns.TypeA}
+	for i := 0; i < 5; i++ {
+		if _, err := f.Query(q); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// after reaching the threshold, the first provider should be skipped
+	if c := first.Calls(); c != 2 {
+		t.Errorf("expected first provider to be called twice, got %v", c)
+	}
+
+	// after the probe interval, a probe is sent; on success the provider is
+	// used again
+	time.Sleep(60 * time.Millisecond)
+	first.Set(ok, nil)
+
+	for i := 0; i < 3; i++ {
+		if _, err := f.Query(q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if c := first.Calls(); c != 5 {
+		t.Errorf("expected first provider to be called 5 times, got %v", c)
+	}
+	if c := second.Calls(); c != 5 {
+		t.Errorf("expected second provider to be called 5 times, got %v", c)
+	}
+}
+
+func TestFailoverAllFailed(t *testing.T) {
+	servfail := &DNSResponse{ResponseCode: dns.RcodeServerFailure}
+
+	f, err := NewFailoverProvider([]Provider{
+		&mockProvider{name: "first", err: errMockProvider},
+		&mockProvider{name: "second", resp: servfail},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a SERVFAIL is preferred over an error, if all upstreams fail
+	resp, err := f.Query(DNSQuestion{Name: "example.com.", Type: dns.TypeA})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.ResponseCode != dns.RcodeServerFailure || resp.Upstream != "second" {
+		t.Errorf("expected SERVFAIL response, got %v", resp)
+	}
+
+	f, err = NewFailoverProvider([]Provider{
+		&mockProvider{name: "first", err: errMockProvider},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = f.Query(DNSQuestion{Name: "example.com.", Type: dns.TypeA})
+	if err != ErrAllServersFailed {
+		t.Errorf("expected ErrAllServersFailed, got %v", err)
+	}
+
+	if _, err := NewFailoverProvider(nil, nil); err == nil {
+		t.Error("expected an error with no providers")
+	}
+}
+
+func TestFailoverCanceledProbe(t *testing.T) {
+	ok := &DNSResponse{ResponseCode: dns.RcodeSuccess}
+
+	first := &mockProvider{name: "first", err: errMockProvider}
+	second := &mockProvider{name: "second", resp: ok}
+
+	f, err := NewFailoverProvider([]Provider{first, second}, &FailoverOptions{
+		FailureThreshold: 1,
+		ProbeInterval:    10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := DNSQuestion{Name: "example.com.", Type: dns.TypeA}
+	if _, err := f.Query(q); err != nil {
+		t.Fatal(err)
+	}
+
+	// the probe is canceled before the first provider answers, as when a
+	// RaceProvider cancels a losing query
+	time.Sleep(20 * time.Millisecond)
+	first.Set(ok, nil)
+	first.delay = time.Second
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := f.QueryContext(ctx, q); err == nil {
+		t.Fatal("expected the query to be canceled")
+	}
+
+	// another probe is sent, which succeeds
+	first.delay = 0
+	if resp, err := f.Query(q); err != nil || resp.Upstream != "first" {
+		t.Errorf("expected a probe of the first provider, got %v %v", resp, err)
+	}
+}
@@ -1,14 +1,12 @@
 package secureoperator
 
 import (
-	"crypto/tls"
+	"context"
 	"encoding/json"
 	"fmt"
-	"math/rand"
 	"net"
 	"net/http"
-	"net/url"
-	"time"
+	"strconv"
 )
 
 const (
@@ -130,79 +128,42 @@ func NewGDNSProvider(endpoint string, opts *GDNSOptions) (*GDNSProvider, error)
 		opts = &GDNSOptions{}
 	}
 
-	u, err := url.Parse(endpoint)
+	e, err := newHTTPEndpoint(endpoint, opts.EndpointIPs, opts.DNSServers)
 	if err != nil {
 		return nil, err
 	}
 
 	g := &GDNSProvider{
-		endpoint: endpoint,
-		url:      u,
-		host:     u.Host,
+		endpoint: e,
 		opts:     opts,
+		client:   newHTTPClient(e.url.Hostname()),
 	}
 
-	if len(opts.DNSServers) > 0 {
-		d, err := NewSimpleDNSClient(opts.DNSServers, nil)
-		if err != nil {
-			return nil, err
-		}
-
-		g.dns = d
-	}
-
-	// custom transport for supporting servernames which may not match the url,
-	// in cases where we request directly against an IP
-	tr := &http.Transport{
-		Proxy: http.ProxyFromEnvironment,
-		DialContext: (&net.Dialer{
-			Timeout:   30 * time.Second,
-			KeepAlive: 30 * time.Second,
-			DualStack: true,
-		}).DialContext,
-		MaxIdleConns:          100,
-		IdleConnTimeout:       90 * time.Second,
-		TLSHandshakeTimeout:   10 * time.Second,
-		ExpectContinueTimeout: 1 * time.Second,
-		TLSClientConfig:       &tls.Config{ServerName: g.url.Host},
-	}
-	g.client = &http.Client{Transport: tr}
-
 	return g, nil
 }
 
 // GDNSProvider is the Google DNS-over-HTTPS provider; it implements the
 // Provider interface.
 type GDNSProvider struct {
-	endpoint string
-	url      *url.URL
-	host     string
+	endpoint *httpEndpoint
 	opts     *GDNSOptions
-	dns      *SimpleDNSClient
 	client   *http.Client
 }
 
-func (g GDNSProvider) newRequest(q DNSQuestion) (*http.Request, error) {
-	u := *g.url
-
-	var mustSendHost bool
-
-	if l := len(g.opts.EndpointIPs); l > 0 {
-		// if endpointIPs are provided, use one of those
-		u.Host = g.opts.EndpointIPs[rand.Intn(l)].String()
-		mustSendHost = true
-	} else if g.dns != nil {
-		ips, err := g.dns.LookupIP(u.Host)
-		if err != nil {
-			return nil, err
-		}
+func (g GDNSProvider) String() string {
+	return g.endpoint.url.String()
+}
 
-		if l := len(ips); l > 0 {
-			u.Host = ips[rand.Intn(l)].String()
-		} else {
-			return nil, fmt.Errorf("lookup for Google DNS host %v failed", u.Host)
-		}
-		mustSendHost = true
+// Close closes any idle connections to the endpoint
+func (g GDNSProvider) Close() error {
+	closeIdleConnections(g.client)
+	return nil
+}
+
+func (g GDNSProvider) newRequest(q DNSQuestion) (*http.Request, error) {
+	u, mustSendHost, err := g.endpoint.resolve()
+	if err != nil {
+		return nil, err
 	}
 
 	httpreq, err := http.NewRequest(http.MethodGet, u.String(), nil)
@@ -227,6 +188,13 @@ func (g GDNSProvider) newRequest(q DNSQuestion) (*http.Request, error) {
 	qry.Add("name", q.Name)
 	qry.Add("type", dnsType)
 
+	if q.DNSSECOK {
+		qry.Add("do", "1")
+	}
+	if q.CheckingDisabled {
+		qry.Add("cd", "1")
+	}
+
 	// add additional query parameters
 	if g.opts.QueryParameters != nil {
 		for k, vs := range g.opts.QueryParameters {
@@ -240,6 +208,9 @@ func (g GDNSProvider) newRequest(q DNSQuestion) (*http.Request, error) {
 	if g.opts.UseEDNSsubnetOption {
 		edns = g.opts.EDNSSubnet
 	}
+	if q.ClientSubnet != nil {
+		edns = q.ClientSubnet.String()
+	}
 	if edns != "" {
 		qry.Add("edns_client_subnet", edns)
 	}
@@ -257,7 +228,7 @@ func (g GDNSProvider) newRequest(q DNSQuestion) (*http.Request, error) {
 	}
 
 	if mustSendHost {
-		httpreq.Host = g.url.Host
+		httpreq.Host = g.endpoint.url.Host
 	}
 
 	return httpreq, nil
@@ -265,16 +236,24 @@ func (g GDNSProvider) newRequest(q DNSQuestion) (*http.Request, error) {
 
 // Query sends a DNS question to Google, and returns the response
 func (g GDNSProvider) Query(q DNSQuestion) (*DNSResponse, error) {
+	return g.QueryContext(context.Background(), q)
+}
+
+// QueryContext sends a DNS question to Google, and returns the response; the
+// request is canceled if the context is done before it completes.
+func (g GDNSProvider) QueryContext(ctx context.Context, q DNSQuestion) (*DNSResponse, error) {
 	httpreq, err := g.newRequest(q)
 	if err != nil {
 		return nil, err
 	}
+	httpreq = httpreq.WithContext(ctx)
 
 	httpresp, err := g.client.Do(httpreq)
 	if err != nil {
 		return nil, err
 	}
 	defer httpresp.Body.Close()
+	upstreamHTTPResponses.inc(g.String(), strconv.Itoa(httpresp.StatusCode))
 
 	dnsResp := new(GDNSResponse)
 	decoder := json.NewDecoder(httpresp.Body)
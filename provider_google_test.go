@@ -215,7 +215,7 @@ func TestPadding(t *testing.T) {
 
 	for _, q := range questions {
 		if _, err := g.Query(q); err != nil {
-			t.Errorf(err.Error())
+			t.Error(err)
 		}
 
 	}
@@ -0,0 +1,94 @@
+package secureoperator
+
+import (
+	"crypto/tls"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// httpEndpoint resolves the address of an HTTPS DNS endpoint, shared by the
+// providers which speak to DNS-over-HTTPS services.
+type httpEndpoint struct {
+	url         *url.URL
+	endpointIPs []net.IP
+	dns         *SimpleDNSClient
+}
+
+func newHTTPEndpoint(endpoint string, ips []net.IP, servers Endpoints) (*httpEndpoint, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &httpEndpoint{url: u, endpointIPs: ips}
+
+	if len(servers) > 0 {
+		d, err := NewSimpleDNSClient(servers, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		e.dns = d
+	}
+
+	return e, nil
+}
+
+// resolve returns the URL to make a request against; mustSendHost is true if
+// the host portion of the URL was replaced with an IP, in which case the
+// original host must be sent with the request.
+func (e *httpEndpoint) resolve() (u url.URL, mustSendHost bool, err error) {
+	u = *e.url
+
+	if l := len(e.endpointIPs); l > 0 {
+		// if endpointIPs are provided, use one of those
+		u.Host = e.endpointIPs[rand.Intn(l)].String()
+		mustSendHost = true
+	} else if e.dns != nil {
+		ips, err := e.dns.LookupIP(u.Host)
+		if err != nil {
+			return u, false, err
+		}
+
+		if l := len(ips); l > 0 {
+			u.Host = ips[rand.Intn(l)].String()
+		} else {
+			return u, false, fmt.Errorf("lookup for DNS host %v failed", u.Host)
+		}
+		mustSendHost = true
+	}
+
+	return u, mustSendHost, nil
+}
+
+// closeIdleConnections closes the idle keep-alive connections of a client
+func closeIdleConnections(c *http.Client) {
+	if tr, ok := c.Transport.(*http.Transport); ok {
+		tr.CloseIdleConnections()
+	}
+}
+
+// newHTTPClient creates an http.Client with a custom transport for supporting
+// servernames which may not match the url, in cases where we request directly
+// against an IP
+func newHTTPClient(serverName string) *http.Client {
+	tr := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+			DualStack: true,
+		}).DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		TLSClientConfig:       &tls.Config{ServerName: serverName},
+	}
+
+	return &http.Client{Transport: tr}
+}
@@ -0,0 +1,103 @@
+package secureoperator
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+const defaultRaceTimeout = 5 * time.Second
+
+// RaceOptions is a configuration object for optional RaceProvider
+// configuration
+type RaceOptions struct {
+	// Timeout is the time to wait for any provider to respond. If not
+	// provided, a default of 5 seconds is used.
+	Timeout time.Duration
+}
+
+// NewRaceProvider creates a RaceProvider, which queries all of the given
+// providers at once.
+func NewRaceProvider(providers []Provider, opts *RaceOptions) (*RaceProvider, error) {
+	if len(providers) < 1 {
+		return nil, fmt.Errorf("at least one provider is required")
+	}
+	if opts == nil {
+		opts = &RaceOptions{}
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = defaultRaceTimeout
+	}
+
+	return &RaceProvider{providers: providers, opts: opts}, nil
+}
+
+// RaceProvider is a Provider which sends each question to all of the
+// providers it wraps at the same time; the first successful response which is
+// not a SERVFAIL is returned, and the outstanding queries are canceled.
+type RaceProvider struct {
+	providers []Provider
+	opts      *RaceOptions
+}
+
+// Close closes the wrapped providers
+func (r *RaceProvider) Close() error {
+	return closeProviders(r.providers)
+}
+
+// Query sends a DNS question to all providers, and returns the first
+// successful response
+func (r *RaceProvider) Query(q DNSQuestion) (*DNSResponse, error) {
+	return r.QueryContext(context.Background(), q)
+}
+
+// QueryContext sends a DNS question to all providers, and returns the first
+// successful response
+func (r *RaceProvider) QueryContext(ctx context.Context, q DNSQuestion) (*DNSResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.opts.Timeout)
+	// cancels the queries which are still outstanding once we return
+	defer cancel()
+
+	type result struct {
+		provider Provider
+		resp     *DNSResponse
+		err      error
+	}
+
+	// buffered, so that the losing queries do not block once we've returned
+	results := make(chan result, len(r.providers))
+	for _, p := range r.providers {
+		go func(p Provider) {
+			resp, err := queryContext(ctx, p, q)
+			results <- result{p, fromUpstream(resp, p), err}
+		}(p)
+	}
+
+	var servfail *DNSResponse
+	for range r.providers {
+		select {
+		case res := <-results:
+			if res.err != nil {
+				log.Errorf("race upstream %v failed: %v", providerName(res.provider), res.err)
+				continue
+			}
+			if res.resp.ResponseCode == dns.RcodeServerFailure {
+				servfail = res.resp
+				continue
+			}
+
+			return res.resp, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	if servfail != nil {
+		return servfail, nil
+	}
+
+	return nil, ErrAllServersFailed
+}
@@ -0,0 +1,82 @@
+package secureoperator
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestRaceFastest(t *testing.T) {
+	slow := &DNSResponse{ResponseCode: dns.RcodeSuccess}
+	fast := &DNSResponse{ResponseCode: dns.RcodeSuccess}
+
+	r, err := NewRaceProvider([]Provider{
+		&mockProvider{name: "error", err: errMockProvider},
+		&mockProvider{name: "servfail", resp: &DNSResponse{ResponseCode: dns.RcodeServerFailure}},
+		&mockProvider{name: "slow", delay: time.Second, resp: slow},
+		&mockProvider{name: "fast", delay: 10 * time.Millisecond, resp: fast},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	resp, err := r.Query(DNSQuestion{Name: "example.com.", Type: dns.TypeA})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Upstream != "fast" {
+		t.Errorf("expected the fastest successful response, got %v", resp)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("expected to return before the slow provider, took %v", d)
+	}
+}
+
+func TestRaceAllFailed(t *testing.T) {
+	servfail := &DNSResponse{ResponseCode: dns.RcodeServerFailure}
+
+	r, err := NewRaceProvider([]Provider{
+		&mockProvider{name: "error", err: errMockProvider},
+		&mockProvider{name: "servfail", delay: 10 * time.Millisecond, resp: servfail},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := r.Query(DNSQuestion{Name: "example.com.", Type: dns.TypeA})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.ResponseCode != dns.RcodeServerFailure || resp.Upstream != "servfail" {
+		t.Errorf("expected SERVFAIL response, got %v", resp)
+	}
+
+	r, err = NewRaceProvider([]Provider{
+		&mockProvider{name: "error", err: errMockProvider},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = r.Query(DNSQuestion{Name: "example.com.", Type: dns.TypeA})
+	if err != ErrAllServersFailed {
+		t.Errorf("expected ErrAllServersFailed, got %v", err)
+	}
+}
+
+func TestRaceTimeout(t *testing.T) {
+	r, err := NewRaceProvider([]Provider{
+		&mockProvider{name: "slow", delay: time.Second},
+	}, &RaceOptions{Timeout: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = r.Query(DNSQuestion{Name: "example.com.", Type: dns.TypeA})
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+}
@@ -0,0 +1,88 @@
+package secureoperator
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// NewRoutingProvider creates a RoutingProvider, which sends questions for
+// names within each of the domains of routes to the provider given for it,
+// and all other questions to the default provider.
+func NewRoutingProvider(routes map[string]Provider, provider Provider) (*RoutingProvider, error) {
+	if provider == nil {
+		return nil, fmt.Errorf("a default provider is required")
+	}
+
+	r := &RoutingProvider{routes: make(map[string]Provider), provider: provider}
+	for domain, p := range routes {
+		name := strings.ToLower(dns.Fqdn(domain))
+		if _, ok := dns.IsDomainName(name); !ok {
+			return nil, fmt.Errorf("invalid route domain %v", domain)
+		}
+		if p == nil {
+			return nil, fmt.Errorf("no provider for route domain %v", domain)
+		}
+		r.routes[name] = p
+	}
+
+	return r, nil
+}
+
+// RoutingProvider is a Provider which chooses among the providers it wraps by
+// the name of each question; the provider of the longest domain containing
+// the name is used, e.g. for internal names which must not be sent to a public
+// resolver.
+type RoutingProvider struct {
+	routes   map[string]Provider
+	provider Provider
+}
+
+// Close closes the wrapped providers; each is closed once, though it may be
+// routed to for several domains
+func (r *RoutingProvider) Close() error {
+	seen := map[Provider]bool{r.provider: true}
+	providers := []Provider{r.provider}
+	for _, p := range r.routes {
+		if !seen[p] {
+			seen[p] = true
+			providers = append(providers, p)
+		}
+	}
+
+	return closeProviders(providers)
+}
+
+// Query sends a DNS question to the provider routed to for its name, and
+// returns the response
+func (r *RoutingProvider) Query(q DNSQuestion) (*DNSResponse, error) {
+	return r.QueryContext(context.Background(), q)
+}
+
+// QueryContext sends a DNS question to the provider routed to for its name,
+// and returns the response
+func (r *RoutingProvider) QueryContext(ctx context.Context, q DNSQuestion) (*DNSResponse, error) {
+	p := r.route(q.Name)
+	resp, err := queryContext(ctx, p, q)
+
+	return fromUpstream(resp, p), err
+}
+
+// route returns the provider for a name
+func (r *RoutingProvider) route(name string) Provider {
+	name = strings.ToLower(dns.Fqdn(name))
+
+	// the first match, removing a label at a time, is the longest
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if p, ok := r.routes[name[off:]]; ok {
+			return p
+		}
+	}
+	if p, ok := r.routes["."]; ok {
+		return p
+	}
+
+	return r.provider
+}
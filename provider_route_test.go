@@ -0,0 +1,107 @@
+package secureoperator
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestRoutingProvider(t *testing.T) {
+	def := &mockProvider{name: "default", resp: &DNSResponse{ResponseCode: dns.RcodeSuccess}}
+	corp := &mockProvider{name: "corp", resp: &DNSResponse{ResponseCode: dns.RcodeSuccess}}
+	dev := &mockProvider{name: "dev", resp: &DNSResponse{ResponseCode: dns.RcodeSuccess}}
+	rev := &mockProvider{name: "reverse", resp: &DNSResponse{ResponseCode: dns.RcodeSuccess}}
+
+	r, err := NewRoutingProvider(map[string]Provider{
+		"corp.example.com":      corp,
+		"dev.corp.example.com.": dev,
+		"10.in-addr.arpa":       rev,
+	}, def)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		upstream string
+	}{
+		{"corp.example.com.", "corp"},
+		{"WWW.Corp.Example.com", "corp"},
+		{"a.b.corp.example.com.", "corp"},
+		{"dev.corp.example.com.", "dev"},
+		{"host.dev.corp.example.com.", "dev"},
+		{"notcorp.example.com.", "default"},
+		{"example.com.", "default"},
+		{"1.0.0.10.in-addr.arpa.", "reverse"},
+		{"1.0.0.11.in-addr.arpa.", "default"},
+		{".", "default"},
+	}
+
+	for _, test := range tests {
+		resp, err := r.Query(DNSQuestion{Name: test.name, Type: dns.TypeA})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Upstream != test.upstream {
+			t.Errorf("%v: expected upstream %v, got %v", test.name, test.upstream, resp.Upstream)
+		}
+	}
+}
+
+func TestRoutingProviderRoot(t *testing.T) {
+	def := &mockProvider{name: "default", err: errMockProvider}
+	root := &mockProvider{name: "root", resp: &DNSResponse{ResponseCode: dns.RcodeSuccess}}
+
+	r, err := NewRoutingProvider(map[string]Provider{".": root}, def)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp, err := r.Query(DNSQuestion{Name: "example.com.", Type: dns.TypeA}); err != nil || resp.Upstream != "root" {
+		t.Errorf("expected the root route to be used, got %v %v", resp, err)
+	}
+	if def.Calls() != 0 {
+		t.Error("expected the default provider not to be queried")
+	}
+}
+
+func TestRoutingProviderErrors(t *testing.T) {
+	p := &mockProvider{name: "mock"}
+
+	if _, err := NewRoutingProvider(nil, nil); err == nil {
+		t.Error("expected an error without a default provider")
+	}
+	if _, err := NewRoutingProvider(map[string]Provider{"corp..example.com": p}, p); err == nil {
+		t.Error("expected an error for an invalid domain")
+	}
+	if _, err := NewRoutingProvider(map[string]Provider{"corp.example.com": nil}, p); err == nil {
+		t.Error("expected an error for a route without a provider")
+	}
+}
+
+func TestRoutingProviderClose(t *testing.T) {
+	first := &mockProvider{name: "first"}
+	second := &mockProvider{name: "second"}
+	corp := &mockProvider{name: "corp"}
+
+	f, err := NewFailoverProvider([]Provider{first, second}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewRoutingProvider(map[string]Provider{
+		"corp.example.com": corp,
+		"10.in-addr.arpa":  corp,
+	}, NewInstrumentedProvider(f))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []*mockProvider{first, second, corp} {
+		if p.Closed() != 1 {
+			t.Errorf("%v: expected to be closed once, got %v", p, p.Closed())
+		}
+	}
+}
@@ -136,3 +136,30 @@ func TestDNSRRTypeAAAA(t *testing.T) {
 		t.Errorf("unexpected record data %v", v.AAAA.String())
 	}
 }
+
+func TestNewDNSRR(t *testing.T) {
+	rr, err := dns.NewRR("example.com. 300 IN MX 10 mail.example.com.")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewDNSRR(rr)
+	if r.Name != "example.com." || r.Type != dns.TypeMX || r.TTL != 300 {
+		t.Errorf("unexpected record %v", r)
+	}
+	if r.Data != "10 mail.example.com." {
+		t.Errorf("unexpected record data %v", r.Data)
+	}
+
+	r.TTL = 30
+	out, err := r.RR()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Header().Ttl != 30 {
+		t.Errorf("expected adjusted TTL, got %v", out.Header().Ttl)
+	}
+	if rr.Header().Ttl != 300 {
+		t.Errorf("original record should not have been modified")
+	}
+}
@@ -0,0 +1,438 @@
+package secureoperator
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+// ErrConnectionClosed is returned when a persistent connection to an upstream
+// server was closed while a query was outstanding
+var ErrConnectionClosed = errors.New("connection to server closed")
+
+// ErrQueryTimeout is returned when an upstream server did not respond to a
+// query within the configured timeout
+var ErrQueryTimeout = errors.New("timed out waiting for response")
+
+const (
+	// DefaultDoTPort is the port used for DNS-over-TLS, as specified in RFC 7858
+	DefaultDoTPort = 853
+	// the maximum number of queries which may be outstanding on a connection
+	maxPendingQueries = 1024
+)
+
+// dotIdleTimeout is the time after which a connection on which nothing has
+// been received is closed, so that connections which have silently died are
+// not kept; it is extended to the query timeout, if that is longer.
+var dotIdleTimeout = 30 * time.Second
+
+// DoTOptions is a configuration object for optional DoTProvider configuration
+type DoTOptions struct {
+	// ServerName is the name used to verify the certificate presented by the
+	// servers; it is required, as servers are addressed by IP.
+	ServerName string
+	// Timeout is the time to wait for a response to a query, including any
+	// time spent connecting. If not provided, a default of 10 seconds is used.
+	Timeout time.Duration
+	// Pad specifies if a DNS request should be padded with the EDNS(0) padding
+	// option, to a multiple of 128 bytes.
+	Pad bool
+	// The EDNS subnet to send in the edns0-client-subnet option. If not
+	// specified, the option is not sent and the server determines this
+	// automatically. To specify that the client subnet should not be used, use
+	// the value "0.0.0.0/0".
+	EDNSSubnet string
+	// TLSConfig may be provided for additional control over the TLS client; if
+	// provided, its ServerName is overridden by the ServerName option.
+	TLSConfig *tls.Config
+}
+
+// NewDoTProvider creates a DoTProvider, which sends queries to the given
+// servers. Servers are tried in order; a server is only skipped if a
+// connection to it fails.
+func NewDoTProvider(servers Endpoints, opts *DoTOptions) (*DoTProvider, error) {
+	if len(servers) < 1 {
+		return nil, fmt.Errorf("at least one endpoint server is required")
+	}
+	if opts == nil {
+		opts = &DoTOptions{}
+	}
+	if opts.ServerName == "" {
+		return nil, fmt.Errorf("a TLS server name is required")
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = defaultDNSClientTimeout
+	}
+
+	var subnet *dns.EDNS0_SUBNET
+	if opts.EDNSSubnet != "" {
+		s, err := parseEDNSSubnet(opts.EDNSSubnet)
+		if err != nil {
+			return nil, err
+		}
+		subnet = s
+	}
+
+	tlsConfig := &tls.Config{}
+	if opts.TLSConfig != nil {
+		tlsConfig = opts.TLSConfig.Clone()
+	}
+	tlsConfig.ServerName = opts.ServerName
+
+	return &DoTProvider{
+		servers:   servers,
+		opts:      opts,
+		subnet:    subnet,
+		tlsConfig: tlsConfig,
+		conns:     make(map[string]*dotConn, len(servers)),
+	}, nil
+}
+
+// DoTProvider is a DNS-over-TLS provider, as specified in RFC 7858; it
+// implements the Provider interface.
+//
+// A persistent connection is kept to each server, on which queries are
+// pipelined; connections are re-established as needed if they are closed.
+type DoTProvider struct {
+	servers   Endpoints
+	opts      *DoTOptions
+	subnet    *dns.EDNS0_SUBNET
+	tlsConfig *tls.Config
+
+	mutex sync.Mutex
+	conns map[string]*dotConn
+}
+
+func (d *DoTProvider) String() string {
+	return "tls://" + d.opts.ServerName
+}
+
+// Close closes the connections to the servers, failing any queries which are
+// outstanding on them
+func (d *DoTProvider) Close() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	for key, c := range d.conns {
+		c.close()
+		delete(d.conns, key)
+	}
+
+	return nil
+}
+
+// Query sends a DNS question to the configured servers, and returns the
+// response
+func (d *DoTProvider) Query(q DNSQuestion) (*DNSResponse, error) {
+	return d.QueryContext(context.Background(), q)
+}
+
+// QueryContext sends a DNS question to the configured servers, and returns
+// the response; the configured timeout applies in addition to any deadline of
+// the context.
+func (d *DoTProvider) QueryContext(ctx context.Context, q DNSQuestion) (*DNSResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.opts.Timeout)
+	defer cancel()
+
+	msg, err := newQueryMsg(q, d.subnet, d.opts.Pad)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, server := range d.servers {
+		r, err := d.attempt(ctx, msg, server, len(d.servers)-i)
+		if err == nil {
+			return NewDNSResponse(r), nil
+		}
+		if ctx.Err() != nil {
+			return nil, ErrQueryTimeout
+		}
+
+		log.Errorf("dns-over-tls exchange with %v failed: %v", server, err)
+	}
+
+	return nil, ErrAllServersFailed
+}
+
+// attempt sends a message to a server, allowing it an equal share of the time
+// remaining among the servers yet to be tried, so that a server which hangs
+// does not prevent the others from being tried.
+func (d *DoTProvider) attempt(ctx context.Context, msg *dns.Msg, server Endpoint, remaining int) (*dns.Msg, error) {
+	deadline, _ := ctx.Deadline()
+	share := time.Until(deadline) / time.Duration(remaining)
+
+	ctx, cancel := context.WithTimeout(ctx, share)
+	defer cancel()
+
+	return d.exchange(ctx, msg, server)
+}
+
+// exchange sends a message to a server, retrying once on a new connection if
+// an existing connection was closed, as servers may close idle connections at
+// any time.
+func (d *DoTProvider) exchange(ctx context.Context, msg *dns.Msg, server Endpoint) (*dns.Msg, error) {
+	for attempt := 0; ; attempt++ {
+		c, fresh, err := d.conn(ctx, server)
+		if err != nil {
+			return nil, err
+		}
+
+		r, err := c.exchange(ctx, msg)
+		if err == ErrConnectionClosed && !fresh && attempt == 0 {
+			continue
+		}
+
+		return r, err
+	}
+}
+
+// conn returns the connection for a server, connecting if there is no open
+// connection; fresh is true if the connection was just established.
+func (d *DoTProvider) conn(ctx context.Context, server Endpoint) (c *dotConn, fresh bool, err error) {
+	key := server.String()
+	if c, ok := d.openConn(key); ok {
+		return c, false, nil
+	}
+
+	// dial without holding the lock, so that a slow server does not delay
+	// queries to the others
+	dialer := &net.Dialer{}
+	if deadline, ok := ctx.Deadline(); ok {
+		dialer.Deadline = deadline
+	}
+
+	log.Debugf("dns-over-tls connecting to %v", key)
+	conn, err := tls.DialWithDialer(dialer, "tcp", key, d.tlsConfig)
+	if err != nil {
+		return nil, false, err
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	// another query may have connected in the meantime; use its connection,
+	// so that only one is kept to each server
+	if c, ok := d.conns[key]; ok && !c.isClosed() {
+		conn.Close()
+		return c, false, nil
+	}
+
+	idle := dotIdleTimeout
+	if d.opts.Timeout > idle {
+		idle = d.opts.Timeout
+	}
+	c = newDoTConn(conn, idle)
+	d.conns[key] = c
+
+	return c, true, nil
+}
+
+// openConn returns the connection for a server, if there is one which is open
+func (d *DoTProvider) openConn(key string) (*dotConn, bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	c, ok := d.conns[key]
+	if !ok || c.isClosed() {
+		return nil, false
+	}
+
+	return c, true
+}
+
+func newDoTConn(conn net.Conn, idle time.Duration) *dotConn {
+	c := &dotConn{
+		conn:    conn,
+		idle:    idle,
+		pending: make(map[uint16]chan *dns.Msg),
+	}
+	go c.read()
+
+	return c
+}
+
+// dotConn is a connection on which queries are pipelined; responses are
+// matched to queries by their message ID.
+type dotConn struct {
+	conn  net.Conn
+	idle  time.Duration
+	write sync.Mutex
+
+	mutex   sync.Mutex
+	pending map[uint16]chan *dns.Msg
+	closed  bool
+	// received counts the messages read from the connection
+	received uint64
+}
+
+func (c *dotConn) isClosed() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.closed
+}
+
+// register allocates an unused message ID, and a channel on which its
+// response will be delivered
+func (c *dotConn) register() (uint16, chan *dns.Msg, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closed {
+		return 0, nil, ErrConnectionClosed
+	}
+	if len(c.pending) >= maxPendingQueries {
+		return 0, nil, fmt.Errorf("too many outstanding queries")
+	}
+
+	for {
+		id := uint16(rand.Intn(1 << 16))
+		if _, ok := c.pending[id]; ok {
+			continue
+		}
+
+		ch := make(chan *dns.Msg, 1)
+		c.pending[id] = ch
+
+		return id, ch, nil
+	}
+}
+
+func (c *dotConn) unregister(id uint16) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	delete(c.pending, id)
+}
+
+func (c *dotConn) receivedCount() uint64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.received
+}
+
+func (c *dotConn) exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	id, ch, err := c.register()
+	if err != nil {
+		return nil, err
+	}
+	defer c.unregister(id)
+
+	// copy the message, as its ID is specific to this connection
+	m := msg.Copy()
+	m.Id = id
+
+	buf, err := m.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	// messages are prefixed with their two-byte length, as in DNS over TCP
+	frame := make([]byte, 2+len(buf))
+	binary.BigEndian.PutUint16(frame, uint16(len(buf)))
+	copy(frame[2:], buf)
+
+	// a zero deadline, where the context has none, clears any prior deadline
+	deadline, _ := ctx.Deadline()
+	received := c.receivedCount()
+
+	c.write.Lock()
+	c.conn.SetWriteDeadline(deadline)
+	_, err = c.conn.Write(frame)
+	c.write.Unlock()
+	if err != nil {
+		c.close()
+		return nil, ErrConnectionClosed
+	}
+
+	select {
+	case r, ok := <-ch:
+		if !ok {
+			return nil, ErrConnectionClosed
+		}
+		return r, nil
+	case <-ctx.Done():
+		// if nothing has been received since the query was sent, the
+		// connection may have died without being closed; close it, so that
+		// the next query connects again rather than waiting on it
+		if c.receivedCount() == received {
+			log.Debugf("dns-over-tls closing unresponsive connection to %v", c.conn.RemoteAddr())
+			c.close()
+		}
+		return nil, ErrQueryTimeout
+	}
+}
+
+// read reads responses from the connection until it is closed, or nothing
+// has been received for the idle timeout, delivering each to the query which
+// is waiting for it
+func (c *dotConn) read() {
+	defer c.close()
+
+	var l [2]byte
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(c.idle))
+		if _, err := io.ReadFull(c.conn, l[:]); err != nil {
+			if err != io.EOF {
+				log.Debugf("dns-over-tls read failed: %v", err)
+			}
+			return
+		}
+
+		buf := make([]byte, binary.BigEndian.Uint16(l[:]))
+		if _, err := io.ReadFull(c.conn, buf); err != nil {
+			log.Debugf("dns-over-tls read failed: %v", err)
+			return
+		}
+
+		c.mutex.Lock()
+		c.received++
+		c.mutex.Unlock()
+
+		r := new(dns.Msg)
+		if err := r.Unpack(buf); err != nil {
+			log.Errorf("dns-over-tls failed to unpack response: %v", err)
+			continue
+		}
+
+		c.mutex.Lock()
+		ch, ok := c.pending[r.Id]
+		delete(c.pending, r.Id)
+		c.mutex.Unlock()
+
+		if !ok {
+			log.Debugf("dns-over-tls discarding unexpected response %v", r.Id)
+			continue
+		}
+
+		ch <- r
+	}
+}
+
+// close closes the connection, failing any outstanding queries
+func (c *dotConn) close() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closed {
+		return
+	}
+	c.closed = true
+	c.conn.Close()
+
+	for id, ch := range c.pending {
+		close(ch)
+		delete(c.pending, id)
+	}
+}
@@ -0,0 +1,386 @@
+package secureoperator
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// newDoTTestServer starts a TLS listener which passes each accepted connection
+// to handle; it returns the server's endpoint and a client TLS config which
+// trusts its certificate.
+func newDoTTestServer(t *testing.T, handle func(net.Conn)) (Endpoint, *tls.Config, func()) {
+	// borrow the test certificate from httptest, which is valid for
+	// example.com
+	ts := httptest.NewUnstartedServer(http.NotFoundHandler())
+	ts.StartTLS()
+	certs := ts.TLS.Certificates
+	ts.Close()
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: certs})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go handle(conn)
+		}
+	}()
+
+	leaf, err := x509.ParseCertificate(certs[0].Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	p, _ := strconv.Atoi(port)
+
+	return Endpoint{IP: net.ParseIP(host), Port: uint16(p)},
+		&tls.Config{RootCAs: pool},
+		func() { ln.Close() }
+}
+
+func readTestMsg(conn net.Conn) (*dns.Msg, error) {
+	var l [2]byte
+	if _, err := io.ReadFull(conn, l[:]); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, binary.BigEndian.Uint16(l[:]))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, err
+	}
+
+	m := new(dns.Msg)
+	return m, m.Unpack(buf)
+}
+
+func writeTestReply(conn net.Conn, req *dns.Msg) error {
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.Answer = []dns.RR{
+		&dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+			A:   net.ParseIP("93.184.216.34"),
+		},
+	}
+
+	buf, err := resp.Pack()
+	if err != nil {
+		return err
+	}
+
+	frame := make([]byte, 2+len(buf))
+	binary.BigEndian.PutUint16(frame, uint16(len(buf)))
+	copy(frame[2:], buf)
+
+	_, err = conn.Write(frame)
+	return err
+}
+
+func TestDoTPipelining(t *testing.T) {
+	var mutex sync.Mutex
+	var conns int
+
+	ep, cfg, stop := newDoTTestServer(t, func(conn net.Conn) {
+		defer conn.Close()
+
+		mutex.Lock()
+		conns++
+		mutex.Unlock()
+
+		// read two queries before responding, answering in reverse order; this
+		// only succeeds if queries are pipelined
+		first, err := readTestMsg(conn)
+		if err != nil {
+			return
+		}
+		second, err := readTestMsg(conn)
+		if err != nil {
+			return
+		}
+
+		writeTestReply(conn, second)
+		writeTestReply(conn, first)
+	})
+	defer stop()
+
+	d, err := NewDoTProvider(Endpoints{ep}, &DoTOptions{
+		ServerName: "example.com",
+		TLSConfig:  cfg,
+		Timeout:    5 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// establish the connection before pipelining queries
+	if _, _, err := d.conn(context.Background(), ep); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for _, name := range []string{"one.example.com.", "two.example.com."} {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+
+			resp, err := d.Query(DNSQuestion{Name: name, Type: dns.TypeA})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if a := resp.Answer[0]; a.Name != name {
+				t.Errorf("got answer for %v, expected %v", a.Name, name)
+			}
+		}(name)
+	}
+	wg.Wait()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if conns != 1 {
+		t.Errorf("expected a single connection, got %v", conns)
+	}
+}
+
+func TestDoTReconnect(t *testing.T) {
+	ep, cfg, stop := newDoTTestServer(t, func(conn net.Conn) {
+		// answer a single query, then close the connection
+		defer conn.Close()
+
+		req, err := readTestMsg(conn)
+		if err != nil {
+			return
+		}
+		writeTestReply(conn, req)
+	})
+	defer stop()
+
+	d, err := NewDoTProvider(Endpoints{ep}, &DoTOptions{
+		ServerName: "example.com",
+		TLSConfig:  cfg,
+		Timeout:    5 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := d.Query(DNSQuestion{Name: "example.com", Type: dns.TypeA}); err != nil {
+			t.Errorf("query %v: %v", i, err)
+		}
+	}
+}
+
+func TestDoTTimeout(t *testing.T) {
+	ep, cfg, stop := newDoTTestServer(t, func(conn net.Conn) {
+		// never respond
+		defer conn.Close()
+		io.Copy(ioutil.Discard, conn)
+	})
+	defer stop()
+
+	d, err := NewDoTProvider(Endpoints{ep}, &DoTOptions{
+		ServerName: "example.com",
+		TLSConfig:  cfg,
+		Timeout:    50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = d.Query(DNSQuestion{Name: "example.com", Type: dns.TypeA})
+	if err != ErrQueryTimeout {
+		t.Errorf("expected ErrQueryTimeout, got %v", err)
+	}
+}
+
+func TestDoTTimeoutReconnect(t *testing.T) {
+	var mutex sync.Mutex
+	var conns int
+
+	ep, cfg, stop := newDoTTestServer(t, func(conn net.Conn) {
+		defer conn.Close()
+
+		mutex.Lock()
+		conns++
+		first := conns == 1
+		mutex.Unlock()
+
+		// the first connection never responds, as one which has silently died
+		if first {
+			io.Copy(ioutil.Discard, conn)
+			return
+		}
+		for {
+			req, err := readTestMsg(conn)
+			if err != nil {
+				return
+			}
+			writeTestReply(conn, req)
+		}
+	})
+	defer stop()
+
+	d, err := NewDoTProvider(Endpoints{ep}, &DoTOptions{
+		ServerName: "example.com",
+		TLSConfig:  cfg,
+		Timeout:    200 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := d.Query(DNSQuestion{Name: "example.com", Type: dns.TypeA}); err != ErrQueryTimeout {
+		t.Errorf("expected ErrQueryTimeout, got %v", err)
+	}
+	if _, err := d.Query(DNSQuestion{Name: "example.com", Type: dns.TypeA}); err != nil {
+		t.Errorf("expected a new connection to be used, got %v", err)
+	}
+}
+
+func TestDoTIdleTimeout(t *testing.T) {
+	idle := dotIdleTimeout
+	dotIdleTimeout = 50 * time.Millisecond
+	defer func() { dotIdleTimeout = idle }()
+
+	closed := make(chan struct{})
+	ep, cfg, stop := newDoTTestServer(t, func(conn net.Conn) {
+		defer conn.Close()
+
+		req, err := readTestMsg(conn)
+		if err != nil {
+			return
+		}
+		writeTestReply(conn, req)
+
+		// wait for the client to close the idle connection
+		io.Copy(ioutil.Discard, conn)
+		close(closed)
+	})
+	defer stop()
+
+	d, err := NewDoTProvider(Endpoints{ep}, &DoTOptions{
+		ServerName: "example.com",
+		TLSConfig:  cfg,
+		Timeout:    dotIdleTimeout,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := d.Query(DNSQuestion{Name: "example.com", Type: dns.TypeA}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Error("expected the idle connection to be closed")
+	}
+}
+
+func TestDoTClose(t *testing.T) {
+	closed := make(chan struct{})
+	ep, cfg, stop := newDoTTestServer(t, func(conn net.Conn) {
+		defer conn.Close()
+
+		req, err := readTestMsg(conn)
+		if err != nil {
+			return
+		}
+		writeTestReply(conn, req)
+
+		io.Copy(ioutil.Discard, conn)
+		close(closed)
+	})
+	defer stop()
+
+	d, err := NewDoTProvider(Endpoints{ep}, &DoTOptions{
+		ServerName: "example.com",
+		TLSConfig:  cfg,
+		Timeout:    5 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := d.Query(DNSQuestion{Name: "example.com", Type: dns.TypeA}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Error("expected the connection to be closed")
+	}
+}
+
+func TestDoTOptions(t *testing.T) {
+	if _, err := NewDoTProvider(nil, &DoTOptions{ServerName: "a"}); err == nil {
+		t.Error("expected an error with no servers")
+	}
+
+	ep := Endpoint{IP: net.ParseIP("127.0.0.1"), Port: DefaultDoTPort}
+	if _, err := NewDoTProvider(Endpoints{ep}, nil); err == nil {
+		t.Error("expected an error with no server name")
+	}
+}
+
+func TestDoTFailover(t *testing.T) {
+	hung, cfg, stopHung := newDoTTestServer(t, func(conn net.Conn) {
+		// never respond
+		defer conn.Close()
+		io.Copy(ioutil.Discard, conn)
+	})
+	defer stopHung()
+
+	ep, _, stop := newDoTTestServer(t, func(conn net.Conn) {
+		defer conn.Close()
+		for {
+			req, err := readTestMsg(conn)
+			if err != nil {
+				return
+			}
+			writeTestReply(conn, req)
+		}
+	})
+	defer stop()
+
+	d, err := NewDoTProvider(Endpoints{hung, ep}, &DoTOptions{
+		ServerName: "example.com",
+		TLSConfig:  cfg,
+		Timeout:    time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the hung server must not use up the whole timeout
+	if _, err := d.Query(DNSQuestion{Name: "example.com", Type: dns.TypeA}); err != nil {
+		t.Errorf("expected the second server to answer, got %v", err)
+	}
+}
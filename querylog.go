@@ -0,0 +1,222 @@
+package secureoperator
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// ClientIPFull records the IP address of clients as-is in the query log
+	ClientIPFull = "full"
+	// ClientIPHash records a keyed hash of the IP address of clients in the
+	// query log, so that queries from a client may be correlated without
+	// revealing its address
+	ClientIPHash = "hash"
+	// ClientIPOmit omits the IP address of clients from the query log
+	ClientIPOmit = "omit"
+)
+
+// cache statuses of a query, as recorded in the query log
+const (
+	cacheHit   = "hit"
+	cacheMiss  = "miss"
+	cacheStale = "stale"
+)
+
+// QueryLogOptions is a configuration object for optional QueryLog
+// configuration
+type QueryLogOptions struct {
+	// ClientIPs is how the IP address of clients is recorded; one of
+	// ClientIPFull, ClientIPHash or ClientIPOmit. If not provided, addresses
+	// are recorded in full.
+	ClientIPs string
+	// HashKey is the key with which client IPs are hashed. If not provided, a
+	// random key is used, and hashes may only be correlated for as long as
+	// the process runs.
+	HashKey string
+}
+
+// NewQueryLog creates a QueryLog, which writes to w
+func NewQueryLog(w io.Writer, opts *QueryLogOptions) (*QueryLog, error) {
+	if opts == nil {
+		opts = &QueryLogOptions{}
+	}
+	if opts.ClientIPs == "" {
+		opts.ClientIPs = ClientIPFull
+	}
+
+	l := &QueryLog{w: w, opts: opts}
+
+	switch opts.ClientIPs {
+	case ClientIPFull, ClientIPOmit:
+	case ClientIPHash:
+		l.key = []byte(opts.HashKey)
+		if len(l.key) == 0 {
+			l.key = make([]byte, 32)
+			if _, err := rand.Read(l.key); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, fmt.Errorf("invalid client IP mode %v", opts.ClientIPs)
+	}
+
+	return l, nil
+}
+
+// QueryLog records each query answered by a Handler, as a line of JSON
+type QueryLog struct {
+	opts *QueryLogOptions
+	key  []byte
+
+	mutex sync.Mutex
+	w     io.Writer
+}
+
+// QueryLogEntry is a single record of the query log
+type QueryLogEntry struct {
+	Time time.Time `json:"time"`
+	// Client is the IP address of the client, or its hash
+	Client string `json:"client,omitempty"`
+	// Protocol is the protocol the query was received over; "udp", "tcp",
+	// "tls" or "https"
+	Protocol string `json:"protocol"`
+	Name     string `json:"qname"`
+	Type     string `json:"qtype"`
+	Rcode    string `json:"rcode"`
+	Answers  int    `json:"answers"`
+	// Latency is the time taken to answer the query, in milliseconds
+	Latency float64 `json:"latency_ms"`
+	// Upstream is the name of the provider which answered the query, if it
+	// was not answered from the cache
+	Upstream string `json:"upstream,omitempty"`
+	// Cache is "hit" if the query was answered from the cache, "stale" if it
+	// was answered by a stale response, and "miss" otherwise
+	Cache string `json:"cache,omitempty"`
+	// Blocked is true if the query was for a blocked name
+	Blocked bool `json:"blocked,omitempty"`
+	// Rule is the blocklist or allowlist rule which matched the name, if any,
+	// and List the path of the list it is from
+	Rule string `json:"rule,omitempty"`
+	List string `json:"list,omitempty"`
+	// Local is true if the query was answered from local records
+	Local bool `json:"local,omitempty"`
+}
+
+// Log writes an entry to the query log
+func (l *QueryLog) Log(e *QueryLogEntry) error {
+	buf, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	_, err = l.w.Write(append(buf, '\n'))
+	return err
+}
+
+// client returns the representation of a client IP in the query log
+func (l *QueryLog) client(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+
+	switch l.opts.ClientIPs {
+	case ClientIPOmit:
+		return ""
+	case ClientIPHash:
+		mac := hmac.New(sha256.New, l.key)
+		mac.Write(ip.To16())
+		return hex.EncodeToString(mac.Sum(nil)[:16])
+	}
+
+	return ip.String()
+}
+
+// queryInfo is how a query was answered, recorded by a Handler for the query
+// log
+type queryInfo struct {
+	cache    string
+	upstream string
+	// rule is the blocklist rule which matched the name, if any
+	rule *rule
+	// local is true if the query was answered from local records
+	local bool
+}
+
+// entry creates an entry for a query and its response
+func (l *QueryLog) entry(w dns.ResponseWriter, r, resp *dns.Msg, info *queryInfo, latency time.Duration) *QueryLogEntry {
+	e := &QueryLogEntry{
+		Time:     time.Now().UTC(),
+		Client:   l.client(remoteIP(w.RemoteAddr())),
+		Protocol: protocol(w),
+		Latency:  float64(latency) / float64(time.Millisecond),
+		Upstream: info.upstream,
+		Cache:    info.cache,
+		Local:    info.local,
+	}
+	if info.rule != nil {
+		e.Blocked = !info.rule.allow
+		e.Rule = info.rule.text
+		e.List = info.rule.list
+	}
+	if len(r.Question) > 0 {
+		e.Name = r.Question[0].Name
+		e.Type = dns.Type(r.Question[0].Qtype).String()
+	}
+	if resp != nil {
+		e.Rcode = dns.RcodeToString[resp.Rcode]
+		if e.Rcode == "" {
+			e.Rcode = strconv.Itoa(resp.Rcode)
+		}
+		e.Answers = len(resp.Answer)
+	}
+
+	return e
+}
+
+// protocol returns the protocol a query was received over
+func protocol(w dns.ResponseWriter) string {
+	if _, ok := w.(*httpResponseWriter); ok {
+		return "https"
+	}
+	if _, ok := w.(*tlsResponseWriter); ok {
+		return "tls"
+	}
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		return "udp"
+	}
+
+	return "tcp"
+}
+
+// tlsResponseWriter is a dns.ResponseWriter for a query received over TLS,
+// which is otherwise indistinguishable from one received over TCP
+type tlsResponseWriter struct {
+	dns.ResponseWriter
+}
+
+// recordingResponseWriter is a dns.ResponseWriter which records the message
+// written to it, so that it may be logged
+type recordingResponseWriter struct {
+	dns.ResponseWriter
+	msg *dns.Msg
+}
+
+func (w *recordingResponseWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return w.ResponseWriter.WriteMsg(m)
+}
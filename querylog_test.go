@@ -0,0 +1,125 @@
+package secureoperator
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func queryLogEntries(t *testing.T, buf *bytes.Buffer) []QueryLogEntry {
+	var entries []QueryLogEntry
+
+	dec := json.NewDecoder(buf)
+	for dec.More() {
+		var e QueryLogEntry
+		if err := dec.Decode(&e); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, e)
+	}
+
+	return entries
+}
+
+func TestHandlerQueryLog(t *testing.T) {
+	var buf bytes.Buffer
+	l, err := NewQueryLog(&buf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &mockProvider{name: "mock", resp: testResponse("example.com.", 300)}
+	h := NewHandler(p, &HandlerOptions{Cache: NewResponseCache(nil), QueryLog: l})
+
+	for i := 0; i < 2; i++ {
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		h.Handle(&testResponseWriter{}, req)
+	}
+
+	entries := queryLogEntries(t, &buf)
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %v", len(entries))
+	}
+
+	e := entries[0]
+	if e.Client != "127.0.0.1" || e.Protocol != "udp" {
+		t.Errorf("unexpected client %v over %v", e.Client, e.Protocol)
+	}
+	if e.Name != "example.com." || e.Type != "A" || e.Rcode != "NOERROR" || e.Answers != 1 {
+		t.Errorf("unexpected entry %+v", e)
+	}
+	if e.Upstream != "mock" || e.Cache != cacheMiss {
+		t.Errorf("expected an upstream miss, got %v from %v", e.Cache, e.Upstream)
+	}
+
+	if e := entries[1]; e.Upstream != "" || e.Cache != cacheHit {
+		t.Errorf("expected a cache hit, got %v from %v", e.Cache, e.Upstream)
+	}
+}
+
+func TestHandlerQueryLogTLS(t *testing.T) {
+	var buf bytes.Buffer
+	l, err := NewQueryLog(&buf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &mockProvider{name: "mock", resp: testResponse("example.com.", 300)}
+	h := NewHandler(p, &HandlerOptions{QueryLog: l})
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	w := &testResponseWriter{remote: &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 40000}}
+	h.HandleTLS(w, req)
+
+	if len(w.msgs) != 1 {
+		t.Fatalf("expected a single response, got %v", len(w.msgs))
+	}
+	entries := queryLogEntries(t, &buf)
+	if len(entries) != 1 || entries[0].Protocol != "tls" {
+		t.Errorf("expected a single entry over tls, got %+v", entries)
+	}
+}
+
+func TestQueryLogClientIPs(t *testing.T) {
+	ip := net.ParseIP("192.0.2.1")
+
+	tests := []struct {
+		opts     *QueryLogOptions
+		expected string
+	}{
+		{nil, "192.0.2.1"},
+		{&QueryLogOptions{ClientIPs: ClientIPOmit}, ""},
+	}
+	for _, test := range tests {
+		l, err := NewQueryLog(nil, test.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c := l.client(ip); c != test.expected {
+			t.Errorf("expected %q, got %q", test.expected, c)
+		}
+	}
+
+	a, _ := NewQueryLog(nil, &QueryLogOptions{ClientIPs: ClientIPHash, HashKey: "a"})
+	b, _ := NewQueryLog(nil, &QueryLogOptions{ClientIPs: ClientIPHash, HashKey: "b"})
+
+	hash := a.client(ip)
+	if hash == "" || hash == ip.String() {
+		t.Errorf("expected a hashed address, got %q", hash)
+	}
+	if a.client(ip) != hash {
+		t.Error("expected hashes of an address to be stable")
+	}
+	if b.client(ip) == hash {
+		t.Error("expected hashes to depend on the key")
+	}
+
+	if _, err := NewQueryLog(nil, &QueryLogOptions{ClientIPs: "partial"}); err == nil {
+		t.Error("expected an error for an invalid client IP mode")
+	}
+}
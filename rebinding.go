@@ -0,0 +1,172 @@
+package secureoperator
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+const (
+	// RebindNXDomain answers with NXDOMAIN when every address of an answer
+	// was removed by a RebindingFilter
+	RebindNXDomain = "nxdomain"
+	// RebindNoData answers with NOERROR and no records when every address of
+	// an answer was removed by a RebindingFilter
+	RebindNoData = "nodata"
+)
+
+// privateNetworks are the networks of addresses which are removed from
+// answers for public names: those of RFC 1918, loopback, link-local and unique
+// local addresses, and 0.0.0.0/8, which reaches the local host on many
+// systems. IPv4-mapped IPv6 addresses are matched by the IPv4 networks.
+var privateNetworks = parseNetworks(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+)
+
+func parseNetworks(cidrs ...string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, n)
+	}
+
+	return networks
+}
+
+// RebindingOptions is a configuration object for optional RebindingFilter
+// configuration
+type RebindingOptions struct {
+	// InternalDomains are the domains whose names, and those of their
+	// subdomains, may have private addresses.
+	InternalDomains []string
+	// Mode is how a question is answered when every address of its answer was
+	// removed; one of RebindNXDomain or RebindNoData. If not provided,
+	// RebindNXDomain is used.
+	Mode string
+}
+
+// NewRebindingFilter creates a RebindingFilter
+func NewRebindingFilter(opts *RebindingOptions) (*RebindingFilter, error) {
+	if opts == nil {
+		opts = &RebindingOptions{}
+	}
+	if opts.Mode == "" {
+		opts.Mode = RebindNXDomain
+	}
+	if opts.Mode != RebindNXDomain && opts.Mode != RebindNoData {
+		return nil, fmt.Errorf("invalid rebinding mode %v", opts.Mode)
+	}
+
+	f := &RebindingFilter{opts: opts, internal: make(map[string]bool)}
+	for _, d := range opts.InternalDomains {
+		name := strings.ToLower(dns.Fqdn(d))
+		if _, ok := dns.IsDomainName(name); !ok {
+			return nil, fmt.Errorf("invalid internal domain %v", d)
+		}
+		f.internal[name] = true
+	}
+
+	return f, nil
+}
+
+// RebindingFilter protects clients from DNS rebinding attacks, in which a
+// public name is made to resolve to an address on the client's own network.
+// Private addresses are removed from answers for all names but those of
+// internal domains.
+type RebindingFilter struct {
+	opts     *RebindingOptions
+	internal map[string]bool
+}
+
+// Internal reports whether a name is within one of the internal domains
+func (f *RebindingFilter) Internal(name string) bool {
+	name = strings.ToLower(dns.Fqdn(name))
+
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if f.internal[name[off:]] {
+			return true
+		}
+	}
+
+	return f.internal["."]
+}
+
+// filter returns a response to a question for name with the private
+// addresses of the answer and additional sections removed, unless the name is
+// internal. The response is returned as-is if nothing was removed.
+func (f *RebindingFilter) filter(name string, resp *DNSResponse) *DNSResponse {
+	if f.Internal(name) {
+		return resp
+	}
+
+	answer, removed, remaining := filterPrivate(resp.Answer)
+	extra, removedExtra, _ := filterPrivate(resp.Extra)
+	if removed+removedExtra == 0 {
+		return resp
+	}
+
+	log.Warnf("removed %v private addresses from the answer for %v", removed+removedExtra, name)
+	rebindingFiltered.inc()
+
+	// copy, as the response may be shared with the cache
+	r := *resp
+	r.Answer, r.Extra = answer, extra
+	// the response is no longer as the upstream validated it
+	r.AuthenticatedData = false
+
+	if removed > 0 && remaining == 0 {
+		r.Answer = nil
+		if f.opts.Mode == RebindNXDomain {
+			r.ResponseCode = dns.RcodeNameError
+		}
+	}
+
+	return &r
+}
+
+// filterPrivate returns the records which are not private addresses, along
+// with the number of addresses removed and remaining
+func filterPrivate(rrs []DNSRR) (filtered []DNSRR, removed, remaining int) {
+	for _, rr := range rrs {
+		if rr.Type != dns.TypeA && rr.Type != dns.TypeAAAA {
+			filtered = append(filtered, rr)
+			continue
+		}
+
+		if ip := net.ParseIP(strings.TrimSpace(rr.Data)); ip != nil && isPrivate(ip) {
+			removed++
+			continue
+		}
+
+		remaining++
+		filtered = append(filtered, rr)
+	}
+
+	return filtered, removed, remaining
+}
+
+// isPrivate reports whether an address is within one of the private networks
+func isPrivate(ip net.IP) bool {
+	for _, n := range privateNetworks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,165 @@
+package secureoperator
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestIsPrivate(t *testing.T) {
+	tests := []struct {
+		ip      string
+		private bool
+	}{
+		{"10.1.2.3", true},
+		{"172.16.0.1", true},
+		{"172.32.0.1", false},
+		{"192.168.1.1", true},
+		{"127.0.0.1", true},
+		{"169.254.169.254", true},
+		{"0.0.0.0", true},
+		{"::ffff:192.168.1.1", true},
+		{"::1", true},
+		{"fe80::1", true},
+		{"fd00::1", true},
+		{"93.184.216.34", false},
+		{"2606:2800:220:1::", false},
+	}
+
+	for _, test := range tests {
+		if isPrivate(net.ParseIP(test.ip)) != test.private {
+			t.Errorf("%v: expected private to be %v", test.ip, test.private)
+		}
+	}
+}
+
+func rebindingResponse(name string, addrs ...string) *DNSResponse {
+	resp := &DNSResponse{
+		Question:          []DNSQuestion{{Name: name, Type: dns.TypeA}},
+		AuthenticatedData: true,
+		Answer: []DNSRR{
+			{Name: name, Type: dns.TypeCNAME, TTL: 300, Data: "target.example.net."},
+		},
+	}
+	for _, a := range addrs {
+		resp.Answer = append(resp.Answer, DNSRR{Name: "target.example.net.", Type: dns.TypeA, TTL: 300, Data: a})
+	}
+
+	return resp
+}
+
+func TestRebindingFilter(t *testing.T) {
+	f, err := NewRebindingFilter(&RebindingOptions{InternalDomains: []string{"corp.example.com", "lan."}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// internal names are left as they are
+	resp := rebindingResponse("host.CORP.example.com.", "10.0.0.1")
+	if r := f.filter(resp.Question[0].Name, resp); r != resp {
+		t.Errorf("expected an internal name to be unfiltered, got %+v", r)
+	}
+
+	// public addresses are left as they are
+	resp = rebindingResponse("example.com.", "93.184.216.34")
+	if r := f.filter(resp.Question[0].Name, resp); r != resp {
+		t.Errorf("expected a public address to be unfiltered, got %+v", r)
+	}
+
+	// private addresses are removed, leaving public ones
+	resp = rebindingResponse("example.com.", "93.184.216.34", "192.168.1.1")
+	r := f.filter(resp.Question[0].Name, resp)
+	if len(r.Answer) != 2 || r.Answer[1].Data != "93.184.216.34" || r.ResponseCode != dns.RcodeSuccess {
+		t.Errorf("expected the private address to be removed, got %+v", r)
+	}
+	if r.AuthenticatedData {
+		t.Error("expected a filtered response not to be authenticated")
+	}
+	if len(resp.Answer) != 3 {
+		t.Error("expected the original response to be unmodified")
+	}
+
+	// if every address is removed, the answer is NXDOMAIN
+	r = f.filter("notcorp.example.com.", rebindingResponse("notcorp.example.com.", "10.0.0.1", "fe80::1"))
+	if len(r.Answer) != 0 || r.ResponseCode != dns.RcodeNameError {
+		t.Errorf("expected NXDOMAIN, got %+v", r)
+	}
+}
+
+func TestRebindingFilterNoData(t *testing.T) {
+	f, err := NewRebindingFilter(&RebindingOptions{Mode: RebindNoData})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := f.filter("example.com.", rebindingResponse("example.com.", "127.0.0.1"))
+	if len(r.Answer) != 0 || r.ResponseCode != dns.RcodeSuccess {
+		t.Errorf("expected an empty NOERROR, got %+v", r)
+	}
+
+	if _, err := NewRebindingFilter(&RebindingOptions{Mode: "refused"}); err == nil {
+		t.Error("expected an error for an invalid mode")
+	}
+	if _, err := NewRebindingFilter(&RebindingOptions{InternalDomains: []string{"corp..example.com"}}); err == nil {
+		t.Error("expected an error for an invalid domain")
+	}
+}
+
+func TestHandlerRebinding(t *testing.T) {
+	f, err := NewRebindingFilter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := NewResponseCache(nil)
+
+	resp := rebindingResponse("example.com.", "93.184.216.34", "10.0.0.1")
+	p := &mockProvider{name: "mock", resp: resp}
+	h := NewHandler(p, &HandlerOptions{Rebinding: f, Cache: cache})
+
+	filtered := rebindingFiltered.value()
+
+	for i := 0; i < 2; i++ {
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+
+		w := &testResponseWriter{}
+		h.Handle(w, req)
+
+		answer := w.msgs[0].Answer
+		if len(answer) != 2 || answer[1].(*dns.A).A.String() != "93.184.216.34" {
+			t.Errorf("%v: expected the private address to be removed, got %v", i, answer)
+		}
+	}
+
+	// the second query is answered from the cache, which holds the filtered
+	// response
+	if p.Calls() != 1 {
+		t.Errorf("expected a single query to the provider, got %v", p.Calls())
+	}
+	if v := rebindingFiltered.value(); v != filtered+1 {
+		t.Errorf("expected one filtered answer, got %v", v-filtered)
+	}
+}
+
+func TestHandlerRebindingWithoutQuestion(t *testing.T) {
+	f, err := NewRebindingFilter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// some JSON APIs omit the question from their responses
+	resp := rebindingResponse("example.com.", "192.168.1.1")
+	resp.Question = nil
+	h := NewHandler(&mockProvider{name: "mock", resp: resp}, &HandlerOptions{Rebinding: f})
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+
+	w := &testResponseWriter{}
+	h.Handle(w, req)
+
+	if r := w.msgs[0]; r.Rcode != dns.RcodeNameError || len(r.Answer) != 0 {
+		t.Errorf("expected the private address to be removed, got %v", r)
+	}
+}
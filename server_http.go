@@ -0,0 +1,308 @@
+package secureoperator
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+const (
+	// DefaultDNSMessagePath is the path at which DNS wire-format queries are
+	// served by an HTTPHandler, unless otherwise specified
+	DefaultDNSMessagePath = "/dns-query"
+	// DefaultJSONPath is the path at which JSON queries are served by an
+	// HTTPHandler, unless otherwise specified
+	DefaultJSONPath = "/resolve"
+)
+
+// HTTPHandlerOptions is a configuration object for optional HTTPHandler
+// configuration
+type HTTPHandlerOptions struct {
+	// DNSMessagePath is the path at which DNS wire-format queries are served,
+	// as specified in RFC 8484. If not provided, "/dns-query" is used.
+	DNSMessagePath string
+	// JSONPath is the path at which queries are served in the JSON format of
+	// Google's DNS-over-HTTPS API. If not provided, "/resolve" is used.
+	JSONPath string
+}
+
+// NewHTTPHandler creates an HTTPHandler, which answers queries with the given
+// Handler.
+func NewHTTPHandler(handler *Handler, opts *HTTPHandlerOptions) *HTTPHandler {
+	if opts == nil {
+		opts = &HTTPHandlerOptions{}
+	}
+	if opts.DNSMessagePath == "" {
+		opts.DNSMessagePath = DefaultDNSMessagePath
+	}
+	if opts.JSONPath == "" {
+		opts.JSONPath = DefaultJSONPath
+	}
+
+	return &HTTPHandler{handler: handler, opts: opts}
+}
+
+// HTTPHandler is an http.Handler which serves DNS-over-HTTPS clients; both
+// the DNS wire format of RFC 8484, and the JSON format of Google's API are
+// supported. Queries are answered through a Handler, exactly as those
+// received over plain DNS.
+type HTTPHandler struct {
+	handler *Handler
+	opts    *HTTPHandlerOptions
+}
+
+func (h *HTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case h.opts.DNSMessagePath:
+		h.serveMessage(w, r)
+	case h.opts.JSONPath:
+		h.serveJSON(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// serveMessage answers a query in the DNS wire format, sent as the "dns"
+// parameter of a GET request, or the body of a POST request
+func (h *HTTPHandler) serveMessage(w http.ResponseWriter, r *http.Request) {
+	var (
+		buf []byte
+		err error
+	)
+
+	switch r.Method {
+	case http.MethodGet:
+		// padding is not permitted, but is tolerated
+		param := strings.TrimRight(r.URL.Query().Get("dns"), "=")
+		if param == "" {
+			http.Error(w, "missing dns parameter", http.StatusBadRequest)
+			return
+		}
+		buf, err = base64.RawURLEncoding.DecodeString(param)
+		if err != nil {
+			http.Error(w, "invalid dns parameter", http.StatusBadRequest)
+			return
+		}
+	case http.MethodPost:
+		ct, _, perr := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if perr != nil || ct != DNSMessageContentType {
+			http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		buf, err = ioutil.ReadAll(io.LimitReader(r.Body, dnsMessageMaxBytes+1))
+		if err != nil {
+			http.Error(w, "unable to read request", http.StatusBadRequest)
+			return
+		}
+		if len(buf) > dnsMessageMaxBytes {
+			http.Error(w, "request too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	req := new(dns.Msg)
+	if err := req.Unpack(buf); err != nil {
+		http.Error(w, "invalid dns message", http.StatusBadRequest)
+		return
+	}
+
+	resp, ok := h.handle(w, r, req)
+	if !ok {
+		return
+	}
+
+	out, err := resp.Pack()
+	if err != nil {
+		log.Errorf("unable to pack response: %v", err)
+		http.Error(w, "unable to pack response", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", DNSMessageContentType)
+	setCacheControl(w, resp)
+	w.Write(out)
+}
+
+// serveJSON answers a query given as the "name" and "type" parameters of a
+// GET request, with a response in the JSON format of Google's API
+func (h *HTTPHandler) serveJSON(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	params := r.URL.Query()
+
+	name := params.Get("name")
+	if _, ok := dns.IsDomainName(name); name == "" || !ok {
+		http.Error(w, "invalid name parameter", http.StatusBadRequest)
+		return
+	}
+
+	qtype := dns.TypeA
+	if t := params.Get("type"); t != "" {
+		n, err := strconv.ParseUint(t, 10, 16)
+		if err == nil {
+			qtype = uint16(n)
+		} else if st, ok := dns.StringToType[strings.ToUpper(t)]; ok {
+			qtype = st
+		} else {
+			http.Error(w, "invalid type parameter", http.StatusBadRequest)
+			return
+		}
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(name), qtype)
+	req.CheckingDisabled = jsonBool(params.Get("cd"))
+	if jsonBool(params.Get("do")) {
+		req.SetEdns0(dns.DefaultMsgSize, true)
+	}
+
+	resp, ok := h.handle(w, r, req)
+	if !ok {
+		return
+	}
+
+	g := GDNSResponse{
+		Status: int32(resp.Rcode),
+		TC:     resp.Truncated,
+		RD:     resp.RecursionDesired,
+		RA:     resp.RecursionAvailable,
+		AD:     resp.AuthenticatedData,
+		CD:     resp.CheckingDisabled,
+	}
+	for _, q := range resp.Question {
+		g.Question = append(g.Question, GDNSQuestion{Name: q.Name, Type: q.Qtype})
+	}
+	g.Answer = jsonRRs(resp.Answer)
+	g.Authority = jsonRRs(resp.Ns)
+	g.Additional = jsonRRs(resp.Extra)
+
+	w.Header().Set("Content-Type", "application/json")
+	setCacheControl(w, resp)
+	if err := json.NewEncoder(w).Encode(g); err != nil {
+		log.Errorf("unable to write response: %v", err)
+	}
+}
+
+// handle answers a DNS message with the handler; if no answer could be
+// produced, an error is written, and ok is false.
+func (h *HTTPHandler) handle(w http.ResponseWriter, r *http.Request, req *dns.Msg) (resp *dns.Msg, ok bool) {
+	rw := &httpResponseWriter{
+		remote: httpAddr(r.RemoteAddr),
+	}
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		rw.local = addr
+	}
+
+	h.handler.Handle(rw, req)
+
+	if rw.msg == nil {
+		http.Error(w, "no response", http.StatusInternalServerError)
+		return nil, false
+	}
+
+	return rw.msg, true
+}
+
+// setCacheControl sets the freshness lifetime of an HTTP response to the
+// lowest TTL of the records in the DNS response, as in RFC 8484 section 5.1
+func setCacheControl(w http.ResponseWriter, m *dns.Msg) {
+	ttl := -1
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if t := int(rr.Header().Ttl); ttl < 0 || t < ttl {
+				ttl = t
+			}
+		}
+	}
+
+	if ttl >= 0 {
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%v", ttl))
+	}
+}
+
+func jsonRRs(rrs []dns.RR) GDNSRRs {
+	var g GDNSRRs
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			continue
+		}
+		g = append(g, GDNSRR(NewDNSRR(rr)))
+	}
+
+	return g
+}
+
+func jsonBool(v string) bool {
+	return v == "1" || strings.EqualFold(v, "true")
+}
+
+// httpAddr parses the remote address of an HTTP request
+func httpAddr(addr string) net.Addr {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+	p, _ := strconv.Atoi(port)
+
+	return &net.TCPAddr{IP: net.ParseIP(host), Port: p}
+}
+
+// httpResponseWriter is a dns.ResponseWriter which captures the response
+// written by a Handler, so that it may be returned over HTTP
+type httpResponseWriter struct {
+	local  net.Addr
+	remote net.Addr
+	msg    *dns.Msg
+}
+
+func (w *httpResponseWriter) LocalAddr() net.Addr {
+	if w.local == nil {
+		return &net.TCPAddr{}
+	}
+	return w.local
+}
+
+func (w *httpResponseWriter) RemoteAddr() net.Addr {
+	return w.remote
+}
+
+func (w *httpResponseWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+func (w *httpResponseWriter) Write(b []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return 0, err
+	}
+	w.msg = m
+
+	return len(b), nil
+}
+
+func (w *httpResponseWriter) Close() error        { return nil }
+func (w *httpResponseWriter) TsigStatus() error   { return nil }
+func (w *httpResponseWriter) TsigTimersOnly(bool) {}
+func (w *httpResponseWriter) Hijack()             {}
@@ -0,0 +1,149 @@
+package secureoperator
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func newHTTPTestServer(p Provider) *httptest.Server {
+	return httptest.NewServer(NewHTTPHandler(NewHandler(p, nil), nil))
+}
+
+func readDNSResponse(t *testing.T, resp *http.Response) *dns.Msg {
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %v", resp.Status)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != DNSMessageContentType {
+		t.Fatalf("unexpected content type %v", ct)
+	}
+	if cc := resp.Header.Get("Cache-Control"); cc != "max-age=300" {
+		t.Errorf("unexpected cache control %v", cc)
+	}
+
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := new(dns.Msg)
+	if err := m.Unpack(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	return m
+}
+
+func TestHTTPHandlerMessage(t *testing.T) {
+	ts := newHTTPTestServer(&mockProvider{resp: testResponse("example.com.", 300)})
+	defer ts.Close()
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	req.Id = 0
+	buf, err := req.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get, err := http.Get(ts.URL + "/dns-query?dns=" + base64.RawURLEncoding.EncodeToString(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	post, err := http.Post(ts.URL+"/dns-query", DNSMessageContentType, bytes.NewReader(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, resp := range []*http.Response{get, post} {
+		m := readDNSResponse(t, resp)
+		if m.Id != 0 || !m.Response {
+			t.Errorf("unexpected header %v", m.MsgHdr)
+		}
+		if len(m.Answer) != 1 || m.Answer[0].Header().Name != "example.com." {
+			t.Errorf("unexpected answer %v", m.Answer)
+		}
+	}
+}
+
+func TestHTTPHandlerJSON(t *testing.T) {
+	ts := newHTTPTestServer(&mockProvider{resp: testResponse("example.com.", 300)})
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/resolve?name=example.com&type=a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %v", resp.Status)
+	}
+
+	var g GDNSResponse
+	if err := json.NewDecoder(resp.Body).Decode(&g); err != nil {
+		t.Fatal(err)
+	}
+
+	if g.Status != dns.RcodeSuccess {
+		t.Errorf("unexpected response %+v", g)
+	}
+	if len(g.Question) != 1 || g.Question[0].Name != "example.com." || g.Question[0].Type != dns.TypeA {
+		t.Errorf("unexpected question %v", g.Question)
+	}
+	if len(g.Answer) != 1 || g.Answer[0].Data != "10.0.0.1" || g.Answer[0].TTL != 300 {
+		t.Errorf("unexpected answer %v", g.Answer)
+	}
+}
+
+func TestHTTPHandlerErrors(t *testing.T) {
+	ts := newHTTPTestServer(&mockProvider{resp: testResponse("example.com.", 300)})
+	defer ts.Close()
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		ct     string
+		body   string
+		status int
+	}{
+		{"missing dns parameter", "GET", "/dns-query", "", "", http.StatusBadRequest},
+		{"invalid dns parameter", "GET", "/dns-query?dns=!!", "", "", http.StatusBadRequest},
+		{"invalid message", "POST", "/dns-query", DNSMessageContentType, "nope", http.StatusBadRequest},
+		{"wrong content type", "POST", "/dns-query", "text/plain", "", http.StatusUnsupportedMediaType},
+		{"wrong method", "PUT", "/dns-query", "", "", http.StatusMethodNotAllowed},
+		{"missing name", "GET", "/resolve", "", "", http.StatusBadRequest},
+		{"invalid type", "GET", "/resolve?name=example.com&type=nope", "", "", http.StatusBadRequest},
+		{"unknown path", "GET", "/nope", "", "", http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest(test.method, ts.URL+test.path, strings.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.ct != "" {
+			req.Header.Set("Content-Type", test.ct)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != test.status {
+			t.Errorf("%v: expected status %v, got %v", test.name, test.status, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,797 @@
+package secureoperator
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+// RootTrustAnchors are the DS records of the root zone's key signing keys, as
+// published by IANA; they are used when no trust anchors are configured.
+var RootTrustAnchors = []string{
+	". IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBE683457104237C7F8EC8D",
+	". IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+const (
+	// the longest time validated zone keys are cached for, regardless of TTL
+	maxZoneKeysTTL = time.Hour
+)
+
+// validation is the DNSSEC security status of a response, as in RFC 4035
+// section 4.3
+type validation int
+
+const (
+	bogus validation = iota
+	insecure
+	secure
+)
+
+// ValidatorOptions is a configuration object for optional ValidatingProvider
+// configuration
+type ValidatorOptions struct {
+	// TrustAnchors are DS or DNSKEY records, in presentation format, which are
+	// trusted without validation; chains of trust are validated up to them. If
+	// not provided, RootTrustAnchors are used.
+	TrustAnchors []string
+}
+
+// NewValidatingProvider creates a ValidatingProvider, which validates the
+// responses of the given provider.
+func NewValidatingProvider(provider Provider, opts *ValidatorOptions) (*ValidatingProvider, error) {
+	if opts == nil {
+		opts = &ValidatorOptions{}
+	}
+	if len(opts.TrustAnchors) == 0 {
+		opts.TrustAnchors = RootTrustAnchors
+	}
+
+	v := &ValidatingProvider{
+		provider: provider,
+		opts:     opts,
+		anchors:  make(map[string][]*dns.DS),
+		keys:     make(map[string]zoneKeys),
+		now:      time.Now,
+	}
+
+	for _, a := range opts.TrustAnchors {
+		rr, err := dns.NewRR(a)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trust anchor %q: %v", a, err)
+		}
+
+		var ds *dns.DS
+		switch r := rr.(type) {
+		case *dns.DS:
+			ds = r
+		case *dns.DNSKEY:
+			ds = r.ToDS(dns.SHA256)
+		}
+		if ds == nil {
+			return nil, fmt.Errorf("trust anchor %q is not a DS or DNSKEY record", a)
+		}
+
+		zone := canonicalName(ds.Hdr.Name)
+		v.anchors[zone] = append(v.anchors[zone], ds)
+	}
+
+	return v, nil
+}
+
+// ValidatingProvider is a Provider which performs DNSSEC validation of the
+// responses of another provider, rather than trusting the upstream to do so.
+//
+// Upstream queries are sent with the DO and CD bits set, so that signatures
+// are returned and the upstream does not itself reject bogus data. Signatures
+// are verified with zone keys which are validated up to a trust anchor. Secure
+// responses have the AD bit set; bogus responses are replaced with SERVFAIL.
+// Unsigned responses are only accepted where a zone is provably insecure.
+//
+// If a question has the CD bit set, validation is skipped, and the response
+// is returned unmodified.
+type ValidatingProvider struct {
+	provider Provider
+	opts     *ValidatorOptions
+	anchors  map[string][]*dns.DS
+
+	mutex sync.Mutex
+	keys  map[string]zoneKeys
+	now   func() time.Time
+}
+
+// zoneKeys are the validated keys of a zone, or a record that the zone is
+// provably insecure
+type zoneKeys struct {
+	keys     []*dns.DNSKEY
+	insecure bool
+	expires  time.Time
+}
+
+func (v *ValidatingProvider) String() string {
+	return providerName(v.provider)
+}
+
+// Close closes the wrapped provider
+func (v *ValidatingProvider) Close() error {
+	return closeProvider(v.provider)
+}
+
+// Query sends a DNS question to the wrapped provider, and returns the
+// validated response
+func (v *ValidatingProvider) Query(q DNSQuestion) (*DNSResponse, error) {
+	return v.QueryContext(context.Background(), q)
+}
+
+// QueryContext sends a DNS question to the wrapped provider, and returns the
+// validated response
+func (v *ValidatingProvider) QueryContext(ctx context.Context, q DNSQuestion) (*DNSResponse, error) {
+	uq := q
+	uq.DNSSECOK = true
+	uq.CheckingDisabled = true
+
+	resp, err := queryContext(ctx, v.provider, uq)
+	if err != nil {
+		return nil, err
+	}
+	if q.CheckingDisabled {
+		return stripDNSSEC(resp, q), nil
+	}
+	if resp.ResponseCode != dns.RcodeSuccess && resp.ResponseCode != dns.RcodeNameError {
+		return stripDNSSEC(resp, q), nil
+	}
+
+	status, err := v.validate(ctx, resp)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		log.Warnf("dnssec validation of %v %v failed: %v",
+			q.Name, dns.TypeToString[q.Type], err)
+		errorsTotal.inc(errorDNSSECBogus)
+
+		return &DNSResponse{
+			Question:           resp.Question,
+			RecursionDesired:   resp.RecursionDesired,
+			RecursionAvailable: resp.RecursionAvailable,
+			ResponseCode:       dns.RcodeServerFailure,
+			Upstream:           resp.Upstream,
+		}, nil
+	}
+
+	resp = stripDNSSEC(resp, q)
+	resp.AuthenticatedData = status == secure
+
+	return resp, nil
+}
+
+// validate determines the security status of a response; an error is
+// returned for bogus responses
+func (v *ValidatingProvider) validate(ctx context.Context, resp *DNSResponse) (validation, error) {
+	answer, err := rrsets(resp.Answer)
+	if err != nil {
+		return bogus, err
+	}
+	authority, err := rrsets(resp.Authority)
+	if err != nil {
+		return bogus, err
+	}
+
+	var q DNSQuestion
+	if len(resp.Question) > 0 {
+		q = resp.Question[0]
+	}
+	name := cnameTarget(q.Name, answer)
+	negative := len(resp.Answer) == 0 || resp.ResponseCode == dns.RcodeNameError ||
+		q.Name != "" && !answered(answer, name, q.Type)
+
+	type expansion struct {
+		name   string
+		labels int
+	}
+	var wildcards []expansion
+	for _, s := range answer {
+		if labels, ok := wildcardLabels(s); ok {
+			wildcards = append(wildcards, expansion{s.rrs[0].Header().Name, labels})
+		}
+	}
+
+	sets := answer
+	if negative || len(wildcards) > 0 {
+		// the proof of non-existence of a negative response, or of a name
+		// answered by a wildcard, is in the authority section. Referral NS
+		// records are not signed, and are skipped.
+		for _, s := range authority {
+			if s.rrs[0].Header().Rrtype != dns.TypeNS {
+				sets = append(sets, s)
+			}
+		}
+	}
+	if negative && len(sets) == 0 {
+		// nothing to validate; acceptable only if the name is insecure
+		if q.Name == "" {
+			return bogus, fmt.Errorf("unsigned negative response")
+		}
+		return v.requireInsecure(ctx, q.Name)
+	}
+
+	hasDNAME := false
+	for _, s := range answer {
+		if s.rrs[0].Header().Rrtype == dns.TypeDNAME {
+			hasDNAME = true
+		}
+	}
+
+	status := secure
+	for _, s := range sets {
+		if hasDNAME && len(s.sigs) == 0 && s.rrs[0].Header().Rrtype == dns.TypeCNAME {
+			// CNAMEs synthesized from a DNAME are unsigned; the DNAME is
+			// validated in their place
+			continue
+		}
+
+		st, err := v.verify(ctx, s)
+		if err != nil {
+			return bogus, err
+		}
+		if st < status {
+			status = st
+		}
+	}
+	if status != secure {
+		return status, nil
+	}
+
+	// the signatures are valid; the records must also prove what the
+	// response claims does not exist
+	proof := newDenialProof(authority)
+	for _, w := range wildcards {
+		if err := proof.wildcardAnswer(w.name, w.labels); err != nil {
+			return bogus, err
+		}
+	}
+	if !negative {
+		return secure, nil
+	}
+	if q.Name == "" {
+		return bogus, fmt.Errorf("negative response without a question")
+	}
+	if resp.ResponseCode == dns.RcodeNameError {
+		return proof.nxdomain(name)
+	}
+
+	return proof.nodata(name, q.Type)
+}
+
+// cnameTarget returns the name an answer's records are for: the name of the
+// question, or the target of the last CNAME followed from it
+func cnameTarget(name string, answer []*rrset) string {
+	name = canonicalName(name)
+
+	// each CNAME is followed at most once, in case of a loop
+	for range answer {
+		next := ""
+		for _, s := range answer {
+			h := s.rrs[0].Header()
+			if h.Rrtype == dns.TypeCNAME && canonicalName(h.Name) == name {
+				next = canonicalName(s.rrs[0].(*dns.CNAME).Target)
+			}
+		}
+		if next == "" {
+			break
+		}
+		name = next
+	}
+
+	return name
+}
+
+// answered reports whether an answer has records of a type for name; CNAME
+// and ANY questions are answered by any records
+func answered(answer []*rrset, name string, qtype uint16) bool {
+	if qtype == dns.TypeCNAME || qtype == dns.TypeANY {
+		return len(answer) > 0
+	}
+
+	for _, s := range answer {
+		h := s.rrs[0].Header()
+		if h.Rrtype == qtype && canonicalName(h.Name) == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// requireInsecure returns insecure if name is provably insecure, and an error
+// otherwise
+func (v *ValidatingProvider) requireInsecure(ctx context.Context, name string) (validation, error) {
+	ok, err := v.insecure(ctx, name)
+	if err != nil {
+		return bogus, err
+	}
+	if !ok {
+		return bogus, fmt.Errorf("missing signatures for %v", name)
+	}
+
+	return insecure, nil
+}
+
+// verify validates the signatures of an RRset
+func (v *ValidatingProvider) verify(ctx context.Context, s *rrset) (validation, error) {
+	h := s.rrs[0].Header()
+	name := canonicalName(h.Name)
+
+	if len(s.sigs) == 0 {
+		return v.requireInsecure(ctx, name)
+	}
+
+	lastErr := fmt.Errorf("no valid signature for %v %v",
+		name, dns.TypeToString[h.Rrtype])
+
+	for _, sig := range s.sigs {
+		signer := canonicalName(sig.SignerName)
+		if !dns.IsSubDomain(signer, name) {
+			lastErr = fmt.Errorf("signer %v is not authoritative for %v", signer, name)
+			continue
+		}
+		if h.Rrtype == dns.TypeDS && signer == name {
+			// a DS record is signed by the parent zone
+			lastErr = fmt.Errorf("DS for %v signed by its own zone", name)
+			continue
+		}
+		if !sig.ValidityPeriod(v.now()) {
+			lastErr = fmt.Errorf("signature for %v %v is expired or not yet valid",
+				name, dns.TypeToString[h.Rrtype])
+			continue
+		}
+
+		zk, err := v.zoneKeys(ctx, signer)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if zk.insecure {
+			return insecure, nil
+		}
+
+		for _, k := range zk.keys {
+			if k.KeyTag() != sig.KeyTag || k.Algorithm != sig.Algorithm {
+				continue
+			}
+			if err := sig.Verify(k, s.rrs); err == nil {
+				return secure, nil
+			}
+		}
+	}
+
+	return bogus, lastErr
+}
+
+// zoneKeys returns the validated keys of a zone, querying for them if they
+// are not cached
+func (v *ValidatingProvider) zoneKeys(ctx context.Context, zone string) (zoneKeys, error) {
+	now := v.now()
+
+	v.mutex.Lock()
+	zk, ok := v.keys[zone]
+	v.mutex.Unlock()
+	if ok && now.Before(zk.expires) {
+		return zk, nil
+	}
+
+	ds, ttl, err := v.delegation(ctx, zone)
+	if err != nil {
+		return zoneKeys{}, err
+	}
+	if ds == nil {
+		zk = zoneKeys{insecure: true, expires: now.Add(ttl)}
+		v.setZoneKeys(zone, zk)
+		return zk, nil
+	}
+
+	resp, err := queryContext(ctx, v.provider, DNSQuestion{
+		Name:             zone,
+		Type:             dns.TypeDNSKEY,
+		DNSSECOK:         true,
+		CheckingDisabled: true,
+	})
+	if err != nil {
+		return zoneKeys{}, err
+	}
+
+	sets, err := rrsets(resp.Answer)
+	if err != nil {
+		return zoneKeys{}, err
+	}
+
+	var keySet *rrset
+	for _, s := range sets {
+		h := s.rrs[0].Header()
+		if h.Rrtype == dns.TypeDNSKEY && canonicalName(h.Name) == zone {
+			keySet = s
+		}
+	}
+	if keySet == nil {
+		return zoneKeys{}, fmt.Errorf("no DNSKEY records for %v", zone)
+	}
+
+	// find the keys which match a DS record; one of them must sign the DNSKEY
+	// RRset for the remaining keys to be trusted
+	var (
+		trusted []*dns.DNSKEY
+		keys    []*dns.DNSKEY
+	)
+	for _, rr := range keySet.rrs {
+		k := rr.(*dns.DNSKEY)
+		if k.Flags&dns.ZONE == 0 || k.Flags&dns.REVOKE != 0 {
+			continue
+		}
+		keys = append(keys, k)
+
+		for _, d := range ds {
+			if k.KeyTag() != d.KeyTag || k.Algorithm != d.Algorithm {
+				continue
+			}
+			if kd := k.ToDS(d.DigestType); kd != nil && strings.EqualFold(kd.Digest, d.Digest) {
+				trusted = append(trusted, k)
+				break
+			}
+		}
+	}
+	if len(trusted) == 0 {
+		return zoneKeys{}, fmt.Errorf("no DNSKEY for %v matches its DS records", zone)
+	}
+
+	valid := false
+	for _, sig := range keySet.sigs {
+		if !sig.ValidityPeriod(now) {
+			continue
+		}
+		for _, k := range trusted {
+			if k.KeyTag() == sig.KeyTag && sig.Verify(k, keySet.rrs) == nil {
+				valid = true
+			}
+		}
+	}
+	if !valid {
+		return zoneKeys{}, fmt.Errorf("no valid signature for DNSKEY of %v", zone)
+	}
+
+	if t := rrsetTTL(keySet.rrs); t < ttl {
+		ttl = t
+	}
+
+	zk = zoneKeys{keys: keys, expires: now.Add(ttl)}
+	v.setZoneKeys(zone, zk)
+
+	return zk, nil
+}
+
+func (v *ValidatingProvider) setZoneKeys(zone string, zk zoneKeys) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	v.keys[zone] = zk
+}
+
+// delegation returns the validated DS records for a zone, and the time they
+// may be trusted for; if the zone is provably insecure, no records are
+// returned.
+func (v *ValidatingProvider) delegation(ctx context.Context, zone string) ([]*dns.DS, time.Duration, error) {
+	if ds, ok := v.anchors[zone]; ok {
+		return ds, maxZoneKeysTTL, nil
+	}
+	if zone == "." {
+		return nil, 0, fmt.Errorf("no trust anchor for the root zone")
+	}
+
+	resp, err := queryContext(ctx, v.provider, DNSQuestion{
+		Name:             zone,
+		Type:             dns.TypeDS,
+		DNSSECOK:         true,
+		CheckingDisabled: true,
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	sets, err := rrsets(resp.Answer)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	for _, s := range sets {
+		h := s.rrs[0].Header()
+		if h.Rrtype != dns.TypeDS || canonicalName(h.Name) != zone {
+			continue
+		}
+		if len(s.sigs) == 0 {
+			return nil, 0, fmt.Errorf("missing signatures for DS of %v", zone)
+		}
+
+		st, err := v.verify(ctx, s)
+		if err != nil {
+			return nil, 0, err
+		}
+		ttl := rrsetTTL(s.rrs)
+		if st == insecure {
+			return nil, ttl, nil
+		}
+
+		var ds []*dns.DS
+		for _, rr := range s.rrs {
+			ds = append(ds, rr.(*dns.DS))
+		}
+		return ds, ttl, nil
+	}
+
+	// there is no DS record; the parent must prove it doesn't exist, and that
+	// the zone is delegated
+	ok, err := v.insecureDelegation(ctx, zone, resp)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !ok {
+		return nil, 0, fmt.Errorf("unable to prove %v is insecure", zone)
+	}
+
+	return nil, maxZoneKeysTTL, nil
+}
+
+// insecure reports whether a name is provably insecure, by finding a zone cut
+// above it with proof that no DS record exists
+func (v *ValidatingProvider) insecure(ctx context.Context, name string) (bool, error) {
+	name = canonicalName(name)
+	labels := dns.SplitDomainName(name)
+	now := v.now()
+
+	// walk down from the top level domain, to the name itself
+	for i := len(labels) - 1; i >= 0; i-- {
+		zone := dns.Fqdn(strings.Join(labels[i:], "."))
+
+		v.mutex.Lock()
+		zk, ok := v.keys[zone]
+		v.mutex.Unlock()
+		if ok && now.Before(zk.expires) {
+			if zk.insecure {
+				return true, nil
+			}
+			continue
+		}
+		if _, ok := v.anchors[zone]; ok {
+			continue
+		}
+
+		resp, err := queryContext(ctx, v.provider, DNSQuestion{
+			Name:             zone,
+			Type:             dns.TypeDS,
+			DNSSECOK:         true,
+			CheckingDisabled: true,
+		})
+		if err != nil {
+			return false, err
+		}
+
+		sets, err := rrsets(resp.Answer)
+		if err != nil {
+			return false, err
+		}
+
+		delegated := false
+		for _, s := range sets {
+			h := s.rrs[0].Header()
+			if h.Rrtype != dns.TypeDS || canonicalName(h.Name) != zone {
+				continue
+			}
+			if len(s.sigs) == 0 {
+				return false, fmt.Errorf("missing signatures for DS of %v", zone)
+			}
+
+			st, err := v.verify(ctx, s)
+			if err != nil {
+				return false, err
+			}
+			if st == insecure {
+				return true, nil
+			}
+			delegated = true
+		}
+		if delegated {
+			// a secure delegation; keep looking further down
+			continue
+		}
+
+		ok, err = v.insecureDelegation(ctx, zone, resp)
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			v.setZoneKeys(zone, zoneKeys{
+				insecure: true,
+				expires:  now.Add(maxZoneKeysTTL),
+			})
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// insecureDelegation reports whether a negative response to a DS query for a
+// zone proves that the zone is delegated without a DS record, using the NSEC
+// or NSEC3 records of its parent, as in RFC 4035 section 5.2
+func (v *ValidatingProvider) insecureDelegation(ctx context.Context, zone string, resp *DNSResponse) (bool, error) {
+	sets, err := rrsets(resp.Authority)
+	if err != nil {
+		return false, err
+	}
+
+	for _, s := range sets {
+		h := s.rrs[0].Header()
+		if h.Rrtype != dns.TypeNSEC && h.Rrtype != dns.TypeNSEC3 {
+			continue
+		}
+		if len(s.sigs) == 0 {
+			return false, fmt.Errorf("missing signatures for %v %v",
+				h.Name, dns.TypeToString[h.Rrtype])
+		}
+		for _, sig := range s.sigs {
+			signer := canonicalName(sig.SignerName)
+			if signer == zone || !dns.IsSubDomain(signer, zone) {
+				// the denial must come from a parent zone
+				return false, fmt.Errorf("denial of DS for %v signed by %v", zone, signer)
+			}
+		}
+
+		st, err := v.verify(ctx, s)
+		if err != nil {
+			return false, err
+		}
+		if st == insecure {
+			return true, nil
+		}
+
+		for _, rr := range s.rrs {
+			switch r := rr.(type) {
+			case *dns.NSEC:
+				if canonicalName(r.Hdr.Name) == zone && delegationBitmap(r.TypeBitMap) {
+					return true, nil
+				}
+			case *dns.NSEC3:
+				if r.Match(zone) && delegationBitmap(r.TypeBitMap) {
+					return true, nil
+				}
+				if r.Cover(zone) && r.Flags&1 == 1 {
+					// the zone falls within an opt-out span
+					return true, nil
+				}
+			}
+		}
+	}
+
+	return false, nil
+}
+
+// delegationBitmap reports whether an NSEC or NSEC3 type bitmap is that of an
+// unsigned delegation: NS is present, and DS and SOA are not
+func delegationBitmap(types []uint16) bool {
+	var ns, ds, soa bool
+	for _, t := range types {
+		switch t {
+		case dns.TypeNS:
+			ns = true
+		case dns.TypeDS:
+			ds = true
+		case dns.TypeSOA:
+			soa = true
+		}
+	}
+
+	return ns && !ds && !soa
+}
+
+// rrset is a set of records with the same name and type, and the signatures
+// which cover them
+type rrset struct {
+	rrs  []dns.RR
+	sigs []*dns.RRSIG
+}
+
+// rrsets groups the records of a response section into RRsets
+func rrsets(records []DNSRR) ([]*rrset, error) {
+	type key struct {
+		name  string
+		rtype uint16
+	}
+
+	var sets []*rrset
+	index := make(map[key]*rrset)
+
+	get := func(k key) *rrset {
+		s, ok := index[k]
+		if !ok {
+			s = &rrset{}
+			index[k] = s
+			sets = append(sets, s)
+		}
+		return s
+	}
+
+	for _, r := range records {
+		rr, err := r.RR()
+		if err != nil {
+			return nil, err
+		}
+
+		name := canonicalName(rr.Header().Name)
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			s := get(key{name, sig.TypeCovered})
+			s.sigs = append(s.sigs, sig)
+			continue
+		}
+
+		s := get(key{name, rr.Header().Rrtype})
+		s.rrs = append(s.rrs, rr)
+	}
+
+	// discard signatures which cover no records in the section
+	var result []*rrset
+	for _, s := range sets {
+		if len(s.rrs) > 0 {
+			result = append(result, s)
+		}
+	}
+
+	return result, nil
+}
+
+func rrsetTTL(rrs []dns.RR) time.Duration {
+	ttl := maxZoneKeysTTL
+	for _, rr := range rrs {
+		if t := time.Duration(rr.Header().Ttl) * time.Second; t < ttl {
+			ttl = t
+		}
+	}
+
+	return ttl
+}
+
+// stripDNSSEC removes DNSSEC records from a response, where the question did
+// not request them with the DO bit, and they were not the subject of the
+// question
+func stripDNSSEC(resp *DNSResponse, q DNSQuestion) *DNSResponse {
+	if q.DNSSECOK {
+		return resp
+	}
+
+	filter := func(records []DNSRR) []DNSRR {
+		var result []DNSRR
+		for _, r := range records {
+			switch r.Type {
+			case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+				if r.Type != q.Type {
+					continue
+				}
+			}
+			result = append(result, r)
+		}
+		return result
+	}
+
+	r := *resp
+	r.Answer = filter(resp.Answer)
+	r.Authority = filter(resp.Authority)
+	r.Extra = filter(resp.Extra)
+
+	return &r
+}
+
+func canonicalName(name string) string {
+	return strings.ToLower(dns.Fqdn(name))
+}
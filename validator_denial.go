@@ -0,0 +1,394 @@
+package secureoperator
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// denialProof holds the NSEC and NSEC3 records of a response, with which the
+// non-existence of names and types is proven, as in RFC 4035 section 5.4 and
+// RFC 5155 section 8. Its records must have been verified before use.
+type denialProof struct {
+	nsec  []*dns.NSEC
+	nsec3 []*dns.NSEC3
+}
+
+func newDenialProof(sets []*rrset) *denialProof {
+	d := &denialProof{}
+	for _, s := range sets {
+		for _, rr := range s.rrs {
+			switch r := rr.(type) {
+			case *dns.NSEC:
+				d.nsec = append(d.nsec, r)
+			case *dns.NSEC3:
+				// SHA-1 is the only hash algorithm defined
+				if r.Hash == dns.SHA1 {
+					d.nsec3 = append(d.nsec3, r)
+				}
+			}
+		}
+	}
+
+	return d
+}
+
+// nxdomain proves that a name does not exist, and that no wildcard could have
+// answered for it; insecure is returned if the name is within an NSEC3
+// opt-out span, in which an unsigned delegation may exist.
+func (d *denialProof) nxdomain(name string) (validation, error) {
+	name = canonicalName(name)
+
+	if len(d.nsec) > 0 {
+		if d.nsecMatch(name) != nil {
+			return bogus, fmt.Errorf("NSEC shows %v exists", name)
+		}
+		n := d.nsecCover(name)
+		if n == nil {
+			return bogus, fmt.Errorf("no NSEC proves %v does not exist", name)
+		}
+
+		w := wildcard(nsecClosestEncloser(name, n))
+		if d.nsecMatch(w) != nil || d.nsecCover(w) == nil {
+			return bogus, fmt.Errorf("no NSEC proves %v does not exist", w)
+		}
+
+		return secure, nil
+	}
+
+	if len(d.nsec3) > 0 {
+		if d.nsec3Match(name) != nil {
+			return bogus, fmt.Errorf("NSEC3 shows %v exists", name)
+		}
+		ce, optOut, err := d.nsec3ClosestEncloser(name)
+		if err != nil {
+			return bogus, err
+		}
+
+		w := wildcard(ce)
+		if d.nsec3Cover(w) == nil {
+			return bogus, fmt.Errorf("no NSEC3 proves %v does not exist", w)
+		}
+		if optOut {
+			return insecure, nil
+		}
+
+		return secure, nil
+	}
+
+	return bogus, fmt.Errorf("no NSEC or NSEC3 records prove %v does not exist", name)
+}
+
+// nodata proves that a name has no records of a type, nor a CNAME; either the
+// name exists without them, or it is answered by a wildcard without them.
+// insecure is returned for a DS question within an NSEC3 opt-out span.
+func (d *denialProof) nodata(name string, qtype uint16) (validation, error) {
+	name = canonicalName(name)
+
+	if len(d.nsec) > 0 {
+		if n := d.nsecMatch(name); n != nil {
+			if err := noType(name, n.TypeBitMap, qtype); err != nil {
+				return bogus, err
+			}
+			return secure, nil
+		}
+
+		if n := d.nsecCover(name); n != nil {
+			// an empty non-terminal, whose descendants exist
+			if next := canonicalName(n.NextDomain); next != name && dns.IsSubDomain(name, next) {
+				return secure, nil
+			}
+
+			w := wildcard(nsecClosestEncloser(name, n))
+			if n := d.nsecMatch(w); n != nil {
+				if err := noType(w, n.TypeBitMap, qtype); err != nil {
+					return bogus, err
+				}
+				return secure, nil
+			}
+		}
+
+		return bogus, fmt.Errorf("no NSEC proves %v has no %v records",
+			name, dns.TypeToString[qtype])
+	}
+
+	if len(d.nsec3) > 0 {
+		if n := d.nsec3Match(name); n != nil {
+			if err := noType(name, n.TypeBitMap, qtype); err != nil {
+				return bogus, err
+			}
+			return secure, nil
+		}
+
+		ce, optOut, err := d.nsec3ClosestEncloser(name)
+		if err != nil {
+			return bogus, err
+		}
+		if qtype == dns.TypeDS && optOut {
+			return insecure, nil
+		}
+
+		w := wildcard(ce)
+		if n := d.nsec3Match(w); n != nil {
+			if err := noType(w, n.TypeBitMap, qtype); err != nil {
+				return bogus, err
+			}
+			return secure, nil
+		}
+
+		return bogus, fmt.Errorf("no NSEC3 proves %v has no %v records",
+			name, dns.TypeToString[qtype])
+	}
+
+	return bogus, fmt.Errorf("no NSEC or NSEC3 records prove %v has no %v records",
+		name, dns.TypeToString[qtype])
+}
+
+// wildcardAnswer proves that an answer synthesized from a wildcard of the
+// given number of labels was not for a name which exists, nor for one closer
+// to it than the wildcard.
+func (d *denialProof) wildcardAnswer(name string, labels int) error {
+	name = canonicalName(name)
+	ce := ancestor(name, labels)
+
+	if n := d.nsecCover(name); n != nil {
+		if nsecClosestEncloser(name, n) != ce {
+			return fmt.Errorf("NSEC shows %v is not answered by *.%v", name, ce)
+		}
+		return nil
+	}
+
+	if d.nsec3Cover(ancestor(name, labels+1)) != nil {
+		return nil
+	}
+
+	return fmt.Errorf("no NSEC or NSEC3 proves %v is not an exact match for the wildcard *.%v",
+		name, ce)
+}
+
+// nsecMatch returns the NSEC record whose owner is name
+func (d *denialProof) nsecMatch(name string) *dns.NSEC {
+	for _, n := range d.nsec {
+		if canonicalName(n.Hdr.Name) == name {
+			return n
+		}
+	}
+
+	return nil
+}
+
+// nsecCover returns an NSEC record which proves a name does not exist
+func (d *denialProof) nsecCover(name string) *dns.NSEC {
+	for _, n := range d.nsec {
+		owner, next := canonicalName(n.Hdr.Name), canonicalName(n.NextDomain)
+		if owner == name {
+			continue
+		}
+
+		covered := false
+		if canonicalCompare(owner, next) < 0 {
+			covered = canonicalCompare(owner, name) < 0 && canonicalCompare(name, next) < 0
+		} else {
+			// the last NSEC of a zone, whose next name is the apex
+			covered = canonicalCompare(owner, name) < 0 && dns.IsSubDomain(next, name)
+		}
+		if !covered {
+			continue
+		}
+
+		// names beneath a delegation or a DNAME are not those of the zone
+		if dns.IsSubDomain(owner, name) && (zoneCut(n.TypeBitMap) || hasType(n.TypeBitMap, dns.TypeDNAME)) {
+			continue
+		}
+
+		return n
+	}
+
+	return nil
+}
+
+// nsec3Match returns the NSEC3 record whose owner is the hash of name
+func (d *denialProof) nsec3Match(name string) *dns.NSEC3 {
+	for _, n := range d.nsec3 {
+		if n.Match(name) {
+			return n
+		}
+	}
+
+	return nil
+}
+
+// nsec3Cover returns an NSEC3 record which proves a name does not exist
+func (d *denialProof) nsec3Cover(name string) *dns.NSEC3 {
+	for _, n := range d.nsec3 {
+		if n.Cover(name) {
+			return n
+		}
+	}
+
+	return nil
+}
+
+// nsec3ClosestEncloser finds the closest encloser of a name which does not
+// exist: its longest existing ancestor, as in RFC 5155 section 8.3. optOut is
+// true if the proof that the next closer name does not exist is an opt-out
+// span.
+func (d *denialProof) nsec3ClosestEncloser(name string) (ce string, optOut bool, err error) {
+	for labels := dns.CountLabel(name) - 1; labels >= 0; labels-- {
+		ce := ancestor(name, labels)
+		n := d.nsec3Match(ce)
+		if n == nil {
+			continue
+		}
+		if zoneCut(n.TypeBitMap) || hasType(n.TypeBitMap, dns.TypeDNAME) {
+			return "", false, fmt.Errorf("closest encloser %v of %v is a delegation or DNAME", ce, name)
+		}
+
+		next := ancestor(name, labels+1)
+		c := d.nsec3Cover(next)
+		if c == nil {
+			return "", false, fmt.Errorf("no NSEC3 proves %v does not exist", next)
+		}
+
+		return ce, c.Flags&1 == 1, nil
+	}
+
+	return "", false, fmt.Errorf("no NSEC3 proves a closest encloser of %v", name)
+}
+
+// nsecClosestEncloser returns the longest ancestor of a name which an NSEC
+// record covering it shows to exist
+func nsecClosestEncloser(name string, n *dns.NSEC) string {
+	labels := dns.CompareDomainName(name, canonicalName(n.Hdr.Name))
+	if l := dns.CompareDomainName(name, canonicalName(n.NextDomain)); l > labels {
+		labels = l
+	}
+
+	return ancestor(name, labels)
+}
+
+// noType returns an error unless the type bitmap of a name shows it has
+// neither records of qtype nor a CNAME
+func noType(name string, types []uint16, qtype uint16) error {
+	if hasType(types, qtype) || hasType(types, dns.TypeCNAME) {
+		return fmt.Errorf("denial of %v %v shows it exists", name, dns.TypeToString[qtype])
+	}
+	// a DS record is denied by the parent of a zone cut, and all others by
+	// the child
+	if qtype == dns.TypeDS && hasType(types, dns.TypeSOA) {
+		return fmt.Errorf("denial of DS for %v is from its own zone", name)
+	}
+	if qtype != dns.TypeDS && zoneCut(types) {
+		return fmt.Errorf("denial of %v %v is from its parent zone", name, dns.TypeToString[qtype])
+	}
+
+	return nil
+}
+
+// zoneCut reports whether a type bitmap is that of a delegation from a parent
+// zone: NS is present, and SOA is not
+func zoneCut(types []uint16) bool {
+	return hasType(types, dns.TypeNS) && !hasType(types, dns.TypeSOA)
+}
+
+func hasType(types []uint16, t uint16) bool {
+	for _, tt := range types {
+		if tt == t {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ancestor returns the ancestor of a name with the given number of labels
+func ancestor(name string, labels int) string {
+	idx := dns.Split(name)
+	if labels <= 0 {
+		return "."
+	}
+	if labels >= len(idx) {
+		return name
+	}
+
+	return name[idx[len(idx)-labels]:]
+}
+
+// wildcard returns the wildcard name immediately below a name
+func wildcard(name string) string {
+	if name == "." {
+		return "*."
+	}
+
+	return "*." + name
+}
+
+// wildcardLabels returns the number of labels of the wildcard an RRset was
+// synthesized from, as given by its signatures; ok is false if it was not.
+func wildcardLabels(s *rrset) (labels int, ok bool) {
+	name := canonicalName(s.rrs[0].Header().Name)
+	n := dns.CountLabel(name)
+	if strings.HasPrefix(name, "*.") {
+		n--
+	}
+
+	for _, sig := range s.sigs {
+		if int(sig.Labels) < n {
+			return int(sig.Labels), true
+		}
+	}
+
+	return 0, false
+}
+
+// canonicalCompare compares two names in the canonical order of RFC 4034
+// section 6.1, returning -1, 0 or 1 as a sorts before, with or after b
+func canonicalCompare(a, b string) int {
+	la, lb := dns.SplitDomainName(a), dns.SplitDomainName(b)
+
+	for i := 1; i <= len(la) && i <= len(lb); i++ {
+		c := bytes.Compare(labelBytes(la[len(la)-i]), labelBytes(lb[len(lb)-i]))
+		if c != 0 {
+			return c
+		}
+	}
+
+	switch {
+	case len(la) < len(lb):
+		return -1
+	case len(la) > len(lb):
+		return 1
+	}
+
+	return 0
+}
+
+// labelBytes returns the octets of a label in presentation format, with any
+// escapes replaced and upper case letters made lower case
+func labelBytes(label string) []byte {
+	var b []byte
+	for i := 0; i < len(label); i++ {
+		c := label[i]
+		if c == '\\' && i+1 < len(label) {
+			if i+3 < len(label) && isDigit(label[i+1]) && isDigit(label[i+2]) && isDigit(label[i+3]) {
+				c = (label[i+1]-'0')*100 + (label[i+2]-'0')*10 + (label[i+3] - '0')
+				i += 3
+			} else {
+				c = label[i+1]
+				i++
+			}
+		}
+		if 'A' <= c && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		b = append(b, c)
+	}
+
+	return b
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
@@ -0,0 +1,426 @@
+package secureoperator
+
+import (
+	"crypto"
+	"net"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// testZone is a signed zone, for building test responses
+type testZone struct {
+	key  *dns.DNSKEY
+	priv crypto.Signer
+}
+
+func newTestZone(t *testing.T, name string) *testZone {
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: name, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     dns.ZONE | dns.SEP,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testZone{key: key, priv: priv.(crypto.Signer)}
+}
+
+// sign returns the records of an RRset, followed by its signature
+func (z *testZone) sign(t *testing.T, rrs ...dns.RR) []dns.RR {
+	h := rrs[0].Header()
+	sig := &dns.RRSIG{
+		Hdr:         dns.RR_Header{Name: h.Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: h.Ttl},
+		TypeCovered: h.Rrtype,
+		Algorithm:   z.key.Algorithm,
+		Labels:      uint8(dns.CountLabel(h.Name)),
+		OrigTtl:     h.Ttl,
+		Expiration:  uint32(time.Now().Add(time.Hour).Unix()),
+		Inception:   uint32(time.Now().Add(-time.Hour).Unix()),
+		KeyTag:      z.key.KeyTag(),
+		SignerName:  z.key.Hdr.Name,
+	}
+	if err := sig.Sign(z.priv, rrs); err != nil {
+		t.Fatal(err)
+	}
+
+	return append(rrs, sig)
+}
+
+func (z *testZone) ds() *dns.DS {
+	return z.key.ToDS(dns.SHA256)
+}
+
+// dnssecTestProvider answers questions from a fixed set of responses, and
+// with NXDOMAIN otherwise
+type dnssecTestProvider struct {
+	t         *testing.T
+	responses map[CacheKey]*dns.Msg
+}
+
+func (p *dnssecTestProvider) set(name string, qtype uint16, answer []dns.RR, ns []dns.RR) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	m.Response = true
+	m.Answer = answer
+	m.Ns = ns
+
+	p.responses[NewCacheKey(m.Question[0])] = m
+
+	return m
+}
+
+func (p *dnssecTestProvider) Query(q DNSQuestion) (*DNSResponse, error) {
+	if !q.DNSSECOK || !q.CheckingDisabled {
+		p.t.Errorf("expected DO and CD bits in query for %v", q.Name)
+	}
+
+	key := NewCacheKey(dns.Question{Name: dns.Fqdn(q.Name), Qtype: q.Type, Qclass: dns.ClassINET})
+	if m, ok := p.responses[key]; ok {
+		return NewDNSResponse(m), nil
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(q.Name), q.Type)
+	m.Rcode = dns.RcodeNameError
+
+	return NewDNSResponse(m), nil
+}
+
+func testA(name, ip string) dns.RR {
+	return &dns.A{
+		Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+		A:   net.ParseIP(ip),
+	}
+}
+
+// sortTypes sorts the types of a type bitmap, which must be in order
+func sortTypes(types []uint16) []uint16 {
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	return types
+}
+
+func testNSEC(name, next string, types ...uint16) dns.RR {
+	return &dns.NSEC{
+		Hdr:        dns.RR_Header{Name: name, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 300},
+		NextDomain: next,
+		TypeBitMap: sortTypes(types),
+	}
+}
+
+func testSOA(zone string) dns.RR {
+	return &dns.SOA{
+		Hdr:    dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 300},
+		Ns:     "ns." + zone,
+		Mbox:   "hostmaster." + zone,
+		Serial: 1,
+		Minttl: 300,
+	}
+}
+
+// testNSEC3Chain returns the signed NSEC3 records of a zone whose names have
+// the given types
+func testNSEC3Chain(t *testing.T, z *testZone, names map[string][]uint16) []dns.RR {
+	var hashes []string
+	types := make(map[string][]uint16)
+	for name, ts := range names {
+		h := dns.HashName(name, dns.SHA1, 0, "")
+		hashes = append(hashes, h)
+		types[h] = sortTypes(ts)
+	}
+	sort.Strings(hashes)
+
+	var rrs []dns.RR
+	for i, h := range hashes {
+		rrs = append(rrs, z.sign(t, &dns.NSEC3{
+			Hdr:        dns.RR_Header{Name: h + "." + z.key.Hdr.Name, Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: 300},
+			Hash:       dns.SHA1,
+			HashLength: 20,
+			NextDomain: hashes[(i+1)%len(hashes)],
+			TypeBitMap: types[h],
+		})...)
+	}
+
+	return rrs
+}
+
+// newDNSSECTestProvider builds a signed hierarchy of the root, com.,
+// example.com. and an unsigned delegation to insecure.com.
+func newDNSSECTestProvider(t *testing.T) (*dnssecTestProvider, *testZone) {
+	root := newTestZone(t, ".")
+	com := newTestZone(t, "com.")
+	example := newTestZone(t, "example.com.")
+
+	p := &dnssecTestProvider{t: t, responses: make(map[CacheKey]*dns.Msg)}
+
+	p.set(".", dns.TypeDNSKEY, root.sign(t, root.key), nil)
+	p.set("com.", dns.TypeDS, root.sign(t, com.ds()), nil)
+	p.set("com.", dns.TypeDNSKEY, com.sign(t, com.key), nil)
+	p.set("example.com.", dns.TypeDS, com.sign(t, example.ds()), nil)
+	p.set("example.com.", dns.TypeDNSKEY, example.sign(t, example.key), nil)
+	p.set("insecure.com.", dns.TypeDS, nil, com.sign(t,
+		testNSEC("insecure.com.", "z.com.", dns.TypeNS, dns.TypeRRSIG, dns.TypeNSEC),
+	))
+	p.set("unsigned.example.com.", dns.TypeDS, nil, example.sign(t,
+		testNSEC("unsigned.example.com.", "www.example.com.", dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC),
+	))
+
+	p.set("www.example.com.", dns.TypeA, example.sign(t, testA("www.example.com.", "192.0.2.1")), nil)
+	p.set("www.insecure.com.", dns.TypeA, []dns.RR{testA("www.insecure.com.", "192.0.2.2")}, nil)
+	p.set("unsigned.example.com.", dns.TypeA, []dns.RR{testA("unsigned.example.com.", "192.0.2.3")}, nil)
+
+	// a signature over different data than is returned
+	forged := example.sign(t, testA("forged.example.com.", "192.0.2.4"))
+	forged[0] = testA("forged.example.com.", "192.0.2.5")
+	p.set("forged.example.com.", dns.TypeA, forged, nil)
+
+	addDenialResponses(t, p, com, example)
+
+	return p, root
+}
+
+// addDenialResponses adds negative and wildcard responses for example.com.,
+// which is signed with NSEC, and n3.com., which is signed with NSEC3; both
+// those with valid proofs and those without.
+func addDenialResponses(t *testing.T, p *dnssecTestProvider, com, example *testZone) {
+	soa := example.sign(t, testSOA("example.com."))
+	apex := example.sign(t, testNSEC("example.com.", "unsigned.example.com.",
+		dns.TypeSOA, dns.TypeNS, dns.TypeDNSKEY, dns.TypeRRSIG, dns.TypeNSEC))
+	www := func(types ...uint16) []dns.RR {
+		return example.sign(t, testNSEC("www.example.com.", "example.com.", types...))
+	}
+
+	// the apex NSEC covers nx.example.com. and *.example.com.
+	p.set("nx.example.com.", dns.TypeA, nil, append(soa, apex...)).Rcode = dns.RcodeNameError
+	p.set("www.example.com.", dns.TypeMX, nil, soa).Rcode = dns.RcodeNameError
+	p.set("www.example.com.", dns.TypeTXT, nil, append(soa, apex...)).Rcode = dns.RcodeNameError
+
+	p.set("www.example.com.", dns.TypeAAAA, nil, append(soa, www(dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC)...))
+	p.set("www.example.com.", dns.TypeSRV, nil, soa)
+	p.set("www.example.com.", dns.TypeHINFO, nil, append(soa, www(dns.TypeA, dns.TypeHINFO, dns.TypeRRSIG, dns.TypeNSEC)...))
+
+	// wild.example.com. is an empty non-terminal above *.wild.example.com.
+	p.set("wild.example.com.", dns.TypeA, nil, append(soa, example.sign(t,
+		testNSEC("unsigned.example.com.", "*.wild.example.com.", dns.TypeNS, dns.TypeRRSIG, dns.TypeNSEC),
+	)...))
+
+	expand := func(name string) []dns.RR {
+		rrs := example.sign(t, testA("*.wild.example.com.", "192.0.2.6"))
+		for _, rr := range rrs {
+			rr.Header().Name = name
+		}
+		return rrs
+	}
+	p.set("a.wild.example.com.", dns.TypeA, expand("a.wild.example.com."), example.sign(t,
+		testNSEC("*.wild.example.com.", "www.example.com.", dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC),
+	))
+	p.set("b.wild.example.com.", dns.TypeA, expand("b.wild.example.com."), nil)
+
+	n3 := newTestZone(t, "n3.com.")
+	p.set("n3.com.", dns.TypeDS, com.sign(t, n3.ds()), nil)
+	p.set("n3.com.", dns.TypeDNSKEY, n3.sign(t, n3.key), nil)
+
+	n3soa := n3.sign(t, testSOA("n3.com."))
+	chain := testNSEC3Chain(t, n3, map[string][]uint16{
+		"n3.com.":     {dns.TypeSOA, dns.TypeNS, dns.TypeDNSKEY, dns.TypeRRSIG, dns.TypeNSEC3PARAM},
+		"www.n3.com.": {dns.TypeA, dns.TypeRRSIG},
+	})
+	p.set("nx.n3.com.", dns.TypeA, nil, append(n3soa, chain...)).Rcode = dns.RcodeNameError
+	p.set("www.n3.com.", dns.TypeMX, nil, append(n3soa, chain...)).Rcode = dns.RcodeNameError
+	p.set("www.n3.com.", dns.TypeAAAA, nil, append(n3soa, chain...))
+	p.set("www.n3.com.", dns.TypeTXT, nil, n3soa)
+}
+
+func TestValidatingProvider(t *testing.T) {
+	p, root := newDNSSECTestProvider(t)
+
+	v, err := NewValidatingProvider(p, &ValidatorOptions{
+		TrustAnchors: []string{root.ds().String()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		rcode int
+		ad    bool
+	}{
+		{"www.example.com.", dns.RcodeSuccess, true},
+		{"www.insecure.com.", dns.RcodeSuccess, false},
+		{"unsigned.example.com.", dns.RcodeServerFailure, false},
+		{"forged.example.com.", dns.RcodeServerFailure, false},
+	}
+
+	for _, test := range tests {
+		resp, err := v.Query(DNSQuestion{Name: test.name, Type: dns.TypeA})
+		if err != nil {
+			t.Errorf("%v: %v", test.name, err)
+			continue
+		}
+		if resp.ResponseCode != test.rcode {
+			t.Errorf("%v: expected rcode %v, got %v", test.name,
+				dns.RcodeToString[test.rcode], dns.RcodeToString[resp.ResponseCode])
+		}
+		if resp.AuthenticatedData != test.ad {
+			t.Errorf("%v: expected AD %v, got %v", test.name, test.ad, resp.AuthenticatedData)
+		}
+		for _, rr := range resp.Answer {
+			if rr.Type == dns.TypeRRSIG {
+				t.Errorf("%v: expected signatures to be stripped", test.name)
+			}
+		}
+	}
+}
+
+func TestValidatingProviderDNSSECOK(t *testing.T) {
+	p, root := newDNSSECTestProvider(t)
+
+	v, err := NewValidatingProvider(p, &ValidatorOptions{
+		TrustAnchors: []string{root.ds().String()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := v.Query(DNSQuestion{Name: "www.example.com.", Type: dns.TypeA, DNSSECOK: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answer) != 2 || resp.Answer[1].Type != dns.TypeRRSIG {
+		t.Errorf("expected signatures to be returned, got %v", resp.Answer)
+	}
+
+	// checking disabled returns bogus data as-is
+	resp, err = v.Query(DNSQuestion{Name: "forged.example.com.", Type: dns.TypeA, CheckingDisabled: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.ResponseCode != dns.RcodeSuccess || resp.AuthenticatedData {
+		t.Errorf("expected unvalidated response, got %v", resp)
+	}
+}
+
+func TestValidatingProviderDenial(t *testing.T) {
+	p, root := newDNSSECTestProvider(t)
+
+	v, err := NewValidatingProvider(p, &ValidatorOptions{
+		TrustAnchors: []string{root.ds().String()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		qtype uint16
+		rcode int
+		ad    bool
+	}{
+		{"nx.example.com.", dns.TypeA, dns.RcodeNameError, true},
+		// NXDOMAIN with only a signed SOA
+		{"www.example.com.", dns.TypeMX, dns.RcodeServerFailure, false},
+		// NXDOMAIN with an NSEC which doesn't cover the name
+		{"www.example.com.", dns.TypeTXT, dns.RcodeServerFailure, false},
+
+		{"www.example.com.", dns.TypeAAAA, dns.RcodeSuccess, true},
+		// NODATA with only a signed SOA
+		{"www.example.com.", dns.TypeSRV, dns.RcodeServerFailure, false},
+		// NODATA with an NSEC which shows the type exists
+		{"www.example.com.", dns.TypeHINFO, dns.RcodeServerFailure, false},
+		{"wild.example.com.", dns.TypeA, dns.RcodeSuccess, true},
+
+		{"a.wild.example.com.", dns.TypeA, dns.RcodeSuccess, true},
+		// a wildcard answer without proof that the name doesn't exist
+		{"b.wild.example.com.", dns.TypeA, dns.RcodeServerFailure, false},
+
+		{"nx.n3.com.", dns.TypeA, dns.RcodeNameError, true},
+		// NXDOMAIN with an NSEC3 which shows the name exists
+		{"www.n3.com.", dns.TypeMX, dns.RcodeServerFailure, false},
+		{"www.n3.com.", dns.TypeAAAA, dns.RcodeSuccess, true},
+		// NODATA with only a signed SOA
+		{"www.n3.com.", dns.TypeTXT, dns.RcodeServerFailure, false},
+	}
+
+	for _, test := range tests {
+		qtype := dns.TypeToString[test.qtype]
+
+		resp, err := v.Query(DNSQuestion{Name: test.name, Type: test.qtype})
+		if err != nil {
+			t.Errorf("%v %v: %v", test.name, qtype, err)
+			continue
+		}
+		if resp.ResponseCode != test.rcode {
+			t.Errorf("%v %v: expected rcode %v, got %v", test.name, qtype,
+				dns.RcodeToString[test.rcode], dns.RcodeToString[resp.ResponseCode])
+		}
+		if resp.AuthenticatedData != test.ad {
+			t.Errorf("%v %v: expected AD %v, got %v", test.name, qtype, test.ad, resp.AuthenticatedData)
+		}
+	}
+}
+
+func TestCanonicalCompare(t *testing.T) {
+	// the example of RFC 4034 section 6.1
+	names := []string{
+		"example.",
+		"a.example.",
+		"yljkjljk.a.example.",
+		"Z.a.example.",
+		"zABC.a.EXAMPLE.",
+		"z.example.",
+		"\\001.z.example.",
+		"*.z.example.",
+		"\\200.z.example.",
+	}
+
+	for i := range names {
+		for j := range names {
+			expected := 0
+			if i < j {
+				expected = -1
+			} else if i > j {
+				expected = 1
+			}
+			if c := canonicalCompare(names[i], names[j]); c != expected {
+				t.Errorf("expected %v comparing %v and %v, got %v", expected, names[i], names[j], c)
+			}
+		}
+	}
+}
+
+func TestValidatingProviderWrongAnchor(t *testing.T) {
+	p, _ := newDNSSECTestProvider(t)
+
+	// the default root anchors won't match the test root key
+	v, err := NewValidatingProvider(p, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := v.Query(DNSQuestion{Name: "www.example.com.", Type: dns.TypeA})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.ResponseCode != dns.RcodeServerFailure {
+		t.Errorf("expected SERVFAIL, got %v", dns.RcodeToString[resp.ResponseCode])
+	}
+}
+
+func TestValidatorOptions(t *testing.T) {
+	if _, err := NewValidatingProvider(nil, &ValidatorOptions{
+		TrustAnchors: []string{"example.com. IN A 192.0.2.1"},
+	}); err == nil {
+		t.Error("expected an error for a non-DS trust anchor")
+	}
+	if _, err := NewValidatingProvider(nil, &ValidatorOptions{
+		TrustAnchors: []string{"not a record"},
+	}); err == nil {
+		t.Error("expected an error for an invalid trust anchor")
+	}
+}